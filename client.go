@@ -23,16 +23,24 @@ var (
 
 // Connect handshake with remote server using underlining net.Conn
 func Connect(ctx context.Context, c net.Conn, cfg *ClientConfig) (*ClientConn, error) {
+	return connect(ctx, c, cfg, nil, "")
+}
+
+// connect runs the handshake, drawing into canvas when set, which ServerInit resizes. The server
+// certificate must have x509Subject when it isn't empty.
+func connect(ctx context.Context, c net.Conn, cfg *ClientConfig, canvas *VncCanvas, x509Subject string) (*ClientConn, error) {
 	conn, err := NewClientConn(c, cfg)
 	if err != nil {
 		conn.Close()
 		cfg.ErrorCh <- err
 		return nil, err
 	}
+	conn.x509Subject = x509Subject
 
 	if len(cfg.Handlers) == 0 {
 		cfg.Handlers = DefaultClientHandlers
 	}
+	conn.Canvas = canvas
 
 	for _, h := range cfg.Handlers {
 		if err := h.Handle(conn); err != nil {
@@ -43,9 +51,11 @@ func Connect(ctx context.Context, c net.Conn, cfg *ClientConfig) (*ClientConn, e
 		}
 	}
 
-	canvas := NewVncCanvas(int(conn.Width()), int(conn.Height()))
-	canvas.DrawCursor = cfg.DrawCursor
-	conn.Canvas = canvas
+	if conn.Canvas == nil {
+		canvas = NewVncCanvas(int(conn.Width()), int(conn.Height()))
+		canvas.DrawCursor = cfg.DrawCursor
+		conn.Canvas = canvas
+	}
 	return conn, nil
 }
 
@@ -75,20 +85,61 @@ func (c *ClientConn) Conn() net.Conn {
 	return c.c
 }
 
+// SetConn replaces the underlining net.Conn, used by security handlers wrapping it with TLS.
+// Buffered writes are flushed first, the new conn gets new buffers.
+func (c *ClientConn) SetConn(conn net.Conn) error {
+	if err := c.bw.Flush(); err != nil {
+		return err
+	}
+	if c.br.Buffered() > 0 {
+		return fmt.Errorf("can't replace a conn with %d unread bytes", c.br.Buffered())
+	}
+	c.c = conn
+	c.br = bufio.NewReader(conn)
+	c.bw = bufio.NewWriter(conn)
+	return nil
+}
+
 // SetProtoVersion sets proto version
 func (c *ClientConn) SetProtoVersion(pv string) {
 	c.protocol = pv
 }
 
-// SetEncodings write SetEncodings message
+// SetEncodings write SetEncodings message, adding the pseudo encodings of the extensions the
+// client is configured for
 func (c *ClientConn) SetEncodings(encs []EncodingType) error {
+	return c.encodingsMessage(encs).Write(c)
+}
 
-	msg := &SetEncodings{
+// encodingsMessage returns the SetEncodings message of encs and the pseudo encodings of the
+// configured extensions
+func (c *ClientConn) encodingsMessage(encs []EncodingType) *SetEncodings {
+	var exts []EncodingType
+	if c.cfg.ContinuousUpdates {
+		exts = append(exts, EncContinuousUpdatesPseudo, EncFencePseudo)
+	}
+	if c.cfg.ExtendedClipboard {
+		exts = append(exts, EncExtendedClipboardPseudo)
+	}
+	if c.cfg.Xvp {
+		exts = append(exts, EncXvpPseudo)
+	}
+	// updates ended by LastRect are always read
+	exts = append(exts, EncLastRectPseudo)
+	for _, ext := range exts {
+		found := false
+		for _, enc := range encs {
+			found = found || enc == ext
+		}
+		if !found {
+			encs = append(encs, ext)
+		}
+	}
+
+	return &SetEncodings{
 		EncNum:    uint16(len(encs)),
 		Encodings: encs,
 	}
-
-	return msg.Write(c)
 }
 
 // Flush flushes data to conn
@@ -113,6 +164,11 @@ func (c *ClientConn) Read(buf []byte) (int, error) {
 	return c.br.Read(buf)
 }
 
+// Peek returns the next n bytes without reading them
+func (c *ClientConn) Peek(n int) ([]byte, error) {
+	return c.br.Peek(n)
+}
+
 // Write data to conn must be Flushed
 func (c *ClientConn) Write(buf []byte) (int, error) {
 	return c.bw.Write(buf)
@@ -223,6 +279,28 @@ type ClientConn struct {
 	// SetPixelFormat method.
 	pixelFormat PixelFormat
 
+	// continuousUpdates is set while the server sends continuous updates of continuousRegion
+	continuousUpdates int32
+	continuousRegion  *EnableContinuousUpdates
+
+	// qemuKeyEvents is set once the server accepts QEMUExtendedKeyEvent, relativePointer while
+	// it asks for relative pointer motion
+	qemuKeyEvents   int32
+	relativePointer int32
+
+	// xvpVersion is set once the server sent XvpInit, xvpAction is the last action sent
+	xvpVersion int32
+	xvpAction  int32
+
+	// redirect is set by ClientRedirectPseudoEncoding, and followed after its update
+	redirect *ClientRedirect
+	// x509Subject is the certificate subject of the server the client was redirected to
+	x509Subject string
+
+	clipboard clipboard
+	// messages are written by the message handler, with the ones from ClientMessageCh
+	messages chan ClientMessage
+
 	quitCh  chan struct{}
 	quit    chan struct{}
 	errorCh chan error
@@ -249,6 +327,7 @@ func NewClientConn(c net.Conn, cfg *ClientConfig) (*ClientConn, error) {
 		errorCh:     cfg.ErrorCh,
 		pixelFormat: cfg.PixelFormat,
 		quit:        make(chan struct{}),
+		messages:    make(chan ClientMessage, 16),
 	}, nil
 }
 
@@ -259,7 +338,6 @@ type DefaultClientMessageHandler struct{}
 func (*DefaultClientMessageHandler) Handle(c Conn) error {
 	logger.Trace("starting DefaultClientMessageHandler")
 	cfg := c.Config().(*ClientConfig)
-	var err error
 	var wg sync.WaitGroup
 	wg.Add(2)
 	//defer c.Close()
@@ -269,15 +347,20 @@ func (*DefaultClientMessageHandler) Handle(c Conn) error {
 		serverMessages[m.Type()] = m
 	}
 
+	quit := c.(*ClientConn).quit
 	go func() {
 		defer wg.Done()
 		for {
+			var msg ClientMessage
 			select {
-			case msg := <-cfg.ClientMessageCh:
-				if err = msg.Write(c); err != nil {
-					cfg.ErrorCh <- err
-					return
-				}
+			case <-quit:
+				return
+			case msg = <-cfg.ClientMessageCh:
+			case msg = <-c.(*ClientConn).messages:
+			}
+			if err := msg.Write(c); err != nil {
+				cfg.ErrorCh <- err
+				return
 			}
 		}
 	}()
@@ -288,15 +371,14 @@ func (*DefaultClientMessageHandler) Handle(c Conn) error {
 			select {
 			default:
 				var messageType ServerMessageType
-				if err = binary.Read(c, binary.BigEndian, &messageType); err != nil {
+				if err := binary.Read(c, binary.BigEndian, &messageType); err != nil {
 					cfg.ErrorCh <- err
 					return
 				}
 				logger.Infof("========got server message, msgType=%d", messageType)
 				msg, ok := serverMessages[messageType]
 				if !ok {
-					err = fmt.Errorf("unknown message-type: %v", messageType)
-					cfg.ErrorCh <- err
+					cfg.ErrorCh <- fmt.Errorf("unknown message-type: %v", messageType)
 					return
 				}
 				canvas := c.(*ClientConn).Canvas
@@ -310,7 +392,14 @@ func (*DefaultClientMessageHandler) Handle(c Conn) error {
 					cfg.ErrorCh <- err
 					return
 				}
+				c.(*ClientConn).handleContinuousUpdates(parsedMsg)
+				c.(*ClientConn).handleClipboard(parsedMsg)
+				c.(*ClientConn).handleXvp(parsedMsg)
 				cfg.ServerMessageCh <- parsedMsg
+				if redirect := c.(*ClientConn).redirect; redirect != nil {
+					c.(*ClientConn).followRedirect(redirect)
+					return
+				}
 			}
 		}
 	}()
@@ -325,12 +414,13 @@ func (*DefaultClientMessageHandler) Handle(c Conn) error {
 	for _, value := range encTypes {
 		v = append(v, value)
 	}
+	// the messages are written by the writing goroutine, like all the others
 	logger.Tracef("setting encodings: %v", v)
-	c.SetEncodings(v)
+	c.(*ClientConn).queue(c.(*ClientConn).encodingsMessage(v))
 
-	firstMsg := FramebufferUpdateRequest{Inc: 0, X: 0, Y: 0, Width: c.Width(), Height: c.Height()}
+	firstMsg := &FramebufferUpdateRequest{Inc: 0, X: 0, Y: 0, Width: c.Width(), Height: c.Height()}
 	logger.Tracef("sending initial req message: %v", firstMsg)
-	firstMsg.Write(c)
+	c.(*ClientConn).queue(firstMsg)
 
 	//wg.Wait()
 	return nil
@@ -348,8 +438,25 @@ type ClientConfig struct {
 	ServerMessageCh  chan ServerMessage
 	Exclusive        bool
 	DrawCursor       bool
-	Messages         []ServerMessage
-	QuitCh           chan struct{}
-	ErrorCh          chan error
-	quit             chan struct{}
+	// ContinuousUpdates asks the server to push the updates without update requests, with fence
+	// based flow control, when it supports them. See ClientConn.ContinuousUpdates.
+	ContinuousUpdates bool
+	// ExtendedClipboard announces the extended clipboard, exchanging UTF-8 text, RTF and
+	// HTML with the servers supporting it instead of Latin-1 text
+	ExtendedClipboard bool
+	// ClipboardCh gets the server's clipboard, see ClientConn.SetClipboard for the client's
+	ClipboardCh chan *ClipboardEvent
+	// Xvp announces the xvp extension, see ClientConn.XvpAction
+	Xvp bool
+	// XvpFailed is called by the message handler when the server failed the last xvp action
+	XvpFailed func(c *ClientConn, action XvpCode)
+	// RedirectDial connects to the server of a ClientRedirectPseudoEncoding, over TCP when nil
+	RedirectDial func(redirect *ClientRedirect) (net.Conn, error)
+	// RedirectCh gets the connection to the server the client was redirected to, which draws
+	// into the same canvas
+	RedirectCh chan *ClientConn
+	Messages   []ServerMessage
+	QuitCh     chan struct{}
+	ErrorCh    chan error
+	quit       chan struct{}
 }
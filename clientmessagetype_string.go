@@ -7,11 +7,19 @@ import "fmt"
 const (
 	_ClientMessageType_name_0 = "SetPixelFormatMsgType"
 	_ClientMessageType_name_1 = "SetEncodingsMsgTypeFramebufferUpdateRequestMsgTypeKeyEventMsgTypePointerEventMsgTypeClientCutTextMsgType"
+	_ClientMessageType_name_2 = "EnableContinuousUpdatesMsgType"
+	_ClientMessageType_name_3 = "ClientFenceMsgType"
+	_ClientMessageType_name_4 = "ClientXvpMsgTypeSetDesktopSizeMsgType"
+	_ClientMessageType_name_5 = "QEMUMsgType"
 )
 
 var (
 	_ClientMessageType_index_0 = [...]uint8{0, 21}
 	_ClientMessageType_index_1 = [...]uint8{0, 19, 50, 65, 84, 104}
+	_ClientMessageType_index_2 = [...]uint8{0, 30}
+	_ClientMessageType_index_3 = [...]uint8{0, 18}
+	_ClientMessageType_index_4 = [...]uint8{0, 16, 37}
+	_ClientMessageType_index_5 = [...]uint8{0, 11}
 )
 
 func (i ClientMessageType) String() string {
@@ -21,6 +29,15 @@ func (i ClientMessageType) String() string {
 	case 2 <= i && i <= 6:
 		i -= 2
 		return _ClientMessageType_name_1[_ClientMessageType_index_1[i]:_ClientMessageType_index_1[i+1]]
+	case i == 150:
+		return _ClientMessageType_name_2
+	case i == 248:
+		return _ClientMessageType_name_3
+	case 250 <= i && i <= 251:
+		i -= 250
+		return _ClientMessageType_name_4[_ClientMessageType_index_4[i]:_ClientMessageType_index_4[i+1]]
+	case i == 255:
+		return _ClientMessageType_name_5
 	default:
 		return fmt.Sprintf("ClientMessageType(%d)", i)
 	}
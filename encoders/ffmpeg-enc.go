@@ -0,0 +1,258 @@
+package encoders
+
+import (
+	"image"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amitbet/vnc2video/logger"
+)
+
+// FFmpegPreset is a codec configuration for FFmpegEncoder
+type FFmpegPreset struct {
+	// Codec is the ffmpeg video codec name
+	Codec string
+	// Args are the codec options
+	Args []string
+	// Container is the default output container (the file extension)
+	Container string
+	// ConstantFrameRate makes ffmpeg repeat frames to the encoder frame rate, for containers
+	// without frame timestamps
+	ConstantFrameRate bool
+}
+
+var (
+	// PresetX264 is the market standard, h264 in an mp4
+	PresetX264 = FFmpegPreset{
+		Codec:     "libx264",
+		Args:      []string{"-preset", "veryfast", "-g", "250", "-crf", "37"},
+		Container: "mp4",
+	}
+	// PresetVP8 is the common codec for webm
+	PresetVP8 = FFmpegPreset{
+		Codec: "libvpx",
+		Args: []string{"-quality", "good", "-cpu-used", "-16",
+			"-b:v", "0.5M", "-minrate", "0.2M", "-maxrate", "0.7M", "-bufsize", "50M",
+			"-g", "180", "-keyint_min", "180", "-qmin", "3", "-qmax", "51"},
+		Container: "webm",
+	}
+	// PresetVP9 compresses better than vp8, and is supported by most browsers
+	PresetVP9 = FFmpegPreset{
+		Codec: "libvpx-vp9",
+		Args: []string{"-deadline", "realtime", "-cpu-used", "-8",
+			"-b:v", "1M", "-maxrate", "2.5M", "-bufsize", "10M",
+			"-g", "120", "-qmin", "11", "-qmax", "51"},
+		Container: "webm",
+	}
+	// PresetHuffYuv is lossless and light on cpu, but the files are large (50-100 MB/min)
+	PresetHuffYuv = FFmpegPreset{
+		Codec:             "huffyuv",
+		Container:         "avi",
+		ConstantFrameRate: true,
+	}
+	// PresetQTRLE is the best lossless compression for screen content (10-20 MB/min)
+	PresetQTRLE = FFmpegPreset{
+		Codec:     "qtrle",
+		Container: "mov",
+	}
+)
+
+// ffmpegFormats maps containers to ffmpeg output format names, when they differ
+var ffmpegFormats = map[string]string{
+	"mkv": "matroska",
+}
+
+// FFmpegEncoder encodes video by piping the frames to an ffmpeg process
+type FFmpegEncoder struct {
+	// FFMpegBinPath is the ffmpeg binary, found in the PATH when empty
+	FFMpegBinPath string
+	Preset        FFmpegPreset
+	// ExtraArgs are passed to ffmpeg after the preset arguments, overriding them
+	ExtraArgs []string
+	// Container overrides the preset container
+	Container string
+	Framerate int
+	// Width and Height are the video size, the size of the first frame when zero. Frames of
+	// another size, after the desktop was resized, are fitted to it as set by ResizeMode.
+	Width      int
+	Height     int
+	ResizeMode ResizeMode
+
+	cmd    *exec.Cmd
+	input  io.WriteCloser
+	frames *ffmpegInput
+	// mu guards the fields below and the writes to input
+	mu     sync.Mutex
+	closed bool
+	// started is set once ffmpeg is started, done is closed when it exits with err
+	started bool
+	done    chan struct{}
+	err     error
+}
+
+// NewFFmpegEncoder returns an encoder using the given preset
+func NewFFmpegEncoder(preset FFmpegPreset, framerate int, extraArgs ...string) *FFmpegEncoder {
+	return &FFmpegEncoder{Preset: preset, Framerate: framerate, ExtraArgs: extraArgs}
+}
+
+// args returns the ffmpeg command line arguments
+func (enc *FFmpegEncoder) args(videoFileName string) []string {
+	container := enc.Container
+	if container == "" {
+		container = enc.Preset.Container
+	}
+	args := []string{"-y", "-f", "matroska", "-i", "-", "-an", "-vcodec", enc.Preset.Codec}
+	args = append(args, enc.Preset.Args...)
+	if enc.Preset.ConstantFrameRate {
+		args = append(args, "-r", strconv.Itoa(enc.Framerate))
+	} else {
+		args = append(args, "-vsync", "vfr")
+	}
+	args = append(args, enc.ExtraArgs...)
+	if container != "" {
+		if !strings.HasSuffix(videoFileName, "."+container) {
+			videoFileName = videoFileName + "." + container
+		}
+		format := ffmpegFormats[container]
+		if format == "" {
+			format = container
+		}
+		args = append(args, "-f", format)
+	}
+	return append(args, videoFileName)
+}
+
+func (enc *FFmpegEncoder) Init(videoFileName string) {
+	if enc.Framerate == 0 {
+		enc.Framerate = 12
+	}
+	binary := enc.FFMpegBinPath
+	if binary == "" {
+		binary = "ffmpeg"
+	}
+	cmd := exec.Command(binary, enc.args(videoFileName)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	encInput, err := cmd.StdinPipe()
+	if err != nil {
+		logger.Error("can't get ffmpeg input pipe: ", err)
+	}
+	enc.input = encInput
+	enc.frames = newFFmpegInput(encInput, enc.Framerate)
+	enc.frames.fitter = frameFitter{mode: enc.ResizeMode, size: image.Pt(enc.Width, enc.Height)}
+	enc.done = make(chan struct{})
+	enc.cmd = cmd
+}
+
+// Run runs ffmpeg until the encoder is closed, calling Init first if needed. Without Run,
+// ffmpeg is started by the first frame.
+func (enc *FFmpegEncoder) Run(videoFileName string) error {
+	enc.mu.Lock()
+	if enc.cmd == nil {
+		enc.Init(videoFileName)
+	}
+	if enc.closed && !enc.started {
+		// closed before any frame, there is nothing to encode
+		enc.mu.Unlock()
+		return nil
+	}
+	if !enc.started {
+		enc.start()
+	}
+	enc.mu.Unlock()
+	<-enc.done
+	return enc.err
+}
+
+// start launches ffmpeg and waits for it to exit in the background, called with the lock held
+func (enc *FFmpegEncoder) start() error {
+	enc.started = true
+	logger.Debugf("launching binary: %v", enc.cmd.Args)
+	if err := enc.cmd.Start(); err != nil {
+		logger.Errorf("error while launching ffmpeg: %v\n err: %v", enc.cmd.Args, err)
+		enc.err = err
+		close(enc.done)
+		return err
+	}
+	go enc.wait()
+	return nil
+}
+
+func (enc *FFmpegEncoder) wait() {
+	err := enc.cmd.Wait()
+	if err != nil {
+		logger.Errorf("ffmpeg failed: %v\n err: %v", enc.cmd.Args, err)
+	}
+	enc.err = err
+	close(enc.done)
+}
+
+// ready starts ffmpeg with the first frame, since nothing reads the input pipe before. It returns
+// false when frames can't be written, called with the lock held.
+func (enc *FFmpegEncoder) ready() bool {
+	if enc.input == nil || enc.closed {
+		return false
+	}
+	if !enc.started {
+		return enc.start() == nil
+	}
+	select {
+	case <-enc.done:
+		// ffmpeg exited, nothing reads the input anymore
+		return false
+	default:
+		return true
+	}
+}
+
+func (enc *FFmpegEncoder) Encode(img image.Image) {
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+	if !enc.ready() {
+		return
+	}
+
+	err := enc.frames.encode(img)
+	if err != nil {
+		logger.Error("error while encoding image:", err)
+	}
+}
+
+// EncodeAt encodes a frame shown from pts on
+func (enc *FFmpegEncoder) EncodeAt(img image.Image, pts time.Duration) {
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+	if !enc.ready() {
+		return
+	}
+
+	err := enc.frames.encodeAt(img, pts)
+	if err != nil {
+		logger.Error("error while encoding image:", err)
+	}
+}
+
+// Close ends the input and waits for ffmpeg to finish writing the video file
+func (enc *FFmpegEncoder) Close() {
+	enc.mu.Lock()
+	if enc.closed || enc.cmd == nil {
+		enc.closed = true
+		enc.mu.Unlock()
+		return
+	}
+	enc.closed = true
+	if err := enc.input.Close(); err != nil {
+		logger.Error("error while closing ffmpeg input:", err)
+	}
+	started := enc.started
+	enc.mu.Unlock()
+	if started {
+		<-enc.done
+	}
+}
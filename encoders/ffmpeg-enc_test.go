@@ -0,0 +1,117 @@
+package encoders
+
+import (
+	"bytes"
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func indexOf(args []string, arg string) int {
+	for i, a := range args {
+		if a == arg {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestFFmpegEncoderClose(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake ffmpeg is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "ffmpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the fake ffmpeg copies its input to the output file, after a delay Close has to wait for
+	script := filepath.Join(dir, "ffmpeg")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\nfor last; do true; done\nsleep 0.2\ncat > \"$last\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	enc := &FFmpegEncoder{FFMpegBinPath: script, Preset: PresetX264, Framerate: 10, ExtraArgs: []string{"-crf", "20"}}
+	videoFileName := filepath.Join(dir, "out")
+	enc.Init(videoFileName)
+	args := enc.cmd.Args
+	if args[len(args)-1] != videoFileName+".mp4" || indexOf(args, "20") < indexOf(args, "37") || indexOf(args, "-vsync") < 0 {
+		t.Fatalf("unexpected ffmpeg arguments %v", args)
+	}
+	done := make(chan error)
+	go func() { done <- enc.Run(videoFileName) }()
+
+	img := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	enc.Encode(img)
+	enc.EncodeAt(img, time.Second)
+	enc.Close()
+
+	expected := &bytes.Buffer{}
+	frames := newFFmpegInput(expected, 10)
+	frames.encode(img)
+	frames.encodeAt(img, time.Second)
+	video, err := ioutil.ReadFile(videoFileName + ".mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(video, expected.Bytes()) {
+		t.Fatalf("got %d bytes of video, want %d", len(video), expected.Len())
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFFmpegEncoderWithoutRun(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake ffmpeg is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "ffmpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "ffmpeg")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\nfor last; do true; done\ncat > \"$last\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	enc := &FFmpegEncoder{FFMpegBinPath: script, Preset: PresetX264, Framerate: 10}
+	videoFileName := filepath.Join(dir, "out")
+	enc.Init(videoFileName)
+
+	// the frame is larger than the pipe buffer, ffmpeg has to be reading it
+	img := image.NewRGBA(image.Rect(0, 0, 200, 200))
+	encoded := make(chan struct{})
+	go func() {
+		enc.Encode(img)
+		close(encoded)
+		for i := 1; i < 10; i++ {
+			enc.EncodeAt(img, time.Duration(i)*time.Second)
+		}
+	}()
+	select {
+	case <-encoded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Encode blocked before Run")
+	}
+	enc.Close()
+	// frames after Close are dropped
+	enc.Encode(img)
+	if err := enc.Run(videoFileName); err != nil {
+		t.Fatal(err)
+	}
+
+	video, err := ioutil.ReadFile(videoFileName + ".mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &bytes.Buffer{}
+	newFFmpegInput(expected, 10).encode(img)
+	if len(video) < expected.Len() || !bytes.Equal(video[:expected.Len()], expected.Bytes()) {
+		t.Fatalf("got %d bytes of video, want the %d bytes of the first frame first", len(video), expected.Len())
+	}
+}
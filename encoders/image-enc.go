@@ -2,103 +2,179 @@ package encoders
 
 import (
 	"errors"
-	"fmt"
 	"image"
 	"image/color"
 	"io"
+	"time"
+
 	"github.com/amitbet/vnc2video"
 )
 
-func encodePPMGeneric(w io.Writer, img image.Image) error {
-	maxvalue := 255
+// rgb24Pixels returns the image pixels as packed RGB triplets, the returned slice is either
+// buf (grown when too small) or the pixels of an RGBImage, which already has this layout
+func rgb24Pixels(img image.Image, buf []byte) []byte {
 	size := img.Bounds()
-	// write ppm header
-	_, err := fmt.Fprintf(w, "P6\n%d %d\n%d\n", size.Dx(), size.Dy(), maxvalue)
-	if err != nil {
-		return err
+	n := size.Dx() * size.Dy() * 3
+	if rgbImg, ok := img.(*vnc2video.RGBImage); ok && rgbImg.Stride == size.Dx()*3 {
+		return rgbImg.Pix[:n]
+	}
+	if len(buf) < n {
+		buf = make([]byte, n)
+	}
+	i := 0
+	if rgbaImg, ok := img.(*image.RGBA); ok {
+		for y := size.Min.Y; y < size.Max.Y; y++ {
+			row := rgbaImg.Pix[rgbaImg.PixOffset(size.Min.X, y):rgbaImg.PixOffset(size.Max.X, y)]
+			for j := 0; j < len(row); j += 4 {
+				buf[i], buf[i+1], buf[i+2] = row[j], row[j+1], row[j+2]
+				i += 3
+			}
+		}
+		return buf[:n]
 	}
 
-	// write the bitmap
 	colModel := color.RGBAModel
-	row := make([]uint8, size.Dx()*3)
 	for y := size.Min.Y; y < size.Max.Y; y++ {
-		i := 0
 		for x := size.Min.X; x < size.Max.X; x++ {
-			color := colModel.Convert(img.At(x, y)).(color.RGBA)
-			row[i] = color.R
-			row[i+1] = color.G
-			row[i+2] = color.B
+			c := colModel.Convert(img.At(x, y)).(color.RGBA)
+			buf[i], buf[i+1], buf[i+2] = c.R, c.G, c.B
 			i += 3
 		}
-		if _, err := w.Write(row); err != nil {
-			return err
-		}
 	}
-	return nil
+	return buf[:n]
 }
 
-var convImage []uint8
+// ResizeMode is how an encoder with a fixed video size writes frames of another size, after the
+// remote desktop was resized
+type ResizeMode int
 
-func encodePPMforRGBA(w io.Writer, img *image.RGBA) error {
-	maxvalue := 255
-	size := img.Bounds()
-	// write ppm header
-	_, err := fmt.Fprintf(w, "P6\n%d %d\n%d\n", size.Dx(), size.Dy(), maxvalue)
-	if err != nil {
-		return err
-	}
+const (
+	// ResizePad draws the frame at the top left of the video, cropped or padded with black
+	ResizePad ResizeMode = iota
+	// ResizeScale scales the frame to fit the video keeping its aspect ratio, centered between
+	// black bars
+	ResizeScale
+)
 
-	if convImage == nil {
-		convImage = make([]uint8, size.Dy()*size.Dx()*3)
-	}
+// frameFitter fits frames to the video size, which is the size of the first frame unless set
+type frameFitter struct {
+	mode  ResizeMode
+	size  image.Point
+	frame *vnc2video.RGBImage
+	buf   []byte
+}
 
-	rowCount := 0
-	for i := 0; i < len(img.Pix); i++ {
-		if (i % 4) != 3 {
-			convImage[rowCount] = img.Pix[i]
-			rowCount++
+// fit returns img when it has the video size, or else a frame of the video size holding img,
+// which is reused by the next call
+func (f *frameFitter) fit(img image.Image) image.Image {
+	size := img.Bounds().Size()
+	if f.size.X <= 0 || f.size.Y <= 0 {
+		f.size = size
+	}
+	if size == f.size {
+		return img
+	}
+	if f.frame == nil {
+		f.frame = vnc2video.NewRGBImage(image.Rectangle{Max: f.size})
+	} else {
+		for i := range f.frame.Pix {
+			f.frame.Pix[i] = 0
 		}
 	}
+	if size.X <= 0 || size.Y <= 0 {
+		return f.frame
+	}
+	src := rgb24Pixels(img, f.buf)
+	if _, ok := img.(*vnc2video.RGBImage); !ok {
+		f.buf = src
+	}
+	dst := f.frame
+	if f.mode == ResizeScale {
+		// the largest size with the frame aspect ratio, nearest neighbour sampled
+		w, h := f.size.X, size.Y*f.size.X/size.X
+		if h > f.size.Y {
+			w, h = size.X*f.size.Y/size.Y, f.size.Y
+		}
+		x0, y0 := (f.size.X-w)/2, (f.size.Y-h)/2
+		for y := 0; y < h; y++ {
+			srcRow := src[y*size.Y/h*size.X*3:]
+			dstRow := dst.Pix[(y0+y)*dst.Stride+x0*3:]
+			for x := 0; x < w; x++ {
+				copy(dstRow[x*3:x*3+3], srcRow[x*size.X/w*3:])
+			}
+		}
+		return dst
+	}
+	rowLen := 3 * vnc2video.Min(size.X, f.size.X)
+	for y := 0; y < vnc2video.Min(size.Y, f.size.Y); y++ {
+		copy(dst.Pix[y*dst.Stride:y*dst.Stride+rowLen], src[y*size.X*3:])
+	}
+	return dst
+}
 
-	if _, err := w.Write(convImage); err != nil {
-		return err
+// ffmpegInput feeds ffmpeg ("-f matroska -i -") with raw RGB frames in a Matroska stream, which
+// carries each frame's timestamp, so frames only need to be written when the screen changes.
+// The output keeps the timestamps with "-vsync vfr".
+type ffmpegInput struct {
+	mkv       *mkvWriter
+	w         io.Writer
+	framerate int
+	next      time.Duration
+	buf       []byte
+	// fitter keeps the frame size of the stream, which can't change
+	fitter frameFitter
+}
+
+// newFFmpegInput returns an input of framerate frames per second, 12 when it isn't set
+func newFFmpegInput(w io.Writer, framerate int) *ffmpegInput {
+	if framerate <= 0 {
+		framerate = 12
 	}
+	return &ffmpegInput{w: w, framerate: framerate}
+}
 
-	return nil
+// encode writes a frame 1/framerate seconds after the previous one
+func (in *ffmpegInput) encode(img image.Image) error {
+	return in.encodeAt(img, in.next)
 }
 
-func encodePPM(w io.Writer, img image.Image) error {
+// encodeAt writes a frame shown from pts until the next frame
+func (in *ffmpegInput) encodeAt(img image.Image, pts time.Duration) error {
 	if img == nil {
 		return errors.New("nil image")
 	}
-	img1, isRGBImage := img.(*vnc2video.RGBImage)
-	img2, isRGBA := img.(*image.RGBA)
-	if isRGBImage {
-		return encodePPMforRGBImage(w, img1)
-	} else if isRGBA {
-		return encodePPMforRGBA(w, img2)
+	img = in.fitter.fit(img)
+	if in.mkv == nil {
+		in.mkv = newMkvWriter(in.w, mkvTrack{
+			CodecID:     "V_UNCOMPRESSED",
+			ColourSpace: []byte{'R', 'G', 'B', 24},
+			Width:       in.fitter.size.X,
+			Height:      in.fitter.size.Y,
+		})
 	}
-	return encodePPMGeneric(w, img)
-}
-
-func encodePPMforRGBImage(w io.Writer, img *vnc2video.RGBImage) error {
-	maxvalue := 255
-	size := img.Bounds()
-	// write ppm header
-	_, err := fmt.Fprintf(w, "P6\n%d %d\n%d\n", size.Dx(), size.Dy(), maxvalue)
-	if err != nil {
-		return err
+	pix := rgb24Pixels(img, in.buf)
+	if _, ok := img.(*vnc2video.RGBImage); !ok {
+		in.buf = pix
 	}
-
-	if _, err := w.Write(img.Pix); err != nil {
+	if err := in.mkv.WriteFrame(pix, pts, true); err != nil {
 		return err
 	}
+	in.next = pts + time.Second/time.Duration(in.framerate)
 	return nil
 }
 
+// ImageEncoder encodes frames to a video file. Init prepares the encoding, Run does the encoding
+// (calling Init if it wasn't called) and blocks until Close for encoders running a process.
 type ImageEncoder interface {
 	Init(string)
-	Run()
+	Run(string) error
 	Encode(image.Image)
+	// EncodeAt encodes a frame shown from pts (the time since the start of the video) until
+	// the next frame, so frames only need to be encoded when the image changes
+	EncodeAt(image.Image, time.Duration)
 	Close()
 }
+
+var _ ImageEncoder = (*FFmpegEncoder)(nil)
+var _ ImageEncoder = (*MJPegImageEncoder)(nil)
+var _ ImageEncoder = (*PNGImageEncoder)(nil)
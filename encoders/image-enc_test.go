@@ -0,0 +1,118 @@
+package encoders
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amitbet/vnc2video"
+)
+
+// fillRGBA returns an image of the given size, with the color of each pixel set by fill
+func fillRGBA(width, height int, fill func(x, y int) color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, fill(x, y))
+		}
+	}
+	return img
+}
+
+// rgbRows returns the pixels of img as one string of R, G, B, or . (black) per row
+func rgbRows(img image.Image) []string {
+	var rows []string
+	size := img.Bounds()
+	for y := size.Min.Y; y < size.Max.Y; y++ {
+		row := ""
+		for x := size.Min.X; x < size.Max.X; x++ {
+			switch c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA); {
+			case c.R == 255:
+				row += "R"
+			case c.G == 255:
+				row += "G"
+			case c.B == 255:
+				row += "B"
+			default:
+				row += "."
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func TestFrameFitter(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	green := color.RGBA{0, 255, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+	// red on the left half, green on the right half, blue on the last row
+	halves := func(width, height int) *image.RGBA {
+		return fillRGBA(width, height, func(x, y int) color.RGBA {
+			switch {
+			case y == height-1:
+				return blue
+			case x < width/2:
+				return red
+			}
+			return green
+		})
+	}
+
+	for _, test := range []struct {
+		name   string
+		mode   ResizeMode
+		size   image.Point
+		frames []image.Image
+		want   []string
+	}{
+		{"pad larger", ResizePad, image.Pt(4, 3), []image.Image{halves(4, 3), halves(6, 4)}, []string{"RRRG", "RRRG", "RRRG"}},
+		{"pad smaller", ResizePad, image.Point{}, []image.Image{halves(4, 3), halves(2, 2)}, []string{"RG..", "BB..", "...."}},
+		{"scale wider", ResizeScale, image.Pt(4, 4), []image.Image{halves(4, 2)}, []string{"....", "RRGG", "BBBB", "...."}},
+		{"scale taller", ResizeScale, image.Pt(4, 2), []image.Image{halves(2, 2)}, []string{".RG.", ".BB."}},
+		{"scale down", ResizeScale, image.Pt(2, 2), []image.Image{halves(4, 4)}, []string{"RG", "RG"}},
+	} {
+		fitter := &frameFitter{mode: test.mode, size: test.size}
+		var fitted image.Image
+		for _, frame := range test.frames {
+			fitted = fitter.fit(frame)
+		}
+		if got, want := strings.Join(rgbRows(fitted), "/"), strings.Join(test.want, "/"); got != want {
+			t.Errorf("%s: got %s, want %s", test.name, got, want)
+		}
+	}
+
+	// frames of the video size aren't copied
+	img := vnc2video.NewRGBImage(image.Rect(0, 0, 4, 3))
+	fitter := &frameFitter{}
+	if fitter.fit(img) != image.Image(img) || fitter.fit(img) != image.Image(img) {
+		t.Error("frame of the video size was copied")
+	}
+}
+
+func TestFFmpegInputResize(t *testing.T) {
+	white := func(x, y int) color.RGBA { return color.RGBA{255, 255, 255, 255} }
+	out := &bytes.Buffer{}
+	in := newFFmpegInput(out, 10)
+	in.encode(fillRGBA(4, 3, white))
+	in.encodeAt(fillRGBA(8, 6, white), time.Second)
+	in.encodeAt(fillRGBA(2, 2, white), 2*time.Second)
+
+	frames, timestamps := readMkvFrames(t, out.Bytes())
+	if len(frames) != 3 || timestamps[2] != 2*time.Second {
+		t.Fatalf("got %d frames at %v", len(frames), timestamps)
+	}
+	// the stream keeps the first frame size, the smaller frame is padded with black
+	full := bytes.Repeat([]byte{255}, 4*3*3)
+	padded := make([]byte, 4*3*3)
+	copy(padded, bytes.Repeat([]byte{255}, 2*3))
+	copy(padded[4*3:], bytes.Repeat([]byte{255}, 2*3))
+	for i, want := range [][]byte{full, full, padded} {
+		if !bytes.Equal(frames[i], want) {
+			t.Errorf("frame %d: got %v, want %v", i, frames[i], want)
+		}
+	}
+}
@@ -5,16 +5,29 @@ import (
 	"image"
 	"image/jpeg"
 	"strings"
-	"github.com/amitbet/vnc2video/logger"
+	"time"
 
+	"github.com/amitbet/vnc2video/logger"
 	"github.com/icza/mjpeg"
 )
 
 type MJPegImageEncoder struct {
 	avWriter  mjpeg.AviWriter
+	err       error
 	Quality   int
 	Framerate int32
-	closed    bool
+	// Width and Height are the video size, the size of the first frame when zero. Frames of
+	// another size, after the desktop was resized, are fitted to it as set by ResizeMode.
+	Width      int
+	Height     int
+	ResizeMode ResizeMode
+	closed     bool
+	fileName   string
+	fitter     frameFitter
+	// frames written to the avi, which has a constant frame rate
+	written int64
+	// the last frame passed to EncodeAt, written once its duration is known
+	pending []byte
 }
 
 func (enc *MJPegImageEncoder) Init(videoFileName string) {
@@ -28,43 +41,109 @@ func (enc *MJPegImageEncoder) Init(videoFileName string) {
 	if enc.Framerate <= 0 {
 		enc.Framerate = 5
 	}
-	avWriter, err := mjpeg.New(videoFileName, 1024, 768, enc.Framerate)
+	enc.fileName = videoFileName
+	enc.fitter = frameFitter{mode: enc.ResizeMode, size: image.Pt(enc.Width, enc.Height)}
+	if enc.Width > 0 && enc.Height > 0 {
+		enc.create(enc.fitter.size)
+	}
+}
+
+// create writes the avi header, which has the video size
+func (enc *MJPegImageEncoder) create(size image.Point) {
+	avWriter, err := mjpeg.New(enc.fileName, int32(size.X), int32(size.Y), enc.Framerate)
 	if err != nil {
 		logger.Error("Error during mjpeg init: ", err)
 	}
 	enc.avWriter = avWriter
+	enc.err = err
+}
+
+func (enc *MJPegImageEncoder) Run(videoFileName string) error {
+	if enc.fileName == "" {
+		enc.Init(videoFileName)
+	}
+	return enc.err
 }
-func (enc *MJPegImageEncoder) Run(videoFileName string) {
-	enc.Init(videoFileName)
+
+// ready creates the avi at the size of the first frame, unless it already exists
+func (enc *MJPegImageEncoder) ready(img image.Image) bool {
+	if img == nil || enc.closed || enc.fileName == "" || enc.err != nil {
+		return false
+	}
+	if enc.avWriter == nil {
+		enc.create(img.Bounds().Size())
+	}
+	return enc.avWriter != nil
 }
 
 func (enc *MJPegImageEncoder) Encode(img image.Image) {
-	if enc.closed {
+	if !enc.ready(img) {
 		return
 	}
+	enc.flushPending(enc.written + 1)
+	enc.addFrame(enc.jpeg(img))
+}
 
+// EncodeAt encodes a frame shown from pts on. AVI frames have a fixed duration, the frame times
+// until pts are written as empty chunks, which players take for dropped frames and show the
+// previous frame for. Idle time costs 24 bytes of chunk header and index entry per frame time.
+func (enc *MJPegImageEncoder) EncodeAt(img image.Image, pts time.Duration) {
+	if !enc.ready(img) {
+		return
+	}
+	enc.flushPending(int64(pts) * int64(enc.Framerate) / int64(time.Second))
+	enc.pending = enc.jpeg(img)
+}
+
+// flushPending writes the pending frame followed by dropped frames until the video has the given
+// number of frames, a pending frame replaced within the same frame time is dropped
+func (enc *MJPegImageEncoder) flushPending(frames int64) {
+	if enc.pending == nil {
+		return
+	}
+	if enc.written < frames {
+		enc.addFrame(enc.pending)
+	}
+	for enc.written < frames {
+		enc.addFrame(nil)
+	}
+	enc.pending = nil
+}
+
+func (enc *MJPegImageEncoder) jpeg(img image.Image) []byte {
 	buf := &bytes.Buffer{}
 	jOpts := &jpeg.Options{Quality: enc.Quality}
 	if enc.Quality <= 0 {
 		jOpts = nil
 	}
-	err := jpeg.Encode(buf, img, jOpts)
+	err := jpeg.Encode(buf, enc.fitter.fit(img), jOpts)
 	if err != nil {
 		logger.Error("Error while creating jpeg: ", err)
 	}
 
 	//logger.Tracef("buff: %v\n", buf.Bytes())
+	return buf.Bytes()
+}
 
-	err = enc.avWriter.AddFrame(buf.Bytes())
+func (enc *MJPegImageEncoder) addFrame(frame []byte) {
+	err := enc.avWriter.AddFrame(frame)
 	if err != nil {
 		logger.Error("Error while adding frame to mjpeg: ", err)
 	}
+	enc.written++
 }
 
 func (enc *MJPegImageEncoder) Close() {
+	if enc.closed {
+		return
+	}
+	enc.closed = true
+	if enc.avWriter == nil {
+		return
+	}
+	enc.flushPending(enc.written + 1)
 	err := enc.avWriter.Close()
 
-	enc.closed = true
 	if err != nil {
 		logger.Error("Error while closing mjpeg: ", err)
 	}
@@ -0,0 +1,62 @@
+package encoders
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// aviFrameSizes returns the size of each frame chunk in the movi list of an avi
+func aviFrameSizes(t *testing.T, data []byte) []int {
+	pos := bytes.Index(data, []byte("movi"))
+	if pos < 0 {
+		t.Fatal("no movi list")
+	}
+	var sizes []int
+	for pos += 4; pos+8 <= len(data) && string(data[pos:pos+4]) == "00dc"; {
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		sizes = append(sizes, size)
+		pos += 8 + size + size&1
+	}
+	return sizes
+}
+
+func TestMJPegEncodeAt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mjpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "out.avi")
+
+	red := fillRGBA(16, 8, func(x, y int) color.RGBA { return color.RGBA{R: 255, A: 255} })
+	blue := fillRGBA(16, 8, func(x, y int) color.RGBA { return color.RGBA{B: 255, A: 255} })
+	enc := &MJPegImageEncoder{Framerate: 4}
+	if err := enc.Run(name); err != nil {
+		t.Fatal(err)
+	}
+	enc.EncodeAt(red, 0)
+	// idle for a second, then a frame replaced within its frame time
+	enc.EncodeAt(blue, time.Second)
+	enc.EncodeAt(red, time.Second+time.Millisecond)
+	enc.Close()
+
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := aviFrameSizes(t, data)
+	if len(sizes) != 5 || sizes[0] == 0 || sizes[4] == 0 {
+		t.Fatalf("got frame sizes %v, want a frame, 3 dropped frames and a frame", sizes)
+	}
+	for _, size := range sizes[1:4] {
+		if size != 0 {
+			t.Fatalf("got frame sizes %v, idle frame times should be empty", sizes)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package encoders
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// matroska element ids, see https://www.matroska.org/technical/elements.html
+const (
+	mkvEBML               = 0x1A45DFA3
+	mkvEBMLVersion        = 0x4286
+	mkvEBMLReadVersion    = 0x42F7
+	mkvEBMLMaxIDLength    = 0x42F2
+	mkvEBMLMaxSizeLength  = 0x42F3
+	mkvDocType            = 0x4282
+	mkvDocTypeVersion     = 0x4287
+	mkvDocTypeReadVersion = 0x4285
+	mkvSegment            = 0x18538067
+	mkvInfo               = 0x1549A966
+	mkvTimecodeScale      = 0x2AD7B1
+	mkvMuxingApp          = 0x4D80
+	mkvWritingApp         = 0x5741
+	mkvTracks             = 0x1654AE6B
+	mkvTrackEntry         = 0xAE
+	mkvTrackNumber        = 0xD7
+	mkvTrackUID           = 0x73C5
+	mkvTrackType          = 0x83
+	mkvFlagLacing         = 0x9C
+	mkvCodecID            = 0x86
+	mkvCodecPrivate       = 0x63A2
+	mkvVideo              = 0xE0
+	mkvPixelWidth         = 0xB0
+	mkvPixelHeight        = 0xBA
+	mkvColourSpace        = 0x2EB524
+	mkvCluster            = 0x1F43B675
+	mkvTimecode           = 0xE7
+	mkvSimpleBlock        = 0xA3
+)
+
+// mkvUnknownSize marks an element whose size isn't known when it is written (the live segment)
+var mkvUnknownSize = []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+// mkvTrack describes the single video track of an mkvWriter
+type mkvTrack struct {
+	CodecID      string
+	CodecPrivate []byte
+	// ColourSpace is the FourCC of V_UNCOMPRESSED frames
+	ColourSpace []byte
+	Width       int
+	Height      int
+}
+
+// mkvWriter writes a streamable Matroska file with one video track, each frame in a cluster
+// of its own so nothing needs to be seeked back to, and the file can be piped to ffmpeg.
+// Timestamps are in milliseconds.
+type mkvWriter struct {
+	w       io.Writer
+	track   mkvTrack
+	started bool
+}
+
+func newMkvWriter(w io.Writer, track mkvTrack) *mkvWriter {
+	return &mkvWriter{w: w, track: track}
+}
+
+func (m *mkvWriter) writeHeader() error {
+	header := &bytes.Buffer{}
+	mkvElement(header, mkvEBML,
+		mkvUint(mkvEBMLVersion, 1),
+		mkvUint(mkvEBMLReadVersion, 1),
+		mkvUint(mkvEBMLMaxIDLength, 4),
+		mkvUint(mkvEBMLMaxSizeLength, 8),
+		mkvString(mkvDocType, "matroska"),
+		mkvUint(mkvDocTypeVersion, 4),
+		mkvUint(mkvDocTypeReadVersion, 2),
+	)
+	mkvID(header, mkvSegment)
+	header.Write(mkvUnknownSize)
+	mkvElement(header, mkvInfo,
+		mkvUint(mkvTimecodeScale, uint64(time.Millisecond)),
+		mkvString(mkvMuxingApp, "vnc2video"),
+		mkvString(mkvWritingApp, "vnc2video"),
+	)
+
+	video := [][]byte{
+		mkvUint(mkvPixelWidth, uint64(m.track.Width)),
+		mkvUint(mkvPixelHeight, uint64(m.track.Height)),
+	}
+	if m.track.ColourSpace != nil {
+		video = append(video, mkvBinary(mkvColourSpace, m.track.ColourSpace))
+	}
+	entry := [][]byte{
+		mkvUint(mkvTrackNumber, 1),
+		mkvUint(mkvTrackUID, 1),
+		mkvUint(mkvTrackType, 1),
+		mkvUint(mkvFlagLacing, 0),
+		mkvString(mkvCodecID, m.track.CodecID),
+	}
+	if m.track.CodecPrivate != nil {
+		entry = append(entry, mkvBinary(mkvCodecPrivate, m.track.CodecPrivate))
+	}
+	entry = append(entry, mkvMaster(mkvVideo, video...))
+	mkvElement(header, mkvTracks, mkvMaster(mkvTrackEntry, entry...))
+
+	_, err := m.w.Write(header.Bytes())
+	return err
+}
+
+// WriteFrame writes a frame shown from pts on, the header is written with the first frame
+func (m *mkvWriter) WriteFrame(frame []byte, pts time.Duration, keyframe bool) error {
+	if pts < 0 {
+		return errors.New("mkvWriter: negative frame timestamp")
+	}
+	if !m.started {
+		if err := m.writeHeader(); err != nil {
+			return err
+		}
+		m.started = true
+	}
+
+	// the block timestamp is relative to the cluster's, which carries the whole of it
+	flags := byte(0)
+	if keyframe {
+		flags = 0x80
+	}
+	cluster := &bytes.Buffer{}
+	cluster.Write(mkvUint(mkvTimecode, uint64(pts/time.Millisecond)))
+	mkvID(cluster, mkvSimpleBlock)
+	mkvSize(cluster, uint64(4+len(frame)))
+	cluster.Write([]byte{0x81, 0, 0, flags})
+
+	header := &bytes.Buffer{}
+	mkvID(header, mkvCluster)
+	mkvSize(header, uint64(cluster.Len()+len(frame)))
+	header.Write(cluster.Bytes())
+	if _, err := m.w.Write(header.Bytes()); err != nil {
+		return err
+	}
+	_, err := m.w.Write(frame)
+	return err
+}
+
+func mkvID(buf *bytes.Buffer, id uint32) {
+	switch {
+	case id >= 1<<24:
+		buf.Write([]byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)})
+	case id >= 1<<16:
+		buf.Write([]byte{byte(id >> 16), byte(id >> 8), byte(id)})
+	case id >= 1<<8:
+		buf.Write([]byte{byte(id >> 8), byte(id)})
+	default:
+		buf.WriteByte(byte(id))
+	}
+}
+
+// mkvSize writes an element size as the shortest EBML variable length integer
+func mkvSize(buf *bytes.Buffer, size uint64) {
+	length := 1
+	// all ones is reserved for the unknown size
+	for size >= 1<<uint(7*length)-1 {
+		length++
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, size|1<<uint(7*length))
+	buf.Write(b[8-length:])
+}
+
+func mkvElement(buf *bytes.Buffer, id uint32, children ...[]byte) {
+	size := 0
+	for _, child := range children {
+		size += len(child)
+	}
+	mkvID(buf, id)
+	mkvSize(buf, uint64(size))
+	for _, child := range children {
+		buf.Write(child)
+	}
+}
+
+func mkvMaster(id uint32, children ...[]byte) []byte {
+	buf := &bytes.Buffer{}
+	mkvElement(buf, id, children...)
+	return buf.Bytes()
+}
+
+func mkvBinary(id uint32, data []byte) []byte {
+	return mkvMaster(id, data)
+}
+
+func mkvString(id uint32, s string) []byte {
+	return mkvMaster(id, []byte(s))
+}
+
+func mkvUint(id uint32, v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	i := 0
+	for i < 7 && b[i] == 0 {
+		i++
+	}
+	return mkvMaster(id, b[i:])
+}
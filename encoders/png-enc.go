@@ -0,0 +1,145 @@
+package encoders
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/png"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/amitbet/vnc2video"
+	"github.com/amitbet/vnc2video/logger"
+)
+
+// PNGImageEncoder is a native golang lossless encoder, writing each frame as a png in a matroska
+// file (the MPNG video for windows codec, played by ffmpeg based players and vlc).
+type PNGImageEncoder struct {
+	// CompressionLevel is the png compression, png.BestSpeed when zero
+	CompressionLevel png.CompressionLevel
+	// Framerate is the frame rate of frames without timestamps
+	Framerate int
+	// Width and Height are the video size, the size of the first frame when zero. Frames of
+	// another size, after the desktop was resized, are fitted to it as set by ResizeMode.
+	Width      int
+	Height     int
+	ResizeMode ResizeMode
+
+	file   *os.File
+	mkv    *mkvWriter
+	fitter frameFitter
+	png    png.Encoder
+	buf    bytes.Buffer
+	rgba   *image.RGBA
+	pix    []byte
+	next   time.Duration
+	err    error
+	closed bool
+}
+
+func (enc *PNGImageEncoder) Init(videoFileName string) {
+	fileExt := ".mkv"
+	if enc.Framerate <= 0 {
+		enc.Framerate = 12
+	}
+	if !strings.HasSuffix(videoFileName, fileExt) {
+		videoFileName = videoFileName + fileExt
+	}
+	enc.png.CompressionLevel = enc.CompressionLevel
+	if enc.png.CompressionLevel == png.DefaultCompression {
+		enc.png.CompressionLevel = png.BestSpeed
+	}
+	enc.fitter = frameFitter{mode: enc.ResizeMode, size: image.Pt(enc.Width, enc.Height)}
+	enc.file, enc.err = os.Create(videoFileName)
+	if enc.err != nil {
+		logger.Error("Error during png encoder init: ", enc.err)
+	}
+}
+
+func (enc *PNGImageEncoder) Run(videoFileName string) error {
+	if enc.file == nil && enc.err == nil {
+		enc.Init(videoFileName)
+	}
+	return enc.err
+}
+
+func (enc *PNGImageEncoder) Encode(img image.Image) {
+	enc.EncodeAt(img, enc.next)
+}
+
+// EncodeAt encodes a frame shown from pts on
+func (enc *PNGImageEncoder) EncodeAt(img image.Image, pts time.Duration) {
+	if enc.file == nil || enc.closed {
+		return
+	}
+	if err := enc.encodeAt(img, pts); err != nil {
+		logger.Error("Error while adding frame to png video: ", err)
+	}
+}
+
+func (enc *PNGImageEncoder) encodeAt(img image.Image, pts time.Duration) error {
+	if img == nil {
+		return errors.New("nil image")
+	}
+	// the track header has the frame size, which can't change
+	img = enc.fitter.fit(img)
+	if enc.mkv == nil {
+		size := enc.fitter.size
+		enc.mkv = newMkvWriter(enc.file, mkvTrack{
+			CodecID:      "V_MS/VFW/FOURCC",
+			CodecPrivate: bitmapInfoHeader(size.X, size.Y, "MPNG"),
+			Width:        size.X,
+			Height:       size.Y,
+		})
+	}
+
+	enc.buf.Reset()
+	if err := enc.png.Encode(&enc.buf, enc.opaque(img)); err != nil {
+		return err
+	}
+	if err := enc.mkv.WriteFrame(enc.buf.Bytes(), pts, true); err != nil {
+		return err
+	}
+	enc.next = pts + time.Second/time.Duration(enc.Framerate)
+	return nil
+}
+
+// opaque returns the image as an opaque RGBA image, which the png encoder writes as 24 bit color
+// without going through image.At for each pixel. The vnc canvas alpha isn't meaningful.
+func (enc *PNGImageEncoder) opaque(img image.Image) image.Image {
+	size := img.Bounds()
+	if enc.rgba == nil || enc.rgba.Rect != size {
+		enc.rgba = image.NewRGBA(size)
+	}
+	pix := rgb24Pixels(img, enc.pix)
+	if _, ok := img.(*vnc2video.RGBImage); !ok {
+		enc.pix = pix
+	}
+	dst := enc.rgba.Pix
+	for i, j := 0, 0; i < len(pix); i, j = i+3, j+4 {
+		dst[j], dst[j+1], dst[j+2], dst[j+3] = pix[i], pix[i+1], pix[i+2], 255
+	}
+	return enc.rgba
+}
+
+func (enc *PNGImageEncoder) Close() {
+	if enc.file == nil || enc.closed {
+		return
+	}
+	enc.closed = true
+	if err := enc.file.Close(); err != nil {
+		logger.Error("Error while closing png video: ", err)
+	}
+}
+
+// bitmapInfoHeader is the video for windows format description of compressed frames
+func bitmapInfoHeader(width, height int, fourcc string) []byte {
+	header := &bytes.Buffer{}
+	binary.Write(header, binary.LittleEndian, []uint32{40, uint32(width), uint32(height)})
+	binary.Write(header, binary.LittleEndian, []uint16{1, 24})
+	header.WriteString(fourcc)
+	binary.Write(header, binary.LittleEndian, []uint32{uint32(width * height * 3), 0, 0, 0, 0})
+	return header.Bytes()
+}
@@ -0,0 +1,155 @@
+package encoders
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/amitbet/vnc2video"
+)
+
+// readMkvVint reads an EBML id (keeping the length marker) or size
+func readMkvVint(data []byte, keepMarker bool) (uint64, int) {
+	length := 1
+	for length < 8 && data[0]&(0x80>>uint(length-1)) == 0 {
+		length++
+	}
+	v := uint64(0)
+	for _, b := range data[:length] {
+		v = v<<8 | uint64(b)
+	}
+	if !keepMarker {
+		v &= 1<<uint(7*length) - 1
+	}
+	return v, length
+}
+
+// readMkvFrames returns the frames and timestamps of an mkvWriter file
+func readMkvFrames(t *testing.T, data []byte) ([][]byte, []time.Duration) {
+	var frames [][]byte
+	var timestamps []time.Duration
+	var clusterTime time.Duration
+	for len(data) > 0 {
+		id, n := readMkvVint(data, true)
+		size, m := readMkvVint(data[n:], false)
+		data = data[n+m:]
+		switch id {
+		case mkvSegment, mkvCluster:
+			// descend into the children
+			continue
+		case mkvTimecode:
+			clusterTime = 0
+			for _, b := range data[:size] {
+				clusterTime = clusterTime<<8 | time.Duration(b)
+			}
+			clusterTime *= time.Millisecond
+		case mkvSimpleBlock:
+			if data[0] != 0x81 || data[3] != 0x80 {
+				t.Fatalf("unexpected block header %v", data[:4])
+			}
+			frames = append(frames, data[4:size])
+			timestamps = append(timestamps, clusterTime)
+		}
+		data = data[size:]
+	}
+	return frames, timestamps
+}
+
+func TestPNGImageEncoder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	videoFileName := filepath.Join(dir, "out")
+
+	// frames of the canvas image type, and another one after a resolution change, which is
+	// padded to the size of the first one
+	small := vnc2video.NewRGBImage(image.Rect(0, 0, 30, 20))
+	small.Set(3, 4, color.RGBA{R: 10, G: 20, B: 30, A: 255})
+	large := image.NewRGBA(image.Rect(0, 0, 50, 40))
+	large.Set(5, 6, color.RGBA{R: 40, G: 50, B: 60, A: 255})
+	large.Set(45, 35, color.RGBA{R: 70, G: 80, B: 90, A: 255})
+
+	enc := &PNGImageEncoder{Framerate: 4}
+	if err := enc.Run(videoFileName); err != nil {
+		t.Fatal(err)
+	}
+	enc.Encode(small)
+	enc.Encode(small)
+	enc.EncodeAt(large, 3*time.Second)
+	enc.Close()
+
+	data, err := ioutil.ReadFile(videoFileName + ".mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames, timestamps := readMkvFrames(t, data)
+	want := []time.Duration{0, 250 * time.Millisecond, 3 * time.Second}
+	if len(frames) != len(want) {
+		t.Fatalf("got %d frames, want %d", len(frames), len(want))
+	}
+	for i, frame := range frames {
+		if timestamps[i] != want[i] {
+			t.Fatalf("frame %d at %v, want %v", i, timestamps[i], want[i])
+		}
+		img, err := png.Decode(bytes.NewReader(frame))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Bounds() != small.Bounds() {
+			t.Fatalf("frame %d is %v, want %v", i, img.Bounds(), small.Bounds())
+		}
+		src, x, y := image.Image(small), 3, 4
+		if i == 2 {
+			src, x, y = large, 5, 6
+		}
+		// the canvas alpha isn't meaningful, the video is opaque
+		got, want := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA), color.RGBAModel.Convert(src.At(x, y)).(color.RGBA)
+		if got.R != want.R || got.G != want.G || got.B != want.B || got.A != 255 {
+			t.Fatalf("frame %d pixel is %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestPNGImageEncoderSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	videoFileName := filepath.Join(dir, "out")
+
+	frame := vnc2video.NewRGBImage(image.Rect(0, 0, 30, 20))
+	enc := &PNGImageEncoder{Width: 60, Height: 60, ResizeMode: ResizeScale}
+	if err := enc.Run(videoFileName); err != nil {
+		t.Fatal(err)
+	}
+	enc.Encode(frame)
+	enc.Close()
+
+	data, err := ioutil.ReadFile(videoFileName + ".mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, bitmapInfoHeader(60, 60, "MPNG")) {
+		t.Fatalf("track header doesn't have the video size")
+	}
+	frames, _ := readMkvFrames(t, data)
+	if len(frames) != 1 {
+		t.Fatalf("got %d frames, want 1", len(frames))
+	}
+	img, err := png.Decode(bytes.NewReader(frames[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(60, 60) {
+		t.Fatalf("frame is %v, want 60x60", size)
+	}
+}
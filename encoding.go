@@ -94,6 +94,42 @@ type Encoding interface {
 	Reset() error
 }
 
+// levelEncoding is implemented by encodings that honor the compression level
+// and JPEG quality pseudo-encodings sent by the client in SetEncodings.
+type levelEncoding interface {
+	setLevels(compressLevel, qualityLevel int)
+}
+
+// streamEncoding is implemented by decoders keeping zlib stream state from rect to rect,
+// the state is saved and restored between messages when seeking in recordings.
+type streamEncoding interface {
+	streamState() interface{}
+	restoreStreamState(interface{})
+}
+
+// encodingLevels extracts the requested compression level and JPEG quality level
+// (both in the 0-9 range) from a SetEncodings list, -1 is returned for a level
+// that was not requested.
+func encodingLevels(encs []EncodingType) (compressLevel int, qualityLevel int) {
+	compressLevel, qualityLevel = -1, -1
+	for _, enc := range encs {
+		switch {
+		case enc >= EncCompressionLevel1 && enc <= EncCompressionLevel10 && compressLevel < 0:
+			compressLevel = int(enc - EncCompressionLevel1)
+		case enc >= EncJPEGQualityLevelPseudo1 && enc <= EncJPEGQualityLevelPseudo10 && qualityLevel < 0:
+			qualityLevel = int(enc - EncJPEGQualityLevelPseudo1)
+		}
+	}
+	return compressLevel, qualityLevel
+}
+
+// connEncoding is implemented by the encodings keeping state for the connection they encode
+// for, such as the target image or zlib streams. Each ServerConn gets its own instance from
+// newConnEncoding, with the settings of the configured one and none of its state.
+type connEncoding interface {
+	newConnEncoding() Encoding
+}
+
 func setBit(n uint8, pos uint8) uint8 {
 	n |= (1 << pos)
 	return n
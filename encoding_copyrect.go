@@ -20,6 +20,10 @@ func (*CopyRectEncoding) Reset() error {
 }
 func (*CopyRectEncoding) Type() EncodingType { return EncCopyRect }
 
+func (enc *CopyRectEncoding) newConnEncoding() Encoding {
+	return &CopyRectEncoding{SX: enc.SX, SY: enc.SY, Image: enc.Image}
+}
+
 func (enc *CopyRectEncoding) SetTargetImage(img draw.Image) {
 	//logger.Tracef("!!!!!!!!!!!!!setting image: %v", img.Bounds())
 	enc.Image = img
@@ -1,7 +1,11 @@
 package vnc2video
 
+import "image/draw"
+
 // DesktopSizePseudoEncoding represents a desktop size message from the server.
-type DesktopSizePseudoEncoding struct{}
+type DesktopSizePseudoEncoding struct {
+	Image draw.Image
+}
 
 func (*DesktopSizePseudoEncoding) Supported(Conn) bool {
 	return true
@@ -11,11 +15,31 @@ func (*DesktopSizePseudoEncoding) Reset() error {
 }
 func (*DesktopSizePseudoEncoding) Type() EncodingType { return EncDesktopSizePseudo }
 
+// SetTargetImage sets the canvas resized with the desktop
+func (enc *DesktopSizePseudoEncoding) SetTargetImage(img draw.Image) {
+	enc.Image = img
+}
+
 // Read implements the Encoding interface.
-func (*DesktopSizePseudoEncoding) Read(c Conn, rect *Rectangle) error {
+func (enc *DesktopSizePseudoEncoding) Read(c Conn, rect *Rectangle) error {
+	resizeDesktop(c, enc.Image, rect.Width, rect.Height)
 	return nil
 }
 
 func (enc *DesktopSizePseudoEncoding) Write(c Conn, rect *Rectangle) error {
 	return nil
 }
+
+// resizeDesktop sets the framebuffer size of the connection and resizes its canvas, the target
+// image when it is a VncCanvas or else the ClientConn canvas
+func resizeDesktop(c Conn, img draw.Image, width, height uint16) {
+	c.SetWidth(width)
+	c.SetHeight(height)
+	canvas, _ := img.(*VncCanvas)
+	if cc, ok := c.(*ClientConn); ok && canvas == nil {
+		canvas = cc.Canvas
+	}
+	if canvas != nil {
+		canvas.Resize(int(width), int(height))
+	}
+}
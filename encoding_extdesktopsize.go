@@ -0,0 +1,120 @@
+package vnc2video
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image/draw"
+
+	"github.com/amitbet/vnc2video/logger"
+)
+
+// ExtendedDesktopSize reasons, sent as the rect X position
+const (
+	DesktopSizeReasonServer      uint16 = 0
+	DesktopSizeReasonClient      uint16 = 1
+	DesktopSizeReasonOtherClient uint16 = 2
+)
+
+// ExtendedDesktopSize statuses of SetDesktopSize requests, sent as the rect Y position
+const (
+	DesktopSizeStatusOK             uint16 = 0
+	DesktopSizeStatusProhibited     uint16 = 1
+	DesktopSizeStatusOutOfResources uint16 = 2
+	DesktopSizeStatusInvalidLayout  uint16 = 3
+)
+
+// Screen is a monitor of the desktop layout, in framebuffer coordinates
+type Screen struct {
+	ID            uint32
+	X, Y          uint16
+	Width, Height uint16
+	Flags         uint32
+}
+
+// maxScreens limits the screens of a layout
+const maxScreens = 255
+
+// ExtendedDesktopSizePseudoEncoding represents the framebuffer size and screen layout sent by
+// the server when the desktop is resized, or in answer to a SetDesktopSize request.
+type ExtendedDesktopSizePseudoEncoding struct {
+	// Screens is the screen layout of the last rect
+	Screens []Screen
+	// Reason and Status are those of the last rect
+	Reason uint16
+	Status uint16
+	Image  draw.Image
+}
+
+func (*ExtendedDesktopSizePseudoEncoding) Supported(Conn) bool {
+	return true
+}
+
+func (*ExtendedDesktopSizePseudoEncoding) Reset() error {
+	return nil
+}
+
+func (*ExtendedDesktopSizePseudoEncoding) Type() EncodingType {
+	return EncExtendedDesktopSizePseudo
+}
+
+// newConnEncoding returns an encoding for the screen layout of another connection
+func (enc *ExtendedDesktopSizePseudoEncoding) newConnEncoding() Encoding {
+	return &ExtendedDesktopSizePseudoEncoding{Image: enc.Image}
+}
+
+// SetTargetImage sets the canvas resized with the desktop
+func (enc *ExtendedDesktopSizePseudoEncoding) SetTargetImage(img draw.Image) {
+	enc.Image = img
+}
+
+// Read implements the Encoding interface.
+func (enc *ExtendedDesktopSizePseudoEncoding) Read(c Conn, rect *Rectangle) error {
+	screens, err := readScreens(c)
+	if err != nil {
+		return err
+	}
+	enc.Screens = screens
+	enc.Reason = rect.X
+	enc.Status = rect.Y
+	if rect.X == DesktopSizeReasonClient && rect.Y != DesktopSizeStatusOK {
+		logger.Errorf("desktop size change refused, status %d", rect.Y)
+		return nil
+	}
+	resizeDesktop(c, enc.Image, rect.Width, rect.Height)
+	return nil
+}
+
+// Write implements the Encoding interface, the rect holds the size, the reason and the status.
+func (enc *ExtendedDesktopSizePseudoEncoding) Write(c Conn, rect *Rectangle) error {
+	screens := enc.Screens
+	if len(screens) == 0 {
+		screens = []Screen{{Width: rect.Width, Height: rect.Height}}
+	}
+	return writeScreens(c, screens)
+}
+
+// readScreens reads a screen count, 3 bytes of padding and the screens
+func readScreens(c Conn) ([]Screen, error) {
+	var header struct {
+		NumScreens uint8
+		_          [3]byte
+	}
+	if err := binary.Read(c, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	screens := make([]Screen, header.NumScreens)
+	if err := binary.Read(c, binary.BigEndian, &screens); err != nil {
+		return nil, err
+	}
+	return screens, nil
+}
+
+func writeScreens(c Conn, screens []Screen) error {
+	if len(screens) > maxScreens {
+		return fmt.Errorf("too many screens: %d", len(screens))
+	}
+	if err := binary.Write(c, binary.BigEndian, [4]uint8{uint8(len(screens))}); err != nil {
+		return err
+	}
+	return binary.Write(c, binary.BigEndian, screens)
+}
@@ -0,0 +1,161 @@
+package vnc2video
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"net"
+	"testing"
+)
+
+func TestVncCanvasResize(t *testing.T) {
+	canvas := NewVncCanvas(4, 3)
+	canvas.Set(1, 1, color.RGBA{R: 9, G: 8, B: 7, A: 255})
+	canvas.Set(3, 2, color.RGBA{R: 1, G: 1, B: 1, A: 255})
+	canvas.Resize(6, 2)
+	if canvas.Bounds() != image.Rect(0, 0, 6, 2) {
+		t.Fatalf("canvas bounds %v after resize", canvas.Bounds())
+	}
+	if got := canvas.Image.(*RGBImage).RGBAt(1, 1); *got != (RGBColor{9, 8, 7}) {
+		t.Fatalf("pixel not kept, got %v", got)
+	}
+}
+
+// resizeTestConns returns a server conn serving source over net.Pipe to a client conn with
+// the ExtendedDesktopSize encoding, rendering into a canvas
+func resizeTestConns(t *testing.T, source FramebufferSource) (*ServerConn, *ClientConn) {
+	sc, cc := net.Pipe()
+	server, err := NewServerConn(sc, &ServerConfig{
+		PixelFormat: PixelFormat32bit,
+		Encodings:   []Encoding{&RawEncoding{}, &ExtendedDesktopSizePseudoEncoding{}},
+		Source:      source,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	canvas := NewVncCanvas(1, 1)
+	client, err := NewClientConn(cc, &ClientConfig{
+		PixelFormat: PixelFormat32bit,
+		Encodings:   []Encoding{&RawEncoding{Image: canvas}, &ExtendedDesktopSizePseudoEncoding{Image: canvas}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Canvas = canvas
+	server.SetEncodings([]EncodingType{EncRaw, EncExtendedDesktopSizePseudo})
+	return server, client
+}
+
+// sendUpdate answers a full update request of the client's framebuffer, returning the update
+// the client read
+func sendUpdate(t *testing.T, scheduler *updateScheduler, server *ServerConn, client *ClientConn) *FramebufferUpdate {
+	errs := make(chan error, 1)
+	go func() {
+		scheduler.request(&FramebufferUpdateRequest{Width: client.Width(), Height: client.Height()})
+		errs <- scheduler.update(server)
+	}()
+	var msgType ServerMessageType
+	if err := binary.Read(client, binary.BigEndian, &msgType); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := (&FramebufferUpdate{}).Read(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return msg.(*FramebufferUpdate)
+}
+
+func TestExtendedDesktopSizeUpdates(t *testing.T) {
+	source := NewImageSource(testSourceImage(100, 70))
+	server, client := resizeTestConns(t, source)
+	defer server.Close()
+	defer client.Close()
+	scheduler := &updateScheduler{source: source}
+
+	// the first update announces the extension with the current size
+	update := sendUpdate(t, scheduler, server, client)
+	if update.NumRect != 2 || update.Rects[0].EncType != EncExtendedDesktopSizePseudo || update.Rects[0].X != DesktopSizeReasonServer {
+		t.Fatalf("expected an ExtendedDesktopSize rect first, got %v", update)
+	}
+	if client.Width() != 100 || client.Height() != 70 || client.Canvas.Bounds() != image.Rect(0, 0, 100, 70) {
+		t.Fatalf("client size %dx%d, canvas %v", client.Width(), client.Height(), client.Canvas.Bounds())
+	}
+
+	img := testSourceImage(120, 80)
+	source.SetImage(img)
+	update = sendUpdate(t, scheduler, server, client)
+	if update.NumRect != 2 || update.Rects[0].EncType != EncExtendedDesktopSizePseudo || update.Rects[1].Width != 120 || update.Rects[1].Height != 80 {
+		t.Fatalf("expected a resize and a full update, got %v", update)
+	}
+	if client.Canvas.Bounds() != image.Rect(0, 0, 120, 80) {
+		t.Fatalf("canvas not resized, bounds %v", client.Canvas.Bounds())
+	}
+	screens := client.GetEncInstance(EncExtendedDesktopSizePseudo).(*ExtendedDesktopSizePseudoEncoding).Screens
+	if len(screens) != 1 || screens[0] != (Screen{Width: 120, Height: 80}) {
+		t.Fatalf("got screens %v", screens)
+	}
+	want := img.RGBAAt(119, 79)
+	if got := client.Canvas.Image.(*RGBImage).RGBAt(119, 79); got.R != want.R || got.G != want.G || got.B != want.B {
+		t.Fatalf("got pixel %v, want %v", got, want)
+	}
+}
+
+// resizableSource is an ImageSource clients can resize
+type resizableSource struct {
+	*ImageSource
+}
+
+func (s *resizableSource) ResizeDesktop(width, height uint16, screens []Screen) error {
+	s.SetImage(image.NewRGBA(image.Rect(0, 0, int(width), int(height))))
+	return nil
+}
+
+func TestSetDesktopSize(t *testing.T) {
+	conn := &bufferConn{}
+	msg := &SetDesktopSize{Width: 800, Height: 600, Screens: []Screen{{ID: 1, Width: 400, Height: 600}, {ID: 2, X: 400, Width: 400, Height: 600}}}
+	if err := msg.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	if msgType, _ := conn.ReadByte(); ClientMessageType(msgType) != SetDesktopSizeMsgType {
+		t.Fatalf("got message type %d", msgType)
+	}
+	read, err := (&SetDesktopSize{}).Read(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := read.(*SetDesktopSize)
+	if got.Width != 800 || got.Height != 600 || len(got.Screens) != 2 || got.Screens[1] != msg.Screens[1] {
+		t.Fatalf("read %v, wrote %v", got, msg)
+	}
+
+	for _, test := range []struct {
+		source FramebufferSource
+		status uint16
+		size   image.Rectangle
+	}{
+		{&resizableSource{NewImageSource(testSourceImage(100, 70))}, DesktopSizeStatusOK, image.Rect(0, 0, 800, 600)},
+		{NewImageSource(testSourceImage(100, 70)), DesktopSizeStatusProhibited, image.Rect(0, 0, 100, 70)},
+	} {
+		server, client := resizeTestConns(t, test.source)
+		scheduler := &updateScheduler{source: test.source}
+		sendUpdate(t, scheduler, server, client)
+
+		scheduler.resize(server, msg)
+		update := sendUpdate(t, scheduler, server, client)
+		rect := update.Rects[0]
+		if rect.EncType != EncExtendedDesktopSizePseudo || rect.X != DesktopSizeReasonClient || rect.Y != test.status {
+			t.Errorf("expected a reply with status %d, got %v", test.status, rect)
+		}
+		if client.Canvas.Bounds() != test.size {
+			t.Errorf("status %d: canvas %v, want %v", test.status, client.Canvas.Bounds(), test.size)
+		}
+		if screens := rect.Enc.(*ExtendedDesktopSizePseudoEncoding).Screens; test.status == DesktopSizeStatusOK && len(screens) != 2 {
+			t.Errorf("the layout wasn't kept, got %v", screens)
+		}
+		server.Close()
+		client.Close()
+	}
+}
@@ -1,6 +1,8 @@
 package vnc2video
 
 import (
+	"encoding/binary"
+	"errors"
 	"image"
 	"image/color"
 	"image/draw"
@@ -8,6 +10,11 @@ import (
 	"github.com/amitbet/vnc2video/logger"
 )
 
+const (
+	hextileTileSize    = 16
+	hextileMaxSubrects = 255
+)
+
 const (
 	HextileRaw                 = 1
 	HextileBackgroundSpecified = 2
@@ -40,11 +47,124 @@ func (z *HextileEncoding) Type() EncodingType {
 	return EncHextile
 }
 
+func (enc *HextileEncoding) newConnEncoding() Encoding {
+	return &HextileEncoding{Image: enc.Image}
+}
+
 func (z *HextileEncoding) WriteTo(w io.Writer) (n int, err error) {
 	return w.Write(z.bytes)
 }
 
+// Write encodes the rect region of enc.Image as 16x16 tiles, each one sent as a background
+// with mono or colored subrects, or as raw pixels when that is smaller.
 func (enc *HextileEncoding) Write(c Conn, rect *Rectangle) error {
+	if enc.Image == nil {
+		return errors.New("hextile encoding: no source image to encode")
+	}
+	pf := c.PixelFormat()
+	if pf.TrueColor == 0 {
+		return errors.New("support for non true color formats was not implemented")
+	}
+	bytesPerPixel := int(pf.BPP) / 8
+
+	// the background and foreground colors carry over from tile to tile until a raw tile
+	var bgCol, fgCol color.RGBA
+	bgValid, fgValid := false, false
+	for ty := 0; ty < int(rect.Height); ty += hextileTileSize {
+		th := Min(hextileTileSize, int(rect.Height)-ty)
+
+		for tx := 0; tx < int(rect.Width); tx += hextileTileSize {
+			tw := Min(hextileTileSize, int(rect.Width)-tx)
+
+			tile := readRectPixels(enc.Image, int(rect.X)+tx, int(rect.Y)+ty, tw, th)
+			tileBg := dominantColor(tile)
+			subrects, ok := findSubrects(tile, tw, th, tileBg, hextileMaxSubrects)
+
+			mono := true
+			for _, sr := range subrects {
+				if sr.color != subrects[0].color {
+					mono = false
+				}
+			}
+
+			var subencoding uint8
+			size := 0
+			if !bgValid || tileBg != bgCol {
+				subencoding |= HextileBackgroundSpecified
+				size += bytesPerPixel
+			}
+			if len(subrects) > 0 {
+				subencoding |= HextileAnySubrects
+				size++
+				if mono {
+					if !fgValid || subrects[0].color != fgCol {
+						subencoding |= HextileForegroundSpecified
+						size += bytesPerPixel
+					}
+					size += 2 * len(subrects)
+				} else {
+					subencoding |= HextileSubrectsColoured
+					size += (bytesPerPixel + 2) * len(subrects)
+				}
+			}
+
+			if !ok || size > tw*th*bytesPerPixel {
+				if err := binary.Write(c, binary.BigEndian, uint8(HextileRaw)); err != nil {
+					return err
+				}
+				for _, col := range tile {
+					if err := WriteColor(c, &pf, col); err != nil {
+						return err
+					}
+				}
+				bgValid, fgValid = false, false
+				continue
+			}
+
+			if err := enc.writeTile(c, &pf, subencoding, tileBg, subrects); err != nil {
+				return err
+			}
+			bgCol, bgValid = tileBg, true
+			if len(subrects) > 0 {
+				fgCol, fgValid = subrects[len(subrects)-1].color, mono
+			}
+		}
+	}
+	return nil
+}
+
+func (enc *HextileEncoding) writeTile(c Conn, pf *PixelFormat, subencoding uint8, bgCol color.RGBA, subrects []rreSubrect) error {
+	if err := binary.Write(c, binary.BigEndian, subencoding); err != nil {
+		return err
+	}
+	if subencoding&HextileBackgroundSpecified != 0 {
+		if err := WriteColor(c, pf, bgCol); err != nil {
+			return err
+		}
+	}
+	if subencoding&HextileForegroundSpecified != 0 {
+		if err := WriteColor(c, pf, subrects[0].color); err != nil {
+			return err
+		}
+	}
+	if subencoding&HextileAnySubrects == 0 {
+		return nil
+	}
+	if err := binary.Write(c, binary.BigEndian, uint8(len(subrects))); err != nil {
+		return err
+	}
+	for _, sr := range subrects {
+		if subencoding&HextileSubrectsColoured != 0 {
+			if err := WriteColor(c, pf, sr.color); err != nil {
+				return err
+			}
+		}
+		// x and y in bits 7-4 and 3-0, then width-1 and height-1 the same way
+		dimensions := []uint8{uint8(sr.x<<4 | sr.y), uint8((sr.width-1)<<4 | (sr.height - 1))}
+		if err := binary.Write(c, binary.BigEndian, dimensions); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,22 @@
+package vnc2video
+
+// LastRectPseudoEncoding ends a framebuffer update before its rect count, servers not knowing
+// the count beforehand send updates of 0xffff rects ended by a LastRect rect.
+type LastRectPseudoEncoding struct{}
+
+func (*LastRectPseudoEncoding) Supported(Conn) bool {
+	return true
+}
+func (*LastRectPseudoEncoding) Reset() error {
+	return nil
+}
+func (*LastRectPseudoEncoding) Type() EncodingType { return EncLastRectPseudo }
+
+// Read implements the Encoding interface.
+func (*LastRectPseudoEncoding) Read(c Conn, rect *Rectangle) error {
+	return nil
+}
+
+func (*LastRectPseudoEncoding) Write(c Conn, rect *Rectangle) error {
+	return nil
+}
@@ -0,0 +1,220 @@
+package vnc2video
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// lastRectStream is a hand-built update sent the way libvncserver sends them with LastRect: a
+// rect count of 0xffff and an empty LastRect rect after the last one, followed by a bell
+var lastRectStream = []byte{
+	0x00, 0x00, 0xff, 0xff,
+	// a raw 2x1 rect, red and blue
+	0x00, 0x01, 0x00, 0x02, 0x00, 0x02, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0xff, 0x00, 0xff, 0x00, 0x00, 0x00,
+	// the LastRect rect
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0x20,
+	0x02,
+}
+
+// lastRectCapture is a session of a libvncserver or TightVNC server requested to use LastRect,
+// recorded by an FbsRecordHandler. The tests reading it are skipped until it is added.
+var lastRectCapture = filepath.Join("testdata", "lastrect.fbs")
+
+// requireLastRectCapture skips the test when there is no capture
+func requireLastRectCapture(t *testing.T) {
+	if _, err := os.Stat(lastRectCapture); os.IsNotExist(err) {
+		t.Skipf("no capture in %s", lastRectCapture)
+	}
+}
+
+// captureEncodings returns the decoders of the encodings servers use, drawing into canvas
+func captureEncodings(canvas *VncCanvas) []Encoding {
+	encs := []Encoding{
+		&RawEncoding{}, &CopyRectEncoding{}, &HextileEncoding{}, &ZLibEncoding{}, &ZRLEEncoding{},
+		&TightEncoding{}, &TightPngEncoding{}, &CursorPseudoEncoding{}, &DesktopSizePseudoEncoding{},
+	}
+	for _, enc := range encs {
+		if renderer, ok := enc.(Renderer); ok {
+			renderer.SetTargetImage(canvas)
+		}
+	}
+	return encs
+}
+
+// checkLastRectCapture checks the messages read from the capture, which must have an update of
+// unknown rect count ended by LastRect
+func checkLastRectCapture(t *testing.T, msgs []ServerMessage) {
+	lastRect := 0
+	for _, msg := range msgs {
+		update, ok := msg.(*FramebufferUpdate)
+		if !ok || update.NumRect != 0xffff {
+			continue
+		}
+		if n := len(update.Rects); n == 0 || update.Rects[n-1].EncType != EncLastRectPseudo {
+			t.Fatalf("update of unknown rect count not ended by LastRect: %v", update)
+		}
+		lastRect++
+	}
+	if lastRect == 0 {
+		t.Fatalf("no update ended by LastRect in %d messages", len(msgs))
+	}
+}
+
+// checkLastRectUpdate checks msg is the update of lastRectStream, drawn into img
+func checkLastRectUpdate(t *testing.T, msg ServerMessage, img image.Image) {
+	update, ok := msg.(*FramebufferUpdate)
+	if !ok || update.NumRect != 0xffff || len(update.Rects) != 2 || update.Rects[1].EncType != EncLastRectPseudo {
+		t.Fatalf("read %v", msg)
+	}
+	if got := rgbAt(img, 1, 2); got != (color.RGBA{255, 0, 0, 255}) {
+		t.Fatalf("got color %v", got)
+	}
+	if got := rgbAt(img, 2, 2); got != (color.RGBA{0, 0, 255, 255}) {
+		t.Fatalf("got color %v", got)
+	}
+}
+
+func TestLastRectClient(t *testing.T) {
+	conn := &recordConn{}
+	img := NewRGBImage(image.Rect(0, 0, 4, 4))
+	client, err := NewClientConn(conn, &ClientConfig{Encodings: []Encoding{&RawEncoding{Image: img}}, PixelFormat: PixelFormat32bit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(lastRectStream[1:])
+	msg, err := (&FramebufferUpdate{}).Read(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLastRectUpdate(t, msg, img)
+	if msgType, _ := client.br.ReadByte(); ServerMessageType(msgType) != BellMsgType {
+		t.Fatalf("got message type %d after the update", msgType)
+	}
+
+	// the update is written back as it was read
+	written := &bufferConn{pf: PixelFormat32bit}
+	if err := msg.Write(written); err != nil {
+		t.Fatal(err)
+	}
+	if got := written.Bytes(); string(got) != string(lastRectStream[:len(lastRectStream)-1]) {
+		t.Fatalf("wrote %v", got)
+	}
+
+	t.Run("capture", func(t *testing.T) {
+		requireLastRectCapture(t)
+		fbs, err := NewFbsReader(lastRectCapture)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fbs.Close()
+		init, err := fbs.ReadStartSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream, err := ioutil.ReadAll(fbs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn := &recordConn{}
+		conn.Write(stream)
+		canvas := NewVncCanvas(int(init.FBWidth), int(init.FBHeight))
+		client, err := NewClientConn(conn, &ClientConfig{Encodings: captureEncodings(canvas), PixelFormat: init.PixelFormat})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Canvas = canvas
+		client.SetWidth(init.FBWidth)
+		client.SetHeight(init.FBHeight)
+		messages := make(map[ServerMessageType]ServerMessage)
+		for _, msg := range DefaultServerMessages {
+			messages[msg.Type()] = msg
+		}
+		var msgs []ServerMessage
+		for {
+			var msgType ServerMessageType
+			if err := binary.Read(client, binary.BigEndian, &msgType); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			msg, ok := messages[msgType]
+			if !ok {
+				t.Fatalf("unknown message type %v after %d messages", msgType, len(msgs))
+			}
+			parsed, err := msg.Read(client)
+			if err != nil {
+				t.Fatalf("message %d: %v", len(msgs), err)
+			}
+			msgs = append(msgs, parsed)
+		}
+		checkLastRectCapture(t, msgs)
+	})
+}
+
+func TestLastRectFBS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fbs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fbsFile := filepath.Join(dir, "session.fbs")
+	fbs, err := NewFbsWriter(fbsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fbs.WriteStartSession(&ServerInit{FBWidth: 4, FBHeight: 4, PixelFormat: PixelFormat32bit}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fbs.Write(lastRectStream); err != nil {
+		t.Fatal(err)
+	}
+	if err := fbs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	img := NewRGBImage(image.Rect(0, 0, 4, 4))
+	conn, err := NewFbsConn(fbsFile, []Encoding{&RawEncoding{Image: img}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	player := NewFBSPlayHelper(conn)
+	msg, err := player.ReadFbsMessage(false, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLastRectUpdate(t, msg, img)
+	if msg, err := player.ReadFbsMessage(false, 1); err != nil || msg.Type() != BellMsgType {
+		t.Fatalf("read %v, %v after the update", msg, err)
+	}
+
+	t.Run("capture", func(t *testing.T) {
+		requireLastRectCapture(t)
+		conn, err := NewFbsConn(lastRectCapture, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.encodings = captureEncodings(NewVncCanvas(int(conn.Width()), int(conn.Height())))
+		player := NewFBSPlayHelper(conn)
+		var msgs []ServerMessage
+		for {
+			msg, err := player.ReadFbsMessage(false, 1)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("message %d: %v", len(msgs), err)
+			}
+			msgs = append(msgs, msg)
+		}
+		checkLastRectCapture(t, msgs)
+	})
+}
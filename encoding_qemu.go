@@ -0,0 +1,60 @@
+package vnc2video
+
+import "sync/atomic"
+
+// QEMUExtendedKeyEventPseudoEncoding is sent by servers accepting QEMUExtendedKeyEvent, see
+// ClientConn.KeyEvent.
+type QEMUExtendedKeyEventPseudoEncoding struct{}
+
+func (*QEMUExtendedKeyEventPseudoEncoding) Supported(Conn) bool {
+	return true
+}
+func (*QEMUExtendedKeyEventPseudoEncoding) Reset() error {
+	return nil
+}
+func (*QEMUExtendedKeyEventPseudoEncoding) Type() EncodingType {
+	return EncQEMUExtendedKeyEventPseudo
+}
+
+// Read implements the Encoding interface.
+func (*QEMUExtendedKeyEventPseudoEncoding) Read(c Conn, rect *Rectangle) error {
+	if cc, ok := c.(*ClientConn); ok {
+		atomic.StoreInt32(&cc.qemuKeyEvents, 1)
+	}
+	return nil
+}
+
+func (*QEMUExtendedKeyEventPseudoEncoding) Write(c Conn, rect *Rectangle) error {
+	return nil
+}
+
+// QEMUPointerMotionChangePseudoEncoding is sent by the server to switch between absolute pointer
+// positions, with an x of 1, and relative pointer motion, with an x of 0. See
+// ClientConn.PointerEvent.
+type QEMUPointerMotionChangePseudoEncoding struct{}
+
+func (*QEMUPointerMotionChangePseudoEncoding) Supported(Conn) bool {
+	return true
+}
+func (*QEMUPointerMotionChangePseudoEncoding) Reset() error {
+	return nil
+}
+func (*QEMUPointerMotionChangePseudoEncoding) Type() EncodingType {
+	return EncQEMUPointerMotionChangePseudo
+}
+
+// Read implements the Encoding interface.
+func (*QEMUPointerMotionChangePseudoEncoding) Read(c Conn, rect *Rectangle) error {
+	if cc, ok := c.(*ClientConn); ok {
+		relative := int32(0)
+		if rect.X == 0 {
+			relative = 1
+		}
+		atomic.StoreInt32(&cc.relativePointer, relative)
+	}
+	return nil
+}
+
+func (*QEMUPointerMotionChangePseudoEncoding) Write(c Conn, rect *Rectangle) error {
+	return nil
+}
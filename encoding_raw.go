@@ -1,6 +1,7 @@
 package vnc2video
 
 import (
+	"errors"
 	"image/draw"
 )
 
@@ -17,10 +18,13 @@ func (*RawEncoding) Reset() error {
 	return nil
 }
 
+// Write sends the rect region of enc.Image as raw pixels in the connection's pixel format
 func (enc *RawEncoding) Write(c Conn, rect *Rectangle) error {
-	var err error
-
-	return err
+	if enc.Image == nil {
+		return errors.New("raw encoding: no source image to encode")
+	}
+	pf := c.PixelFormat()
+	return EncodeRaw(c, &pf, rect, enc.Image)
 }
 func (enc *RawEncoding) SetTargetImage(img draw.Image) {
 	enc.Image = img
@@ -36,3 +40,7 @@ func (enc *RawEncoding) Read(c Conn, rect *Rectangle) error {
 }
 
 func (*RawEncoding) Type() EncodingType { return EncRaw }
+
+func (enc *RawEncoding) newConnEncoding() Encoding {
+	return &RawEncoding{Image: enc.Image}
+}
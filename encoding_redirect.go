@@ -0,0 +1,155 @@
+package vnc2video
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/amitbet/vnc2video/logger"
+)
+
+// ClientRedirect is where a server sends its clients
+type ClientRedirect struct {
+	Host string
+	Port uint16
+	// X509Subject is the subject of the certificate of the new server, empty when unknown, in the
+	// form of pkix.Name.String such as "CN=host,O=org". The client checks it when the new server
+	// is authenticated with a VeNCrypt X509 sub type.
+	X509Subject string
+}
+
+// String returns string
+func (r *ClientRedirect) String() string {
+	return fmt.Sprintf("host: %s, port: %d, x509 subject: %s", r.Host, r.Port, r.X509Subject)
+}
+
+// ClientRedirectPseudoEncoding redirects the client to another server. Servers write Redirect,
+// clients follow the redirects they read, see ClientConfig.RedirectCh.
+type ClientRedirectPseudoEncoding struct {
+	Redirect ClientRedirect
+}
+
+func (*ClientRedirectPseudoEncoding) Supported(Conn) bool {
+	return true
+}
+func (*ClientRedirectPseudoEncoding) Reset() error {
+	return nil
+}
+func (*ClientRedirectPseudoEncoding) Type() EncodingType { return EncClientRedirect }
+
+// Read implements the Encoding interface.
+func (*ClientRedirectPseudoEncoding) Read(c Conn, rect *Rectangle) error {
+	redirect := &ClientRedirect{}
+	if err := binary.Read(c, binary.BigEndian, &redirect.Port); err != nil {
+		return err
+	}
+	host, err := readRedirectString(c)
+	if err != nil {
+		return err
+	}
+	subject, err := readRedirectString(c)
+	if err != nil {
+		return err
+	}
+	redirect.Host, redirect.X509Subject = string(host), string(subject)
+	if cc, ok := c.(*ClientConn); ok {
+		cc.redirect = redirect
+	}
+	return nil
+}
+
+func (enc *ClientRedirectPseudoEncoding) Write(c Conn, rect *Rectangle) error {
+	if err := binary.Write(c, binary.BigEndian, enc.Redirect.Port); err != nil {
+		return err
+	}
+	for _, s := range []string{enc.Redirect.Host, enc.Redirect.X509Subject} {
+		if err := binary.Write(c, binary.BigEndian, uint32(len(s))); err != nil {
+			return err
+		}
+		if err := binary.Write(c, binary.BigEndian, []byte(s)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// redirectMaxString is the longest host or subject accepted
+const redirectMaxString = 4096
+
+func readRedirectString(c Conn) ([]byte, error) {
+	var length uint32
+	if err := binary.Read(c, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length > redirectMaxString {
+		return nil, fmt.Errorf("client redirect string too long: %d", length)
+	}
+	s := make([]byte, length)
+	if err := binary.Read(c, binary.BigEndian, &s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// dialRedirect is the default ClientConfig.RedirectDial
+func dialRedirect(redirect *ClientRedirect) (net.Conn, error) {
+	return net.Dial("tcp", net.JoinHostPort(redirect.Host, strconv.Itoa(int(redirect.Port))))
+}
+
+// verifyRedirectSubject returns a tls.Config.VerifyPeerCertificate calling verify when it isn't
+// nil, then checking that the server certificate has subject
+func verifyRedirectSubject(verify func([][]byte, [][]*x509.Certificate) error, subject string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if verify != nil {
+			if err := verify(rawCerts, verifiedChains); err != nil {
+				return err
+			}
+		}
+		if len(rawCerts) == 0 {
+			return errors.New("client redirect: no server certificate")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		if got := cert.Subject.String(); got != subject {
+			return fmt.Errorf("client redirect: server certificate subject %q, want %q", got, subject)
+		}
+		return nil
+	}
+}
+
+// followRedirect connects to the server the client was redirected to, with the same config and
+// canvas, and closes this connection. The new connection is sent to RedirectCh and takes over
+// the config channels.
+func (c *ClientConn) followRedirect(redirect *ClientRedirect) {
+	logger.Infof("following client redirect to %v", redirect)
+	dial := c.cfg.RedirectDial
+	if dial == nil {
+		dial = dialRedirect
+	}
+	nc, err := dial(redirect)
+	if err != nil {
+		c.cfg.ErrorCh <- err
+		return
+	}
+	// QuitCh belongs to the new connection
+	c.quitCh = nil
+	c.Close()
+
+	c.ResetAllEncodings()
+	// the context given to Connect isn't kept, it is for the first connection and callers
+	// commonly cancel it once Connect returns, while a redirect can come at any time after
+	conn, err := connect(context.Background(), nc, c.cfg, c.Canvas, redirect.X509Subject)
+	if err != nil {
+		// reported by connect
+		return
+	}
+	if c.cfg.RedirectCh != nil {
+		c.cfg.RedirectCh <- conn
+	}
+}
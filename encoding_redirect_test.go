@@ -0,0 +1,237 @@
+package vnc2video
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveRedirectTest runs the handshake of a server filled with fill, authenticating with
+// security, then sends one update once start is closed, followed by a redirect when set, and
+// waits for the client to close
+func serveRedirectTest(nc net.Conn, security SecurityHandler, width, height uint16, fill color.RGBA, start chan struct{}, redirect *ClientRedirect) error {
+	defer nc.Close()
+	img := image.NewRGBA(image.Rect(0, 0, int(width), int(height)))
+	draw.Draw(img, img.Bounds(), &image.Uniform{fill}, image.Point{}, draw.Src)
+	sc, err := NewServerConn(nc, &ServerConfig{
+		SecurityHandlers: []SecurityHandler{security},
+		Encodings:        []Encoding{&RawEncoding{}},
+		PixelFormat:      PixelFormat32bit,
+		Width:            width,
+		Height:           height,
+		DesktopName:      []byte("redirect"),
+	})
+	if err != nil {
+		return err
+	}
+	for _, h := range []Handler{&DefaultServerVersionHandler{}, &DefaultServerSecurityHandler{}, &DefaultServerClientInitHandler{}, &DefaultServerServerInitHandler{}} {
+		if err := h.Handle(sc); err != nil {
+			return err
+		}
+	}
+	for _, msg := range []ClientMessage{&SetPixelFormat{}, &SetEncodings{}, &FramebufferUpdateRequest{}} {
+		var msgType ClientMessageType
+		if err := binary.Read(sc, binary.BigEndian, &msgType); err != nil {
+			return err
+		}
+		if msgType != msg.Type() {
+			return fmt.Errorf("got message type %v, want %v", msgType, msg.Type())
+		}
+		if _, err := msg.Read(sc); err != nil {
+			return err
+		}
+	}
+
+	<-start
+	rects := []*Rectangle{{Width: width, Height: height, EncType: EncRaw, Enc: &RawEncoding{Image: img}}}
+	if redirect != nil {
+		rects = append(rects, &Rectangle{EncType: EncClientRedirect, Enc: &ClientRedirectPseudoEncoding{Redirect: *redirect}})
+	}
+	if err := (&FramebufferUpdate{NumRect: uint16(len(rects)), Rects: rects}).Write(sc); err != nil {
+		return err
+	}
+	_, err = io.Copy(ioutil.Discard, nc)
+	return err
+}
+
+// rgbAt returns the opaque color of a pixel
+func rgbAt(img image.Image, x, y int) color.RGBA {
+	r, g, b, _ := img.At(x, y).RGBA()
+	return color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), 255}
+}
+
+func TestClientRedirect(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+	target := &ClientRedirect{Host: "gateway.example", Port: 5901, X509Subject: "CN=gateway"}
+
+	serverA, clientA := net.Pipe()
+	serverB, clientB := net.Pipe()
+	startA, startB := make(chan struct{}), make(chan struct{})
+	serverErr := make(chan error, 2)
+	go func() { serverErr <- serveRedirectTest(serverA, &ServerAuthNone{}, 40, 30, red, startA, target) }()
+	go func() { serverErr <- serveRedirectTest(serverB, &ServerAuthNone{}, 64, 48, blue, startB, nil) }()
+
+	dialed := make(chan *ClientRedirect, 1)
+	dial := make(chan struct{})
+	raw := &RawEncoding{}
+	cfg := &ClientConfig{
+		SecurityHandlers: []SecurityHandler{&ClientAuthNone{}},
+		Encodings:        []Encoding{raw, &ClientRedirectPseudoEncoding{}},
+		ServerMessageCh:  make(chan ServerMessage),
+		Messages:         DefaultServerMessages,
+		ErrorCh:          make(chan error, 2),
+		RedirectDial: func(redirect *ClientRedirect) (net.Conn, error) {
+			dialed <- redirect
+			<-dial
+			return clientB, nil
+		},
+		RedirectCh: make(chan *ClientConn, 1),
+	}
+	cc, err := Connect(context.Background(), clientA, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	canvas := cc.Canvas
+	raw.SetTargetImage(canvas)
+
+	// nextUpdate waits for the next update, or fails with the first error
+	nextUpdate := func() {
+		select {
+		case msg := <-cfg.ServerMessageCh:
+			if msg.Type() != FramebufferUpdateMsgType {
+				t.Fatalf("got message %v", msg)
+			}
+		case err := <-cfg.ErrorCh:
+			t.Fatal(err)
+		case err := <-serverErr:
+			t.Fatalf("server stopped: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no update")
+		}
+	}
+
+	close(startA)
+	nextUpdate()
+	if got := <-dialed; *got != *target {
+		t.Fatalf("dialed %v", got)
+	}
+	// the canvas is kept as it is until the new server draws into it
+	if got := rgbAt(canvas.Image, 10, 10); got != red {
+		t.Fatalf("got color %v from the first server", got)
+	}
+	close(dial)
+
+	redirected := <-cfg.RedirectCh
+	if redirected.Canvas != canvas || string(redirected.DesktopName()) != "redirect" {
+		t.Fatal("the redirected connection doesn't draw into the canvas")
+	}
+	// the first server sees the client leave
+	if err := <-serverErr; err != nil {
+		t.Fatal(err)
+	}
+
+	close(startB)
+	nextUpdate()
+	if size := canvas.Image.Bounds(); size.Dx() != 64 || size.Dy() != 48 || redirected.Width() != 64 {
+		t.Fatalf("canvas size %v after the redirect", size)
+	}
+	if got := rgbAt(canvas.Image, 50, 40); got != blue {
+		t.Fatalf("got color %v from the second server", got)
+	}
+	redirected.Close()
+}
+
+func TestClientRedirectX509Subject(t *testing.T) {
+	cert, pool := testCertificate(t)
+	start := make(chan struct{})
+	close(start)
+	for _, test := range []struct {
+		subject string
+		ok      bool
+	}{
+		{"CN=localhost", true},
+		{"CN=gateway", false},
+	} {
+		server, client := net.Pipe()
+		serverErr := make(chan error, 1)
+		security := &ServerAuthVeNCrypt{TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}}
+		go func() { serverErr <- serveRedirectTest(server, security, 64, 48, color.RGBA{}, start, nil) }()
+
+		raw := &RawEncoding{}
+		cfg := &ClientConfig{
+			SecurityHandlers: []SecurityHandler{&ClientAuthVeNCrypt{TLSConfig: &tls.Config{RootCAs: pool, ServerName: "localhost"}}},
+			Encodings:        []Encoding{raw},
+			ServerMessageCh:  make(chan ServerMessage, 1),
+			Messages:         DefaultServerMessages,
+			ErrorCh:          make(chan error, 2),
+			RedirectDial:     func(*ClientRedirect) (net.Conn, error) { return client, nil },
+			RedirectCh:       make(chan *ClientConn, 1),
+		}
+		first, _ := net.Pipe()
+		cc, err := NewClientConn(first, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the canvas of the connected client, which the redirected connection draws into
+		cc.Canvas = NewVncCanvas(64, 48)
+		raw.SetTargetImage(cc.Canvas)
+		cc.followRedirect(&ClientRedirect{Host: "localhost", Port: 5901, X509Subject: test.subject})
+
+		if !test.ok {
+			select {
+			case err := <-cfg.ErrorCh:
+				if !strings.Contains(err.Error(), "subject") {
+					t.Errorf("%s: got error %v", test.subject, err)
+				}
+			case <-cfg.RedirectCh:
+				t.Errorf("%s: followed the redirect to another certificate", test.subject)
+			}
+			<-serverErr
+			continue
+		}
+		var redirected *ClientConn
+		select {
+		case redirected = <-cfg.RedirectCh:
+		case err := <-cfg.ErrorCh:
+			t.Fatalf("%s: %v", test.subject, err)
+		}
+		// the server sends its update once it read the first messages
+		select {
+		case <-cfg.ServerMessageCh:
+		case err := <-cfg.ErrorCh:
+			t.Fatalf("%s: %v", test.subject, err)
+		}
+		redirected.Close()
+		if err := <-serverErr; err != nil {
+			t.Fatalf("%s: server error %v", test.subject, err)
+		}
+	}
+}
+
+func TestClientRedirectEncoding(t *testing.T) {
+	conn := &bufferConn{}
+	enc := &ClientRedirectPseudoEncoding{Redirect: ClientRedirect{Host: "10.0.0.2", Port: 5900}}
+	enc.Write(conn, &Rectangle{})
+	want := []byte{0x17, 0x0c, 0, 0, 0, 8, '1', '0', '.', '0', '.', '0', '.', '2', 0, 0, 0, 0}
+	if got := conn.Bytes(); string(got) != string(want) {
+		t.Fatalf("wrote %v, want %v", got, want)
+	}
+
+	conn.Reset()
+	binary.Write(conn, binary.BigEndian, uint16(1))
+	binary.Write(conn, binary.BigEndian, uint32(redirectMaxString+1))
+	if err := enc.Read(conn, &Rectangle{}); err == nil {
+		t.Fatal("read a host too long")
+	}
+}
@@ -2,6 +2,8 @@ package vnc2video
 
 import (
 	"encoding/binary"
+	"errors"
+	"image/color"
 	"image/draw"
 	"io"
 	//"image/draw"
@@ -29,11 +31,107 @@ func (enc *RREEncoding) Reset() error {
 
 func (*RREEncoding) Type() EncodingType { return EncRRE }
 
+func (enc *RREEncoding) newConnEncoding() Encoding {
+	return &RREEncoding{Image: enc.Image}
+}
+
+// Write encodes the rect region of enc.Image as its most common color
+// covered by solid subrectangles for the remaining pixels.
 func (enc *RREEncoding) Write(c Conn, rect *Rectangle) error {
+	if enc.Image == nil {
+		return errors.New("rre encoding: no source image to encode")
+	}
+	pf := c.PixelFormat()
+	if pf.TrueColor == 0 {
+		return errors.New("support for non true color formats was not implemented")
+	}
+
+	width, height := int(rect.Width), int(rect.Height)
+	pixels := readRectPixels(enc.Image, int(rect.X), int(rect.Y), width, height)
+	bgColor := dominantColor(pixels)
+	subrects, _ := findSubrects(pixels, width, height, bgColor, -1)
 
+	if err := binary.Write(c, binary.BigEndian, uint32(len(subrects))); err != nil {
+		return err
+	}
+	if err := WriteColor(c, &pf, bgColor); err != nil {
+		return err
+	}
+	for _, sr := range subrects {
+		if err := WriteColor(c, &pf, sr.color); err != nil {
+			return err
+		}
+		if err := binary.Write(c, binary.BigEndian, []uint16{uint16(sr.x), uint16(sr.y), uint16(sr.width), uint16(sr.height)}); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// rreSubrect is a solid colored area, relative to the encoded rect
+type rreSubrect struct {
+	color               color.RGBA
+	x, y, width, height int
+}
+
+// dominantColor returns the most frequent color of the pixels, used as the background
+func dominantColor(pixels []color.RGBA) color.RGBA {
+	var best color.RGBA
+	bestCount := 0
+	counts := make(map[color.RGBA]int)
+	for _, col := range pixels {
+		counts[col]++
+		if counts[col] > bestCount {
+			best, bestCount = col, counts[col]
+		}
+	}
+	return best
+}
+
+// findSubrects covers the pixels that differ from bgColor with solid subrects, growing each one
+// right along its row and then down while the rows below match. It gives up returning false once
+// more than maxSubrects are needed, a negative maxSubrects means no limit.
+func findSubrects(pixels []color.RGBA, width, height int, bgColor color.RGBA, maxSubrects int) ([]rreSubrect, bool) {
+	var subrects []rreSubrect
+	covered := make([]bool, len(pixels))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := y*width + x
+			col := pixels[i]
+			if covered[i] || col == bgColor {
+				continue
+			}
+			if maxSubrects >= 0 && len(subrects) == maxSubrects {
+				return nil, false
+			}
+
+			w := 1
+			for x+w < width && !covered[i+w] && pixels[i+w] == col {
+				w++
+			}
+			h := 1
+		grow:
+			for y+h < height {
+				row := (y+h)*width + x
+				for j := row; j < row+w; j++ {
+					if covered[j] || pixels[j] != col {
+						break grow
+					}
+				}
+				h++
+			}
+
+			for sy := y; sy < y+h; sy++ {
+				for sx := x; sx < x+w; sx++ {
+					covered[sy*width+sx] = true
+				}
+			}
+			subrects = append(subrects, rreSubrect{color: col, x: x, y: y, width: w, height: h})
+		}
+	}
+	return subrects, true
+}
+
 func (z *RREEncoding) WriteTo(w io.Writer) (n int, err error) {
 	binary.Write(w, binary.BigEndian, z.numSubRects)
 	if err != nil {
@@ -36,20 +36,54 @@ const (
 )
 
 type TightEncoding struct {
-	Image        draw.Image
-	decoders     []io.Reader
-	decoderBuffs []*bytes.Buffer
+	Image    draw.Image
+	decoders []*inflateStream
+
+	// server side state: the four zlib streams kept open for the connection
+	encoders      [4]*zlib.Writer
+	encoderBuffs  [4]*bytes.Buffer
+	encoderLevels [4]int
+	resetStreams  uint8
+	compressLevel int
+	qualityLevel  int
+	levelsSet     bool
 }
 
 var instance *TightEncoding
 var TightMinToCompress int = 12
 
+const (
+	// TightMaxRectWidth is the widest rectangle a tight decoder accepts
+	TightMaxRectWidth = 2048
+	// TightMaxRectSize is the largest rectangle area (in pixels) a tight decoder accepts
+	TightMaxRectSize = 65536
+
+	tightDefaultCompressLevel = 6
+	tightMaxPaletteColors     = 256
+	tightMinJPEGArea          = 1024
+	tightSmoothThreshold      = 16
+
+	// zlib streams used for each kind of data, same as the TightVNC server
+	tightStreamCopy     = 0
+	tightStreamMono     = 1
+	tightStreamIndexed  = 2
+	tightStreamGradient = 3
+)
+
+// tightJPEGQuality maps the client's JPEG quality level (0-9) to a jpeg.Options quality
+var tightJPEGQuality = [10]int{15, 29, 41, 42, 62, 77, 79, 86, 92, 100}
+
 func (*TightEncoding) Supported(Conn) bool {
 	return true
 }
 
 func (*TightEncoding) Type() EncodingType { return EncTight }
 
+// newConnEncoding returns an encoding with its own four zlib streams, started with the first rect
+func (enc *TightEncoding) newConnEncoding() Encoding {
+	return &TightEncoding{Image: enc.Image}
+}
+
 func (*TightEncoding) GetInstance() *TightEncoding {
 	if instance == nil {
 		instance = &TightEncoding{}
@@ -57,10 +91,305 @@ func (*TightEncoding) GetInstance() *TightEncoding {
 	return instance
 }
 
+func (enc *TightEncoding) setLevels(compressLevel, qualityLevel int) {
+	enc.compressLevel = compressLevel
+	enc.qualityLevel = qualityLevel
+	enc.levelsSet = true
+}
+
+func (enc *TightEncoding) zlibLevel() int {
+	if !enc.levelsSet || enc.compressLevel < 0 {
+		return tightDefaultCompressLevel
+	}
+	return enc.compressLevel
+}
+
+// jpegQuality returns the jpeg quality to use, or 0 when the client didn't ask for JPEG
+func (enc *TightEncoding) jpegQuality() int {
+	if !enc.levelsSet || enc.qualityLevel < 0 {
+		return 0
+	}
+	return tightJPEGQuality[enc.qualityLevel]
+}
+
+// Write encodes the rect region of enc.Image, choosing the fill, palette,
+// gradient, jpeg or basic subencoding according to the rect's content.
 func (enc *TightEncoding) Write(c Conn, rect *Rectangle) error {
+	if enc.Image == nil {
+		return errors.New("tight encoding: no source image to encode")
+	}
+	pf := c.PixelFormat()
+	if pf.TrueColor == 0 {
+		return errors.New("support for non true color formats was not implemented")
+	}
+	if rect.Width > TightMaxRectWidth || rect.Area() > TightMaxRectSize {
+		return fmt.Errorf("tight encoding: rect %v is too large, split it before encoding", rect)
+	}
+	if rect.Area() == 0 {
+		return nil
+	}
+	// streams opened with a previous compression level are restarted on both sides
+	level := enc.zlibLevel()
+	for i, w := range enc.encoders {
+		if w != nil && enc.encoderLevels[i] != level {
+			enc.resetEncoder(i)
+		}
+	}
+
+	pixels := readRectPixels(enc.Image, int(rect.X), int(rect.Y), int(rect.Width), int(rect.Height))
+	palette, indexes := tightPalette(pixels)
+	jpegQuality := enc.jpegQuality()
+
+	switch {
+	case len(palette) == 1:
+		logger.Tracef("--TIGHT_FILL: writing fill rect=%v", rect)
+		return enc.writeFill(c, &pf, palette[0])
+	case len(palette) == 2:
+		logger.Tracef("--TIGHT_MONO: writing mono rect=%v", rect)
+		return enc.writeMono(c, &pf, rect, palette, indexes)
+	case palette != nil && len(palette)*8 <= rect.Area():
+		logger.Tracef("--TIGHT_PALETTE: writing %d color palette rect=%v", len(palette), rect)
+		return enc.writeIndexed(c, &pf, palette, indexes)
+	case jpegQuality > 0 && pf.BPP != 8 && rect.Area() >= tightMinJPEGArea:
+		logger.Tracef("--TIGHT_JPEG: writing jpeg rect=%v quality=%d", rect, jpegQuality)
+		return enc.writeJPEG(c, rect, pixels, jpegQuality)
+	case isTightFormat(&pf) && isSmoothImage(rect, pixels):
+		logger.Tracef("--TIGHT_GRADIENT: writing gradient rect=%v", rect)
+		return enc.writeGradient(c, rect, pixels)
+	}
+	logger.Tracef("--TIGHT_BASIC: writing copy filter rect=%v", rect)
+	return enc.writeCopy(c, &pf, pixels)
+}
+
+// tightPalette collects the rect colors, returning a nil palette when there are too many of them.
+func tightPalette(pixels []color.RGBA) ([]color.RGBA, []uint8) {
+	var palette []color.RGBA
+	lookup := make(map[color.RGBA]uint8)
+	indexes := make([]uint8, len(pixels))
+	for i, col := range pixels {
+		idx, ok := lookup[col]
+		if !ok {
+			if len(palette) == tightMaxPaletteColors {
+				return nil, nil
+			}
+			idx = uint8(len(palette))
+			lookup[col] = idx
+			palette = append(palette, col)
+		}
+		indexes[i] = idx
+	}
+	return palette, indexes
+}
+
+// isSmoothImage reports whether the gradient filter is likely to compress the rect better than
+// plain zlib, by checking how well each pixel is predicted from its neighbours.
+func isSmoothImage(rect *Rectangle, pixels []color.RGBA) bool {
+	width := int(rect.Width)
+	if width < 16 || rect.Height < 16 {
+		return false
+	}
+	var errSum int
+	for i := width + 1; i < len(pixels); i++ {
+		if i%width == 0 {
+			continue
+		}
+		up, left, diag := pixels[i-width], pixels[i-1], pixels[i-width-1]
+		errSum += absInt(int(pixels[i].R) - gradientPredict(up.R, left.R, diag.R))
+		errSum += absInt(int(pixels[i].G) - gradientPredict(up.G, left.G, diag.G))
+		errSum += absInt(int(pixels[i].B) - gradientPredict(up.B, left.B, diag.B))
+	}
+	return errSum/(len(pixels)*3) < tightSmoothThreshold
+}
+
+func gradientPredict(up, left, diag uint8) int {
+	d := int(up) + int(left) - int(diag)
+	if d < 0 {
+		d = 0
+	}
+	if d > 255 {
+		d = 255
+	}
+	return d
+}
+
+func absInt(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func isTightFormat(pf *PixelFormat) bool {
+	return pf.TrueColor != 0 && pf.Depth == 24 && pf.BPP == 32 && pf.BlueMax <= 255 && pf.RedMax <= 255 && pf.GreenMax <= 255
+}
+
+// writeTightColor marshals a TPIXEL, which is packed into 3 bytes for 24 bit depth formats
+func writeTightColor(w io.Writer, pf *PixelFormat, col color.RGBA) error {
+	if isTightFormat(pf) {
+		_, err := w.Write([]byte{col.R, col.G, col.B})
+		return err
+	}
+	return WriteColor(w, pf, col)
+}
+
+// writeCompCtl writes the compression control byte, adding the pending stream reset flags
+func (enc *TightEncoding) writeCompCtl(c Conn, compctl uint8) error {
+	compctl |= enc.resetStreams
+	enc.resetStreams = 0
+	return binary.Write(c, binary.BigEndian, compctl)
+}
+
+func (enc *TightEncoding) writeFill(c Conn, pf *PixelFormat, col color.RGBA) error {
+	if err := enc.writeCompCtl(c, TightCompressionFill<<4); err != nil {
+		return err
+	}
+	return writeTightColor(c, pf, col)
+}
+
+func (enc *TightEncoding) writePalette(c Conn, pf *PixelFormat, streamId uint8, palette []color.RGBA) error {
+	if err := enc.writeCompCtl(c, (streamId|0x04)<<4); err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, []uint8{TightFilterPalette, uint8(len(palette) - 1)}); err != nil {
+		return err
+	}
+	for _, col := range palette {
+		if err := writeTightColor(c, pf, col); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+func (enc *TightEncoding) writeMono(c Conn, pf *PixelFormat, rect *Rectangle, palette []color.RGBA, indexes []uint8) error {
+	if err := enc.writePalette(c, pf, tightStreamMono, palette); err != nil {
+		return err
+	}
+	width := int(rect.Width)
+	rowBytes := (width + 7) / 8
+	data := make([]byte, rowBytes*int(rect.Height))
+	for i, idx := range indexes {
+		if idx == 0 {
+			continue
+		}
+		x, y := i%width, i/width
+		data[y*rowBytes+x/8] |= 0x80 >> uint(x%8)
+	}
+	return enc.writeTightData(c, tightStreamMono, data)
+}
+
+func (enc *TightEncoding) writeIndexed(c Conn, pf *PixelFormat, palette []color.RGBA, indexes []uint8) error {
+	if err := enc.writePalette(c, pf, tightStreamIndexed, palette); err != nil {
+		return err
+	}
+	return enc.writeTightData(c, tightStreamIndexed, indexes)
+}
+
+func (enc *TightEncoding) writeGradient(c Conn, rect *Rectangle, pixels []color.RGBA) error {
+	if err := enc.writeCompCtl(c, (tightStreamGradient|0x04)<<4); err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, uint8(TightFilterGradient)); err != nil {
+		return err
+	}
+	width := int(rect.Width)
+	var zero color.RGBA
+	data := make([]byte, 0, len(pixels)*3)
+	for i, px := range pixels {
+		up, left, diag := zero, zero, zero
+		if i >= width {
+			up = pixels[i-width]
+		}
+		if i%width != 0 {
+			left = pixels[i-1]
+			if i >= width {
+				diag = pixels[i-width-1]
+			}
+		}
+		data = append(data,
+			byte(int(px.R)-gradientPredict(up.R, left.R, diag.R)),
+			byte(int(px.G)-gradientPredict(up.G, left.G, diag.G)),
+			byte(int(px.B)-gradientPredict(up.B, left.B, diag.B)))
+	}
+	return enc.writeTightData(c, tightStreamGradient, data)
+}
+
+func (enc *TightEncoding) writeCopy(c Conn, pf *PixelFormat, pixels []color.RGBA) error {
+	if err := enc.writeCompCtl(c, tightStreamCopy<<4); err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	for _, px := range pixels {
+		if err := writeTightColor(buf, pf, px); err != nil {
+			return err
+		}
+	}
+	return enc.writeTightData(c, tightStreamCopy, buf.Bytes())
+}
+
+// tightRectImage returns an opaque image of the rect pixels, at the origin
+func tightRectImage(rect *Rectangle, pixels []color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, int(rect.Width), int(rect.Height)))
+	for i, px := range pixels {
+		img.Pix[i*4] = px.R
+		img.Pix[i*4+1] = px.G
+		img.Pix[i*4+2] = px.B
+		img.Pix[i*4+3] = 255
+	}
+	return img
+}
+
+func (enc *TightEncoding) writeJPEG(c Conn, rect *Rectangle, pixels []color.RGBA, quality int) error {
+	img := tightRectImage(rect, pixels)
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return err
+	}
+	if err := enc.writeCompCtl(c, TightCompressionJPEG<<4); err != nil {
+		return err
+	}
+	if err := writeTightLength(c, buf.Len()); err != nil {
+		return err
+	}
+	_, err := buf.WriteTo(c)
+	return err
+}
+
+// writeTightData writes filtered pixel data, compressing it on the given zlib stream when it is
+// large enough, the inverse of ReadTightData.
+func (enc *TightEncoding) writeTightData(c Conn, streamId int, data []byte) error {
+	if len(data) < TightMinToCompress {
+		_, err := c.Write(data)
+		return err
+	}
+
+	if enc.encoders[streamId] == nil {
+		level := enc.zlibLevel()
+		buf := &bytes.Buffer{}
+		w, err := zlib.NewWriterLevel(buf, level)
+		if err != nil {
+			return err
+		}
+		enc.encoders[streamId] = w
+		enc.encoderBuffs[streamId] = buf
+		enc.encoderLevels[streamId] = level
+	}
+
+	buf := enc.encoderBuffs[streamId]
+	buf.Reset()
+	if _, err := enc.encoders[streamId].Write(data); err != nil {
+		return err
+	}
+	if err := enc.encoders[streamId].Flush(); err != nil {
+		return err
+	}
+	if err := writeTightLength(c, buf.Len()); err != nil {
+		return err
+	}
+	_, err := buf.WriteTo(c)
+	return err
+}
+
 // Read unmarshal color from conn
 func getTightColor(c io.Reader, pf *PixelFormat) (*color.RGBA, error) {
 
@@ -69,8 +398,7 @@ func getTightColor(c io.Reader, pf *PixelFormat) (*color.RGBA, error) {
 	}
 	order := pf.order()
 	var pixel uint32
-	isTightFormat := pf.TrueColor != 0 && pf.Depth == 24 && pf.BPP == 32 && pf.BlueMax <= 255 && pf.RedMax <= 255 && pf.GreenMax <= 255
-	if isTightFormat {
+	if isTightFormat(pf) {
 		//tbytes := make([]byte, 3)
 		tbytes, err := ReadBytes(3, c)
 		if err != nil {
@@ -131,9 +459,22 @@ func calcTightBytePerPixel(pf *PixelFormat) int {
 func (enc *TightEncoding) Reset() error {
 	//enc.decoders = make([]io.Reader, 4)
 	//enc.decoderBuffs = make([]*bytes.Buffer, 4)
+	for i := range enc.encoders {
+		enc.resetEncoder(i)
+	}
 	return nil
 }
 
+// resetEncoder drops a zlib stream, the client is told to reset its matching decoder in the next rect.
+func (enc *TightEncoding) resetEncoder(streamId int) {
+	if enc.encoders[streamId] == nil {
+		return
+	}
+	enc.encoders[streamId] = nil
+	enc.encoderBuffs[streamId] = nil
+	enc.resetStreams |= 1 << uint(streamId)
+}
+
 func (enc *TightEncoding) resetDecoders(compControl uint8) {
 	logger.Tracef("###resetDecoders compctl :%d", 0x0F&compControl)
 	for i := 0; i < 4; i++ {
@@ -145,6 +486,26 @@ func (enc *TightEncoding) resetDecoders(compControl uint8) {
 	}
 }
 
+func (enc *TightEncoding) streamState() interface{} {
+	states := make([]*inflateState, 4)
+	for i, d := range enc.decoders {
+		if d != nil {
+			states[i] = d.state()
+		}
+	}
+	return states
+}
+
+func (enc *TightEncoding) restoreStreamState(state interface{}) {
+	states := state.([]*inflateState)
+	enc.decoders = make([]*inflateStream, len(states))
+	for i, st := range states {
+		if st != nil {
+			enc.decoders[i] = st.resume()
+		}
+	}
+}
+
 func (enc *TightEncoding) SetTargetImage(img draw.Image) {
 	enc.Image = img
 }
@@ -275,7 +636,6 @@ func (enc *TightEncoding) handleTightFilters(compCtl uint8, pixelFmt *PixelForma
 
 	for len(enc.decoders) < 4 {
 		enc.decoders = append(enc.decoders, nil)
-		enc.decoderBuffs = append(enc.decoderBuffs, nil)
 	}
 
 	if (compCtl & FILTER_ID_MASK) > 0 {
@@ -386,6 +746,10 @@ func (enc *TightEncoding) drawTightPalette(rect *Rectangle, palette color.Palett
 			//logger.Tracef("(%d,%d): pos: %d col:%d", int(rect.X)+j, int(rect.Y)+i, palettePos, palette[palettePos])
 		}
 
+		// rows are padded to whole bytes, skip the rest of a partially used byte
+		if len(palette) == 2 && bitPos != 7 {
+			bytePos++
+		}
 		// reset bit alignment to first bit in byte (msb)
 		bitPos = 7
 	}
@@ -441,7 +805,7 @@ func (enc *TightEncoding) decodeGradData(rect *Rectangle, buffer []byte) {
 			bIdx += 3
 		}
 
-		for idx := 3; idx < (len(thisRow) - 3); idx += 3 {
+		for idx := 3; idx < len(thisRow); idx += 3 {
 			myColor := color.RGBA{R: (thisRow[idx]), G: (thisRow[idx+1]), B: (thisRow[idx+2]), A: 1}
 			if !disableGradient {
 				enc.Image.Set(idx/3+int(rect.X)-1, int(rect.Y)+i, myColor)
@@ -563,17 +927,15 @@ func (enc *TightEncoding) ReadTightData(dataSize int, c Conn, decoderId int) ([]
 	if err != nil {
 		return nil, err
 	}
-	var r io.Reader
-	if enc.decoders[decoderId] == nil {
-		b := bytes.NewBuffer(zippedBytes)
-		r, err = zlib.NewReader(b)
+	r := enc.decoders[decoderId]
+	if r == nil {
+		r, err = newInflateStream(zippedBytes)
+		if err != nil {
+			return nil, err
+		}
 		enc.decoders[decoderId] = r
-		enc.decoderBuffs[decoderId] = b
 	} else {
-		b := enc.decoderBuffs[decoderId]
-
-		b.Write(zippedBytes) //set the underlaying buffer to new content (not resetting the decoder zlib stream)
-		r = enc.decoders[decoderId]
+		r.Write(zippedBytes) //add the new content to the stream's input (not resetting the decoder zlib stream)
 	}
 
 	retBytes := make([]byte, dataSize)
@@ -603,6 +965,8 @@ func readTightCC(c Conn) (*TightCC, error) {
 		return &TightCC{TightCompressionBasic, TightFilterCopy}, nil
 	case TightCompressionFill:
 		return &TightCC{TightCompressionFill, TightFilterCopy}, nil
+	case TightCompressionJPEG:
+		return &TightCC{TightCompressionJPEG, TightFilterCopy}, nil
 	case TightCompressionPNG:
 		return &TightCC{TightCompressionPNG, TightFilterCopy}, nil
 	}
@@ -2,16 +2,24 @@ package vnc2video
 
 import (
 	"bytes"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"image"
-	"image/color"
 	"image/draw"
+	"image/jpeg"
 	"image/png"
-	"io"
+
 	"github.com/amitbet/vnc2video/logger"
 )
 
+// TightPngEncoding is the tight encoding of noVNC servers, rects are a fill color, a jpeg or a
+// png, there are no zlib streams nor filters.
+type TightPngEncoding struct {
+	// TightCC is the compression of the last rect read, or of the rects written when set
+	TightCC *TightCC
+	Image   draw.Image
+}
+
 func (*TightPngEncoding) Supported(Conn) bool {
 	return true
 }
@@ -19,82 +27,104 @@ func (*TightPngEncoding) Reset() error {
 	return nil
 }
 
+func (*TightPngEncoding) Type() EncodingType { return EncTightPng }
+
+func (enc *TightPngEncoding) newConnEncoding() Encoding {
+	return &TightPngEncoding{TightCC: enc.TightCC, Image: enc.Image}
+}
+
+// Write encodes the rect region of enc.Image with the compression of enc.TightCC, or as a fill
+// for solid rects and a png otherwise when it isn't set.
 func (enc *TightPngEncoding) Write(c Conn, rect *Rectangle) error {
-	if err := writeTightCC(c, enc.TightCC); err != nil {
+	if enc.Image == nil {
+		return errors.New("tightpng encoding: no source image to encode")
+	}
+	pf := c.PixelFormat()
+	if pf.TrueColor == 0 {
+		return errors.New("support for non true color formats was not implemented")
+	}
+	pixels := readRectPixels(enc.Image, int(rect.X), int(rect.Y), int(rect.Width), int(rect.Height))
+	tcc := enc.TightCC
+	if tcc == nil {
+		tcc = &TightCC{Compression: TightCompressionPNG, Filter: TightFilterCopy}
+		if palette, _ := tightPalette(pixels); len(palette) == 1 {
+			tcc.Compression = TightCompressionFill
+		}
+	}
+	if err := writeTightCC(c, tcc); err != nil {
 		return err
 	}
-	cmp := enc.TightCC.Compression
-	switch cmp {
-	case TightCompressionPNG:
+	switch tcc.Compression {
+	case TightCompressionFill:
+		if len(pixels) == 0 {
+			return errors.New("tightpng encoding: no fill color for an empty rect")
+		}
+		return writeTightColor(c, &pf, pixels[0])
+	case TightCompressionJPEG, TightCompressionPNG:
+		img := tightRectImage(rect, pixels)
 		buf := bPool.Get().(*bytes.Buffer)
 		buf.Reset()
 		defer bPool.Put(buf)
-		pngEnc := &png.Encoder{CompressionLevel: png.BestSpeed}
-		//pngEnc := &png.Encoder{CompressionLevel: png.NoCompression}
-		if err := pngEnc.Encode(buf, enc.Image); err != nil {
-			return err
-		}
-		if err := writeTightLength(c, buf.Len()); err != nil {
-			return err
+		var err error
+		if tcc.Compression == TightCompressionJPEG {
+			err = jpeg.Encode(buf, img, &jpeg.Options{Quality: jpeg.DefaultQuality})
+		} else {
+			err = (&png.Encoder{CompressionLevel: png.BestSpeed}).Encode(buf, img)
 		}
-
-		if _, err := buf.WriteTo(c); err != nil {
+		if err != nil {
 			return err
 		}
-	case TightCompressionFill:
-		var tpx TightPixel
-		r, g, b, _ := enc.Image.At(0, 0).RGBA()
-		tpx.R = uint8(r)
-		tpx.G = uint8(g)
-		tpx.B = uint8(b)
-		if err := binary.Write(c, binary.BigEndian, tpx); err != nil {
+		if err := writeTightLength(c, buf.Len()); err != nil {
 			return err
 		}
-	default:
-		return fmt.Errorf("unknown tight compression %d", cmp)
+		_, err = buf.WriteTo(c)
+		return err
 	}
-	return nil
-}
-
-type TightPngEncoding struct {
-	TightCC *TightCC
-	Image   draw.Image
+	return fmt.Errorf("tightpng encoding: compression %s not supported", tcc.Compression)
 }
 
-func (*TightPngEncoding) Type() EncodingType { return EncTightPng }
-
+// Read implements the Encoding interface, drawing the rect into enc.Image.
 func (enc *TightPngEncoding) Read(c Conn, rect *Rectangle) error {
 	tcc, err := readTightCC(c)
-	logger.Trace("starting to read a tight rect: %v", rect)
 	if err != nil {
 		return err
 	}
+	logger.Tracef("reading a tightpng rect: %v, compression: %s", rect, tcc.Compression)
 	enc.TightCC = tcc
-	cmp := enc.TightCC.Compression
-	switch cmp {
-	case TightCompressionPNG:
-		l, err := readTightLength(c)
+	if enc.Image == nil {
+		enc.Image = image.NewRGBA(image.Rect(0, 0, int(c.Width()), int(c.Height())))
+	}
+	switch tcc.Compression {
+	case TightCompressionFill:
+		pf := c.PixelFormat()
+		col, err := getTightColor(c, &pf)
 		if err != nil {
 			return err
 		}
-		img, err := png.Decode(io.LimitReader(c, int64(l)))
+		myRect := MakeRectFromVncRect(rect)
+		FillRect(enc.Image, &myRect, col)
+	case TightCompressionJPEG, TightCompressionPNG:
+		length, err := readTightLength(c)
 		if err != nil {
 			return err
 		}
-		//draw.Draw(enc.Image, enc.Image.Bounds(), img, image.Point{X: int(rect.X), Y: int(rect.Y)}, draw.Src)
-		DrawImage(enc.Image, img, image.Point{X: int(rect.X), Y: int(rect.Y)})
-	case TightCompressionFill:
-		var tpx TightPixel
-		if err := binary.Read(c, binary.BigEndian, &tpx); err != nil {
+		// the whole payload is read first, decoders may stop before its end
+		data, err := ReadBytes(length, c)
+		if err != nil {
 			return err
 		}
-		//enc.Image = image.NewRGBA(image.Rect(0, 0, 1, 1))
-		col := color.RGBA{R: tpx.R, G: tpx.G, B: tpx.B, A: 1}
-		myRect := MakeRectFromVncRect(rect)
-		FillRect(enc.Image, &myRect, col)
-		//enc.Image.(draw.Image).Set(0, 0, color.RGBA{R: tpx.R, G: tpx.G, B: tpx.B, A: 1})
+		var img image.Image
+		if tcc.Compression == TightCompressionJPEG {
+			img, err = jpeg.Decode(bytes.NewReader(data))
+		} else {
+			img, err = png.Decode(bytes.NewReader(data))
+		}
+		if err != nil {
+			return err
+		}
+		DrawImage(enc.Image, img, image.Point{X: int(rect.X), Y: int(rect.Y)})
 	default:
-		return fmt.Errorf("unknown compression %d", cmp)
+		return fmt.Errorf("tightpng encoding: compression %s not supported", tcc.Compression)
 	}
 	return nil
 }
@@ -40,6 +40,35 @@ func NewVncCanvas(width, height int) *VncCanvas {
 	return &canvas
 }
 
+// Resize changes the canvas size, keeping the part of the image inside both sizes
+func (c *VncCanvas) Resize(width, height int) {
+	old := c.Image.Bounds()
+	if old.Dx() == width && old.Dy() == height {
+		return
+	}
+	rect := image.Rect(0, 0, width, height)
+	var img draw.Image
+	switch src := c.Image.(type) {
+	case *image.RGBA:
+		dst := image.NewRGBA(rect)
+		draw.Draw(dst, rect, src, image.Point{}, draw.Src)
+		img = dst
+	case *RGBImage:
+		dst := NewRGBImage(rect)
+		rowLen := 3 * Min(width, old.Dx())
+		for y := 0; y < Min(height, old.Dy()); y++ {
+			copy(dst.Pix[y*dst.Stride:y*dst.Stride+rowLen], src.Pix[y*src.Stride:])
+		}
+		img = dst
+	default:
+		dst := NewRGBImage(rect)
+		DrawImage(dst, src, image.Point{})
+		img = dst
+	}
+	c.Image = img
+	c.SetChanged(&Rectangle{Width: uint16(width), Height: uint16(height)})
+}
+
 func (c *VncCanvas) SetChanged(rect *Rectangle) {
 	if c.Changed == nil {
 		c.Changed = make(map[string]bool)
@@ -195,6 +224,72 @@ func ReadColor(c io.Reader, pf *PixelFormat) (*color.RGBA, error) {
 	return &rgb, nil
 }
 
+// WriteColor marshals a color to w in the given pixel format, the inverse of ReadColor
+func WriteColor(w io.Writer, pf *PixelFormat, c color.Color) error {
+	if pf.TrueColor == 0 {
+		return errors.New("support for non true color formats was not implemented")
+	}
+	order := pf.order()
+	pixel := colorToPixel(pf, c)
+
+	switch pf.BPP {
+	case 8:
+		return binary.Write(w, order, uint8(pixel))
+	case 16:
+		return binary.Write(w, order, uint16(pixel))
+	case 32:
+		return binary.Write(w, order, pixel)
+	}
+	return fmt.Errorf("unsupported bits per pixel: %d", pf.BPP)
+}
+
+// colorToPixel scales the 8 bit color channels into the pixel format's channel maximums
+func colorToPixel(pf *PixelFormat, c color.Color) uint32 {
+	col := color.RGBAModel.Convert(c).(color.RGBA)
+	pixel := (uint32(col.R) * uint32(pf.RedMax) / 255) << pf.RedShift
+	pixel |= (uint32(col.G) * uint32(pf.GreenMax) / 255) << pf.GreenShift
+	pixel |= (uint32(col.B) * uint32(pf.BlueMax) / 255) << pf.BlueShift
+	return pixel
+}
+
+// rgbaAt returns the color of a source image pixel, with a fast path for the canvas image types
+func rgbaAt(img image.Image, x, y int) color.RGBA {
+	switch im := img.(type) {
+	case *VncCanvas:
+		return rgbaAt(im.Image, x, y)
+	case *RGBImage:
+		col := im.RGBAt(x, y)
+		return color.RGBA{R: col.R, G: col.G, B: col.B, A: 1}
+	case *image.RGBA:
+		return im.RGBAAt(x, y)
+	}
+	return color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+}
+
+// readRectPixels returns the pixels of a source image region in row order, the encoders ignore alpha
+// so it is normalized to the value the decoders use.
+func readRectPixels(img image.Image, x, y, width, height int) []color.RGBA {
+	pixels := make([]color.RGBA, 0, width*height)
+	for py := y; py < y+height; py++ {
+		for px := x; px < x+width; px++ {
+			col := rgbaAt(img, px, py)
+			col.A = 1
+			pixels = append(pixels, col)
+		}
+	}
+	return pixels
+}
+
+// EncodeRaw writes the rect region of the source image as raw pixels, the inverse of DecodeRaw
+func EncodeRaw(w io.Writer, pf *PixelFormat, rect *Rectangle, sourceImage image.Image) error {
+	for _, col := range readRectPixels(sourceImage, int(rect.X), int(rect.Y), int(rect.Width), int(rect.Height)) {
+		if err := WriteColor(w, pf, col); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func DecodeRaw(reader io.Reader, pf *PixelFormat, rect *Rectangle, targetImage draw.Image) error {
 	for y := 0; y < int(rect.Height); y++ {
 		for x := 0; x < int(rect.Width); x++ {
@@ -3,26 +3,76 @@ package vnc2video
 import (
 	"bytes"
 	"compress/zlib"
+	"encoding/binary"
+	"errors"
 	"image/draw"
 	"io"
+
+	"github.com/amitbet/vnc2video/logger"
 )
 
 type ZLibEncoding struct {
-	Image      draw.Image
-	unzipper   io.Reader
-	zippedBuff *bytes.Buffer
+	Image    draw.Image
+	unzipper *inflateStream
+
+	// server side state: the zlib stream lives as long as the connection
+	zipper        *zlib.Writer
+	zipperBuff    *bytes.Buffer
+	compressLevel int
+	levelsSet     bool
 }
 
 func (*ZLibEncoding) Type() EncodingType {
 	return EncZlib
 }
 
+// newConnEncoding returns an encoding starting a zlib stream of its own
+func (enc *ZLibEncoding) newConnEncoding() Encoding {
+	return &ZLibEncoding{Image: enc.Image}
+}
+
 func (enc *ZLibEncoding) WriteTo(w io.Writer) (n int, err error) {
 	return 0, nil
 }
 
+func (enc *ZLibEncoding) setLevels(compressLevel, qualityLevel int) {
+	enc.compressLevel = compressLevel
+	enc.levelsSet = true
+}
+
+// Write sends the rect region of enc.Image as raw pixels compressed on the connection's zlib stream
 func (enc *ZLibEncoding) Write(c Conn, rect *Rectangle) error {
-	return nil
+	if enc.Image == nil {
+		return errors.New("zlib encoding: no source image to encode")
+	}
+	pf := c.PixelFormat()
+
+	if enc.zipper == nil {
+		level := zlib.DefaultCompression
+		if enc.levelsSet && enc.compressLevel >= 0 {
+			level = enc.compressLevel
+		}
+		enc.zipperBuff = &bytes.Buffer{}
+		zipper, err := zlib.NewWriterLevel(enc.zipperBuff, level)
+		if err != nil {
+			return err
+		}
+		enc.zipper = zipper
+	}
+
+	enc.zipperBuff.Reset()
+	if err := EncodeRaw(enc.zipper, &pf, rect, enc.Image); err != nil {
+		return err
+	}
+	if err := enc.zipper.Flush(); err != nil {
+		return err
+	}
+	logger.Tracef("writing ZLib: %v, zipped length: %d", rect, enc.zipperBuff.Len())
+	if err := binary.Write(c, binary.BigEndian, uint32(enc.zipperBuff.Len())); err != nil {
+		return err
+	}
+	_, err := enc.zipperBuff.WriteTo(c)
+	return err
 }
 
 func (enc *ZLibEncoding) SetTargetImage(img draw.Image) {
@@ -32,6 +82,20 @@ func (enc *ZLibEncoding) SetTargetImage(img draw.Image) {
 func (*ZLibEncoding) Supported(Conn) bool {
 	return true
 }
+func (enc *ZLibEncoding) streamState() interface{} {
+	if enc.unzipper == nil {
+		return (*inflateState)(nil)
+	}
+	return enc.unzipper.state()
+}
+
+func (enc *ZLibEncoding) restoreStreamState(state interface{}) {
+	enc.unzipper = nil
+	if st := state.(*inflateState); st != nil {
+		enc.unzipper = st.resume()
+	}
+}
+
 func (enc *ZLibEncoding) Reset() error {
 	enc.unzipper = nil
 	return nil
@@ -53,16 +117,13 @@ func (enc *ZLibEncoding) Read(r Conn, rect *Rectangle) error {
 	if err != nil {
 		return err
 	}
-	bytesBuff := bytes.NewBuffer(b)
-
 	if enc.unzipper == nil {
-		enc.unzipper, err = zlib.NewReader(bytesBuff)
-		enc.zippedBuff = bytesBuff
+		enc.unzipper, err = newInflateStream(b)
 		if err != nil {
 			return err
 		}
 	} else {
-		enc.zippedBuff.Write(b)
+		enc.unzipper.Write(b)
 	}
 	DecodeRaw(enc.unzipper, &pf, rect, enc.Image)
 
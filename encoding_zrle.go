@@ -3,20 +3,40 @@ package vnc2video
 import (
 	"bytes"
 	"compress/zlib"
+	"encoding/binary"
 	"errors"
 	"image/color"
 	"image/draw"
 	"io"
+
 	"github.com/amitbet/vnc2video/logger"
 )
 
 type ZRLEEncoding struct {
-	bytes      []byte
-	Image      draw.Image
-	unzipper   io.Reader
-	zippedBuff *bytes.Buffer
+	bytes    []byte
+	Image    draw.Image
+	unzipper *inflateStream
+
+	// server side state: the zlib stream lives as long as the connection
+	zipper        *zlib.Writer
+	zipperBuff    *bytes.Buffer
+	compressLevel int
+	levelsSet     bool
 }
 
+const (
+	zrleTileSize       = 64
+	zrleMaxPaletteSize = 127
+	zrleMaxPackedSize  = 16
+
+	// tile subencodings, packed palette is sent as the palette size
+	zrleSubencRaw      = 0
+	zrleSubencSolid    = 1
+	zrleSubencPlainRLE = 128
+	// zrlePaletteRLEBase is added to the palette size to send palette RLE, from 130 to 255
+	zrlePaletteRLEBase = 128
+)
+
 func (*ZRLEEncoding) Supported(Conn) bool {
 	return true
 }
@@ -25,6 +45,20 @@ func (enc *ZRLEEncoding) SetTargetImage(img draw.Image) {
 	enc.Image = img
 }
 
+func (enc *ZRLEEncoding) streamState() interface{} {
+	if enc.unzipper == nil {
+		return (*inflateState)(nil)
+	}
+	return enc.unzipper.state()
+}
+
+func (enc *ZRLEEncoding) restoreStreamState(state interface{}) {
+	enc.unzipper = nil
+	if st := state.(*inflateState); st != nil {
+		enc.unzipper = st.resume()
+	}
+}
+
 func (enc *ZRLEEncoding) Reset() error {
 	enc.unzipper = nil
 	return nil
@@ -32,14 +66,264 @@ func (enc *ZRLEEncoding) Reset() error {
 
 func (*ZRLEEncoding) Type() EncodingType { return EncZRLE }
 
+// newConnEncoding returns an encoding starting a zlib stream of its own
+func (enc *ZRLEEncoding) newConnEncoding() Encoding {
+	return &ZRLEEncoding{Image: enc.Image}
+}
+
 func (z *ZRLEEncoding) WriteTo(w io.Writer) (n int, err error) {
 	return w.Write(z.bytes)
 }
 
+func (enc *ZRLEEncoding) setLevels(compressLevel, qualityLevel int) {
+	enc.compressLevel = compressLevel
+	enc.levelsSet = true
+}
+
+// Write encodes the rect region of enc.Image as 64x64 tiles, each one using
+// its cheapest subencoding, compressed on the connection's zlib stream.
 func (enc *ZRLEEncoding) Write(c Conn, rect *Rectangle) error {
+	if enc.Image == nil {
+		return errors.New("zrle encoding: no source image to encode")
+	}
+	pf := c.PixelFormat()
+	if pf.TrueColor == 0 {
+		return errors.New("support for non true color formats was not implemented")
+	}
+
+	if enc.zipper == nil {
+		level := zlib.DefaultCompression
+		if enc.levelsSet && enc.compressLevel >= 0 {
+			level = enc.compressLevel
+		}
+		enc.zipperBuff = &bytes.Buffer{}
+		zipper, err := zlib.NewWriterLevel(enc.zipperBuff, level)
+		if err != nil {
+			return err
+		}
+		enc.zipper = zipper
+	}
+
+	enc.zipperBuff.Reset()
+	tileBuff := &bytes.Buffer{}
+	for tileOffsetY := 0; tileOffsetY < int(rect.Height); tileOffsetY += zrleTileSize {
+		tileHeight := Min(zrleTileSize, int(rect.Height)-tileOffsetY)
+
+		for tileOffsetX := 0; tileOffsetX < int(rect.Width); tileOffsetX += zrleTileSize {
+			tileWidth := Min(zrleTileSize, int(rect.Width)-tileOffsetX)
+
+			tileBuff.Reset()
+			tile := readRectPixels(enc.Image, int(rect.X)+tileOffsetX, int(rect.Y)+tileOffsetY, tileWidth, tileHeight)
+			if err := writeZRLETile(tileBuff, &pf, tile, tileWidth, tileHeight); err != nil {
+				return err
+			}
+			if _, err := enc.zipper.Write(tileBuff.Bytes()); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := enc.zipper.Flush(); err != nil {
+		return err
+	}
+	logger.Tracef("writing ZRLE: %v, zipped length: %d", rect, enc.zipperBuff.Len())
+	if err := binary.Write(c, binary.BigEndian, uint32(enc.zipperBuff.Len())); err != nil {
+		return err
+	}
+	_, err := enc.zipperBuff.WriteTo(c)
+	return err
+}
+
+// zrleRunBytes is the number of bytes taken by a run length
+func zrleRunBytes(runLen int) int {
+	return (runLen-1)/255 + 1
+}
+
+// writeZRLETile analyzes a tile and writes it with the cheapest of the raw,
+// solid, packed palette, plain RLE and palette RLE subencodings.
+func writeZRLETile(w io.Writer, pf *PixelFormat, tile []color.RGBA, tw, th int) error {
+	bpp := CalcBytesPerCPixel(pf)
+
+	// collect the runs and the palette, a tile with more than 127 colors has no palette
+	var runs []int
+	var runColors []color.RGBA
+	var palette []color.RGBA
+	lookup := make(map[color.RGBA]uint8)
+	hasPalette := true
+	for i, col := range tile {
+		if i > 0 && col == tile[i-1] {
+			runs[len(runs)-1]++
+			continue
+		}
+		runs = append(runs, 1)
+		runColors = append(runColors, col)
+		if _, ok := lookup[col]; ok || !hasPalette {
+			continue
+		}
+		if len(palette) == zrleMaxPaletteSize {
+			hasPalette = false
+			continue
+		}
+		lookup[col] = uint8(len(palette))
+		palette = append(palette, col)
+	}
+
+	if hasPalette && len(palette) == 1 {
+		if err := binary.Write(w, binary.BigEndian, uint8(zrleSubencSolid)); err != nil {
+			return err
+		}
+		return writeCPixel(w, pf, palette[0])
+	}
+
+	subEnc := zrleSubencRaw
+	size := len(tile) * bpp
+	plainRLESize := 0
+	for _, runLen := range runs {
+		plainRLESize += bpp + zrleRunBytes(runLen)
+	}
+	if plainRLESize < size {
+		subEnc, size = zrleSubencPlainRLE, plainRLESize
+	}
+	if hasPalette {
+		paletteRLESize := len(palette) * bpp
+		for _, runLen := range runs {
+			paletteRLESize++
+			if runLen > 1 {
+				paletteRLESize += zrleRunBytes(runLen)
+			}
+		}
+		if paletteRLESize < size {
+			subEnc, size = zrlePaletteRLEBase+len(palette), paletteRLESize
+		}
+		if len(palette) <= zrleMaxPackedSize {
+			packedSize := len(palette)*bpp + th*((tw*int(zrlePackedBits(len(palette)))+7)/8)
+			if packedSize < size {
+				subEnc, size = len(palette), packedSize
+			}
+		}
+	}
+
+	if err := binary.Write(w, binary.BigEndian, uint8(subEnc)); err != nil {
+		return err
+	}
+	switch {
+	case subEnc == zrleSubencRaw:
+		for _, col := range tile {
+			if err := writeCPixel(w, pf, col); err != nil {
+				return err
+			}
+		}
+	case subEnc == zrleSubencPlainRLE:
+		for i, runLen := range runs {
+			if err := writeCPixel(w, pf, runColors[i]); err != nil {
+				return err
+			}
+			if err := writeRunLength(w, runLen); err != nil {
+				return err
+			}
+		}
+	case subEnc > zrlePaletteRLEBase:
+		if err := writeZRLEPalette(w, pf, palette); err != nil {
+			return err
+		}
+		for i, runLen := range runs {
+			index := lookup[runColors[i]]
+			if runLen == 1 {
+				if err := binary.Write(w, binary.BigEndian, index); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := binary.Write(w, binary.BigEndian, index|0x80); err != nil {
+				return err
+			}
+			if err := writeRunLength(w, runLen); err != nil {
+				return err
+			}
+		}
+	default:
+		if err := writeZRLEPalette(w, pf, palette); err != nil {
+			return err
+		}
+		return writeZRLEPacked(w, lookup, zrlePackedBits(len(palette)), tile, tw)
+	}
+	return nil
+}
+
+// zrlePackedBits is the size of a palette index in the packed palette subencoding
+func zrlePackedBits(paletteSize int) uint {
+	if paletteSize == 2 {
+		return 1
+	} else if paletteSize <= 4 {
+		return 2
+	}
+	return 4
+}
+
+func writeZRLEPalette(w io.Writer, pf *PixelFormat, palette []color.RGBA) error {
+	for _, col := range palette {
+		if err := writeCPixel(w, pf, col); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeZRLEPacked writes palette indexes packed msb first, each row starting on a byte boundary
+func writeZRLEPacked(w io.Writer, lookup map[color.RGBA]uint8, indexBits uint, tile []color.RGBA, tw int) error {
+	row := make([]byte, (tw*int(indexBits)+7)/8)
+	for y := 0; y < len(tile)/tw; y++ {
+		for i := range row {
+			row[i] = 0
+		}
+		bitPos := uint(0)
+		for x := 0; x < tw; x++ {
+			index := lookup[tile[y*tw+x]]
+			row[bitPos/8] |= index << (8 - indexBits - bitPos%8)
+			bitPos += indexBits
+		}
+		if _, err := w.Write(row); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// writeRunLength writes a run length as a sequence of 255 valued bytes followed by the remainder
+func writeRunLength(w io.Writer, runLen int) error {
+	buf := make([]byte, 0, zrleRunBytes(runLen))
+	rem := runLen - 1
+	for rem >= 255 {
+		buf = append(buf, 255)
+		rem -= 255
+	}
+	buf = append(buf, uint8(rem))
+	_, err := w.Write(buf)
+	return err
+}
+
+// writeCPixel writes a cpixel, the inverse of readCPixel
+func writeCPixel(w io.Writer, pf *PixelFormat, col color.RGBA) error {
+	if pf.TrueColor == 0 {
+		return errors.New("support for non true color formats was not implemented")
+	}
+	if !IsCPixelSpecific(pf) {
+		return WriteColor(w, pf, col)
+	}
+
+	// only 3 of the pixel's 4 bytes are significant, either the least or the most significant ones
+	pixel := colorToPixel(pf, col)
+	lowBytes := colorToPixel(pf, color.RGBA{R: 255, G: 255, B: 255})&0xff000000 == 0
+	buf := make([]byte, 4)
+	pf.order().PutUint32(buf, pixel)
+	if lowBytes == (pf.BigEndian != 1) {
+		_, err := w.Write(buf[:3])
+		return err
+	}
+	_, err := w.Write(buf[1:])
+	return err
+}
+
 func IsCPixelSpecific(pf *PixelFormat) bool {
 	significant := int(pf.RedMax<<pf.RedShift | pf.GreenMax<<pf.GreenShift | pf.BlueMax<<pf.BlueShift)
 
@@ -68,16 +352,13 @@ func (enc *ZRLEEncoding) Read(r Conn, rect *Rectangle) error {
 		return err
 	}
 
-	bytesBuff := bytes.NewBuffer(b)
-
 	if enc.unzipper == nil {
-		enc.unzipper, err = zlib.NewReader(bytesBuff)
-		enc.zippedBuff = bytesBuff
+		enc.unzipper, err = newInflateStream(b)
 		if err != nil {
 			return err
 		}
 	} else {
-		enc.zippedBuff.Write(b)
+		enc.unzipper.Write(b)
 	}
 	pf := r.PixelFormat()
 	enc.renderZRLE(rect, &pf)
@@ -31,6 +31,7 @@ func main() {
 	cchServer := make(chan vnc.ServerMessage)
 	cchClient := make(chan vnc.ClientMessage)
 	errorCh := make(chan error)
+	redirectCh := make(chan *vnc.ClientConn)
 
 	ccfg := &vnc.ClientConfig{
 		SecurityHandlers: []vnc.SecurityHandler{
@@ -53,8 +54,16 @@ func main() {
 			&vnc.CursorPosPseudoEncoding{},
 			&vnc.ZLibEncoding{},
 			&vnc.RREEncoding{},
+			&vnc.DesktopSizePseudoEncoding{},
+			&vnc.ExtendedDesktopSizePseudoEncoding{},
+			&vnc.QEMUExtendedKeyEventPseudoEncoding{},
+			&vnc.QEMUPointerMotionChangePseudoEncoding{},
+			&vnc.ClientRedirectPseudoEncoding{},
 		},
-		ErrorCh: errorCh,
+		ErrorCh:           errorCh,
+		ContinuousUpdates: true,
+		ExtendedClipboard: true,
+		RedirectCh:        redirectCh,
 	}
 
 	cc, err := vnc.Connect(context.Background(), nc, ccfg)
@@ -68,16 +77,17 @@ func main() {
 	// 	os.Exit(1)
 	// }
 	//vcodec := &encoders.MJPegImageEncoder{Quality: 60 , Framerate: framerate}
-	//vcodec := &encoders.X264ImageEncoder{FFMpegBinPath: "./ffmpeg", Framerate: framerate}
-	//vcodec := &encoders.HuffYuvImageEncoder{FFMpegBinPath: "./ffmpeg", Framerate: framerate}
-	vcodec := &encoders.QTRLEImageEncoder{FFMpegBinPath: "./ffmpeg", Framerate: framerate}
-	//vcodec := &encoders.VP8ImageEncoder{FFMpegBinPath:"./ffmpeg", Framerate: framerate}
-	//vcodec := &encoders.DV9ImageEncoder{FFMpegBinPath:"./ffmpeg", Framerate: framerate}
+	//vcodec := &encoders.PNGImageEncoder{Framerate: framerate}
+	//vcodec := &encoders.FFmpegEncoder{FFMpegBinPath: "./ffmpeg", Preset: encoders.PresetX264, Framerate: framerate}
+	//vcodec := &encoders.FFmpegEncoder{FFMpegBinPath: "./ffmpeg", Preset: encoders.PresetHuffYuv, Framerate: framerate}
+	vcodec := &encoders.FFmpegEncoder{FFMpegBinPath: "./ffmpeg", Preset: encoders.PresetQTRLE, Framerate: framerate}
+	//vcodec := &encoders.FFmpegEncoder{FFMpegBinPath: "./ffmpeg", Preset: encoders.PresetVP8, Framerate: framerate}
+	//vcodec := &encoders.FFmpegEncoder{FFMpegBinPath: "./ffmpeg", Preset: encoders.PresetVP9, Framerate: framerate}
 
 	//counter := 0
 	//vcodec.Init("./output" + strconv.Itoa(counter))
 
-	go vcodec.Run("./output.mp4")
+	go vcodec.Run("./output.mov")
 	//windows
 	///go vcodec.Run("/Users/amitbet/Dropbox/go/src/vnc2webm/example/file-reader/ffmpeg", "./output.mp4")
 
@@ -104,6 +114,9 @@ func main() {
 		vnc.EncCopyRect,
 		vnc.EncTight,
 		vnc.EncZRLE,
+		vnc.EncDesktopSizePseudo,
+		vnc.EncExtendedDesktopSizePseudo,
+		vnc.EncClientRedirect,
 		//vnc.EncHextile,
 		//vnc.EncZlib,
 		//vnc.EncRRE,
@@ -149,6 +162,9 @@ func main() {
 		select {
 		case err := <-errorCh:
 			panic(err)
+		case cc = <-redirectCh:
+			// the recording goes on in the same canvas
+			logger.Tracef("redirected to: %s", cc.Conn().RemoteAddr())
 		case msg := <-cchClient:
 			logger.Tracef("Received client message type:%v msg:%v\n", msg.Type(), msg)
 		case msg := <-cchServer:
@@ -169,6 +185,9 @@ func main() {
 				///vcodec.Encode(screenImage)
 				logger.Infof("reqs=%d, seconds=%f, Req Per second= %f", frameBufferReq, secsPassed, reqPerSec)
 
+				if cc.ContinuousUpdates() {
+					break
+				}
 				reqMsg := vnc.FramebufferUpdateRequest{Inc: 1, X: 0, Y: 0, Width: cc.Width(), Height: cc.Height()}
 				//cc.ResetAllEncodings()
 				reqMsg.Write(cc)
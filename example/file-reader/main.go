@@ -3,7 +3,6 @@ package main
 import (
 	"os"
 	"path/filepath"
-	"time"
 	vnc "github.com/amitbet/vnc2video"
 	"github.com/amitbet/vnc2video/encoders"
 	"github.com/amitbet/vnc2video/logger"
@@ -11,8 +10,6 @@ import (
 
 func main() {
 	framerate := 10
-	speedupFactor := 3.0
-	fastFramerate := int(float64(framerate) * speedupFactor)
 
 	if len(os.Args) <= 1 {
 		logger.Errorf("please provide a fbs file name")
@@ -27,6 +24,8 @@ func main() {
 		&vnc.TightEncoding{},
 		&vnc.CopyRectEncoding{},
 		&vnc.ZRLEEncoding{},
+		&vnc.DesktopSizePseudoEncoding{},
+		&vnc.ExtendedDesktopSizePseudoEncoding{},
 	}
 
 	fbs, err := vnc.NewFbsConn(
@@ -35,15 +34,16 @@ func main() {
 	)
 	if err != nil {
 		logger.Error("failed to open fbs reader:", err)
-		//return nil, err
+		return
 	}
 
 	//launch video encoding process:
-	vcodec := &encoders.X264ImageEncoder{FFMpegBinPath: "./ffmpeg", Framerate: framerate}
-	//vcodec := &encoders.DV8ImageEncoder{}
-	//vcodec := &encoders.DV9ImageEncoder{}
+	vcodec := &encoders.FFmpegEncoder{FFMpegBinPath: "./ffmpeg", Preset: encoders.PresetX264, Framerate: framerate}
+	//vcodec := &encoders.FFmpegEncoder{FFMpegBinPath: "./ffmpeg", Preset: encoders.PresetVP8, Framerate: framerate}
+	//vcodec := &encoders.FFmpegEncoder{FFMpegBinPath: "./ffmpeg", Preset: encoders.PresetVP9, Framerate: framerate}
 	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
 	logger.Tracef("current dir: %s", dir)
+	vcodec.Init("./output.mp4")
 	go vcodec.Run("./output.mp4")
 
 	//screenImage := image.NewRGBA(image.Rect(0, 0, int(fbs.Width()), int(fbs.Height())))
@@ -58,33 +58,12 @@ func main() {
 		}
 	}
 
-	go func() {
-		frameMillis := (1000.0 / float64(fastFramerate)) - 1 //a couple of millis, adjusting for time lost in software commands
-		frameDuration := time.Duration(frameMillis * float64(time.Millisecond))
-		//logger.Error("milis= ", frameMillis)
-
-		for {
-			timeStart := time.Now()
-
-			vcodec.Encode(screenImage.Image)
-			timeTarget := timeStart.Add(frameDuration)
-			timeLeft := timeTarget.Sub(time.Now())
-			//.Add(1 * time.Millisecond)
-			if timeLeft > 0 {
-				time.Sleep(timeLeft)
-				//logger.Error("sleeping= ", timeLeft)
-			}
-		}
-	}()
-
+	// render the whole file as fast as possible, frames are timed by the recording's timestamps
 	msgReader := vnc.NewFBSPlayHelper(fbs)
-	//loop over all messages, feed images to video codec:
-	for {
-		_, err := msgReader.ReadFbsMessage(true, speedupFactor)
-		//vcodec.Encode(screenImage.Image)
-		if err != nil {
-			os.Exit(-1)
-		}
-		//vcodec.Encode(screenImage)
+	err = msgReader.RenderFrames(screenImage, framerate, vcodec)
+	vcodec.Close()
+	if err != nil {
+		logger.Error("failed to render fbs file:", err)
+		os.Exit(-1)
 	}
 }
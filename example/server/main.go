@@ -21,6 +21,9 @@ func main() {
 	chClient := make(chan vnc.ServerMessage)
 
 	im := image.NewRGBA(image.Rect(0, 0, width, height))
+	drawImage(im, 0)
+	source := vnc.NewImageSource(im)
+	anim := 0
 	tick := time.NewTicker(time.Second / 2)
 	defer tick.Stop()
 
@@ -32,11 +35,12 @@ func main() {
 		SecurityHandlers: []vnc.SecurityHandler{&vnc.ClientAuthNone{}},
 		//ClientInitHandler: vnc.ServerClientInitHandler,
 		//ServerInitHandler: vnc.ServerServerInitHandler,
-		Encodings:       []vnc.Encoding{&vnc.RawEncoding{}},
+		Encodings:       []vnc.Encoding{&vnc.ZRLEEncoding{}, &vnc.TightEncoding{}, &vnc.HextileEncoding{}, &vnc.RawEncoding{}},
 		PixelFormat:     vnc.PixelFormat32bit,
 		ClientMessageCh: chServer,
 		ServerMessageCh: chClient,
 		Messages:        vnc.DefaultClientMessages,
+		Source:          source,
 	}
 	cfg.Handlers = vnc.DefaultServerHandlers
 	go vnc.Serve(context.Background(), ln, cfg)
@@ -45,7 +49,9 @@ func main() {
 	for {
 		select {
 		case <-tick.C:
-			drawImage(im, 0)
+			anim++
+			drawImage(im, anim)
+			source.Invalidate()
 			fmt.Printf("tick\n")
 		case msg := <-chClient:
 			switch msg.Type() {
@@ -2,6 +2,7 @@ package vnc2video
 
 import (
 	"encoding/binary"
+	"fmt"
 	"net"
 	"github.com/amitbet/vnc2video/logger"
 
@@ -106,6 +107,13 @@ type FBSPlayHelper struct {
 	serverMessageMap map[uint8]ServerMessage
 	firstSegDone     bool
 	startTime        int
+	speedFactor      float64
+
+	// seeking state, set up by EnableSeeking
+	canvas           *VncCanvas
+	index            []FbsIndexEntry
+	keyframes        []*fbsKeyframe
+	keyframeInterval time.Duration
 }
 
 func NewFbsConn(filename string, encs []Encoding) (*FbsConn, error) {
@@ -133,7 +141,7 @@ func NewFbsConn(filename string, encs []Encoding) (*FbsConn, error) {
 }
 
 func NewFBSPlayHelper(r *FbsConn) *FBSPlayHelper {
-	h := &FBSPlayHelper{Conn: r}
+	h := &FBSPlayHelper{Conn: r, speedFactor: 1}
 	h.startTime = int(time.Now().UnixNano() / int64(time.Millisecond))
 
 	h.serverMessageMap = make(map[uint8]ServerMessage)
@@ -141,6 +149,9 @@ func NewFBSPlayHelper(r *FbsConn) *FBSPlayHelper {
 	h.serverMessageMap[1] = &SetColorMapEntries{}
 	h.serverMessageMap[2] = &Bell{}
 	h.serverMessageMap[3] = &ServerCutText{}
+	h.serverMessageMap[uint8(EndOfContinuousUpdatesMsgType)] = &EndOfContinuousUpdates{}
+	h.serverMessageMap[uint8(ServerFenceMsgType)] = &ServerFence{}
+	h.serverMessageMap[uint8(ServerXvpMsgType)] = &ServerXvp{}
 
 	return h
 }
@@ -166,6 +177,30 @@ func NewFBSPlayHelper(r *FbsConn) *FBSPlayHelper {
 // }
 
 func (h *FBSPlayHelper) ReadFbsMessage(SyncWithTimestamps bool, SpeedFactor float64) (ServerMessage, error) {
+	fbs := h.Conn
+	startTimeMsgHandling := time.Now()
+	h.speedFactor = SpeedFactor
+	parsedMsg, err := h.readMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	millisSinceStart := int(startTimeMsgHandling.UnixNano()/int64(time.Millisecond)) - h.startTime
+	adjestedTimeStamp := float64(fbs.CurrentTimestamp()) / SpeedFactor
+	millisToSleep := adjestedTimeStamp - float64(millisSinceStart)
+
+	if millisToSleep > 0 && SyncWithTimestamps {
+
+		time.Sleep(time.Duration(millisToSleep) * time.Millisecond)
+	} else if millisToSleep < -400 {
+		logger.Errorf("rendering time is noticeably off, change speedup factor: videoTimeLine: %f, currentTime:%d, offset: %f", adjestedTimeStamp, millisSinceStart, millisToSleep)
+	}
+
+	return parsedMsg, nil
+}
+
+// readMessage reads and renders the next server message, adding a keyframe when one is due
+func (h *FBSPlayHelper) readMessage() (ServerMessage, error) {
 	var messageType uint8
 	//messages := make(map[uint8]ServerMessage)
 	fbs := h.Conn
@@ -175,13 +210,12 @@ func (h *FBSPlayHelper) ReadFbsMessage(SyncWithTimestamps bool, SpeedFactor floa
 		logger.Error("FBSConn.NewConnHandler: Error in reading FBS: ", err)
 		return nil, err
 	}
-	startTimeMsgHandling := time.Now()
 	//IClientConn{}
 	//binary.Write(h.Conn, binary.BigEndian, messageType)
 	msg := h.serverMessageMap[messageType]
 	if msg == nil {
 		logger.Error("FBSConn.NewConnHandler: Error unknown message type: ", messageType)
-		return nil, err
+		return nil, fmt.Errorf("unknown message-type: %v", messageType)
 	}
 	//read the actual message data
 	//err = binary.Read(fbs, binary.BigEndian, &msg)
@@ -191,16 +225,10 @@ func (h *FBSPlayHelper) ReadFbsMessage(SyncWithTimestamps bool, SpeedFactor floa
 		return nil, err
 	}
 
-	millisSinceStart := int(startTimeMsgHandling.UnixNano()/int64(time.Millisecond)) - h.startTime
-	adjestedTimeStamp := float64(fbs.CurrentTimestamp()) / SpeedFactor
-	millisToSleep := adjestedTimeStamp - float64(millisSinceStart)
-
-	if millisToSleep > 0 && SyncWithTimestamps {
-
-		time.Sleep(time.Duration(millisToSleep) * time.Millisecond)
-	} else if millisToSleep < -400 {
-		logger.Errorf("rendering time is noticeably off, change speedup factor: videoTimeLine: %f, currentTime:%d, offset: %f", adjestedTimeStamp, millisSinceStart, millisToSleep)
+	if h.keyframeDue() {
+		if err := h.addKeyframe(); err != nil {
+			return nil, err
+		}
 	}
-
 	return parsedMsg, nil
 }
@@ -3,6 +3,7 @@ package vnc2video
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
 	"os"
 	//"vncproxy/common"
@@ -188,3 +189,85 @@ type FbsSegment struct {
 	bytes     []byte
 	timestamp uint32
 }
+
+// FbsIndexEntry is the file offset and timestamp of an fbs segment
+type FbsIndexEntry struct {
+	Offset    int64
+	Timestamp uint32
+}
+
+// ReadIndex lists the segments from the current position to the end of the file by skipping over
+// their data, the read position is left unchanged. A truncated last segment is left out.
+func (fbs *FbsReader) ReadIndex() ([]FbsIndexEntry, error) {
+	seeker, ok := fbs.reader.(io.Seeker)
+	if !ok {
+		return nil, errors.New("FbsReader.ReadIndex: fbs stream is not seekable")
+	}
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	defer seeker.Seek(start, io.SeekStart)
+
+	var index []FbsIndexEntry
+	offset := start
+	for {
+		var bytesLen uint32
+		if err := binary.Read(fbs.reader, binary.BigEndian, &bytesLen); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return index, nil
+			}
+			logger.Error("FbsReader.ReadIndex: reading len, error reading rbs file: ", err)
+			return nil, err
+		}
+		paddedSize := int64((bytesLen + 3) & 0x7FFFFFFC)
+		if _, err := seeker.Seek(offset+4+paddedSize, io.SeekStart); err != nil {
+			return nil, err
+		}
+		var timeSinceStart uint32
+		if err := binary.Read(fbs.reader, binary.BigEndian, &timeSinceStart); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return index, nil
+			}
+			logger.Error("FbsReader.ReadIndex: read timestamp, error reading rbs file: ", err)
+			return nil, err
+		}
+		index = append(index, FbsIndexEntry{Offset: offset, Timestamp: timeSinceStart})
+		offset += 4 + paddedSize + 4
+	}
+}
+
+// fbsPosition is a read position: the file offset of the next segment and the segment bytes
+// read from the file but not consumed yet
+type fbsPosition struct {
+	offset    int64
+	buffered  []byte
+	timestamp int
+}
+
+func (fbs *FbsReader) position() (*fbsPosition, error) {
+	seeker, ok := fbs.reader.(io.Seeker)
+	if !ok {
+		return nil, errors.New("FbsReader: fbs stream is not seekable")
+	}
+	offset, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	buffered := append([]byte{}, fbs.buffer.Bytes()...)
+	return &fbsPosition{offset: offset, buffered: buffered, timestamp: fbs.currentTimestamp}, nil
+}
+
+func (fbs *FbsReader) setPosition(pos *fbsPosition) error {
+	seeker, ok := fbs.reader.(io.Seeker)
+	if !ok {
+		return errors.New("FbsReader: fbs stream is not seekable")
+	}
+	if _, err := seeker.Seek(pos.offset, io.SeekStart); err != nil {
+		return err
+	}
+	fbs.buffer.Reset()
+	fbs.buffer.Write(pos.buffered)
+	fbs.currentTimestamp = pos.timestamp
+	return nil
+}
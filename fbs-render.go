@@ -0,0 +1,83 @@
+package vnc2video
+
+import (
+	"errors"
+	"image"
+	"time"
+
+	"github.com/amitbet/vnc2video/logger"
+)
+
+// FrameEncoder receives the rendered frames, the video encoders in the encoders package implement it
+type FrameEncoder interface {
+	Encode(image.Image)
+}
+
+// TimedFrameEncoder is a FrameEncoder writing frame timestamps (the time since the start of
+// the video), each frame lasts until the next one
+type TimedFrameEncoder interface {
+	FrameEncoder
+	EncodeAt(image.Image, time.Duration)
+}
+
+// RenderFrames renders the rest of the recording as fast as possible, encoding the canvas
+// once every 1/framerate seconds of recording time. The clock only advances with the
+// segment timestamps, so each frame shows exactly the messages recorded before its time.
+// A TimedFrameEncoder only gets the frames following a framebuffer update, and the final one.
+func (h *FBSPlayHelper) RenderFrames(canvas *VncCanvas, framerate int, enc FrameEncoder) error {
+	if framerate <= 0 {
+		return errors.New("FBSPlayHelper.RenderFrames: framerate must be positive")
+	}
+	if h.index == nil {
+		index, err := h.Conn.ReadIndex()
+		if err != nil {
+			return err
+		}
+		h.index = index
+	}
+
+	// frame times are computed from the frame number so they don't drift
+	frameTime := func(frame int) int {
+		return int(int64(frame) * 1000 / int64(framerate))
+	}
+	// the first frame is the first one not before the messages already rendered
+	first := int((int64(h.Conn.CurrentTimestamp())*int64(framerate) + 999) / 1000)
+	timedEnc, timed := enc.(TimedFrameEncoder)
+	encoded := 0
+	changed := true
+	encode := func(frame int, last bool) {
+		switch {
+		case !timed:
+			enc.Encode(canvas.Image)
+		case changed || last:
+			timedEnc.EncodeAt(canvas.Image, time.Duration(frameTime(frame)-frameTime(first))*time.Millisecond)
+		default:
+			return
+		}
+		changed = false
+		encoded++
+	}
+
+	frame := first
+	for {
+		next, ok := h.nextMessageTimestamp()
+		if !ok {
+			break
+		}
+		for ; frameTime(frame) < next; frame++ {
+			encode(frame, false)
+		}
+		msg, err := h.readMessage()
+		if err != nil {
+			return err
+		}
+		if _, ok := msg.(*FramebufferUpdate); ok {
+			changed = true
+		}
+	}
+	// the final frame shows the end of the recording
+	encode(frame, true)
+	frame++
+	logger.Debugf("FBSPlayHelper.RenderFrames: encoded %d frames, up to %s", encoded, time.Duration(frameTime(frame))*time.Millisecond)
+	return nil
+}
@@ -0,0 +1,107 @@
+package vnc2video
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// frameCounter records which test frame each encoded image shows
+type frameCounter struct {
+	t        *testing.T
+	expected []*image.RGBA
+	frames   []int
+}
+
+func (c *frameCounter) Encode(img image.Image) {
+	sameRGB := func(a, b color.RGBA) bool { return a.R == b.R && a.G == b.G && a.B == b.B }
+	for i := len(c.expected) - 1; i >= 0; i-- {
+		if sameRGB(rgbaAt(img, i*9, i*5), rgbaAt(c.expected[i], i*9, i*5)) && sameRGB(rgbaAt(img, 99, 65), rgbaAt(c.expected[i], 99, 65)) {
+			c.frames = append(c.frames, i)
+			return
+		}
+	}
+	c.t.Fatalf("encoded image matches no recorded frame")
+}
+
+func TestFBSPlayHelperRenderFrames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fbs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fbsFile := filepath.Join(dir, "session.fbs")
+	expected := writeTestRecording(t, fbsFile, 4)
+
+	canvas := NewVncCanvas(100, 70)
+	encs := []Encoding{&ZRLEEncoding{Image: canvas}, &ZLibEncoding{Image: canvas}, &TightEncoding{Image: canvas}}
+	conn, err := NewFbsConn(fbsFile, encs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// messages are recorded every second, at 2 frames per second each one shows in 2 frames
+	// and the last one, at the end of the recording, in the final frame
+	counter := &frameCounter{t: t, expected: expected}
+	if err := NewFBSPlayHelper(conn).RenderFrames(canvas, 2, counter); err != nil {
+		t.Fatal(err)
+	}
+	want := []int{0, 0, 1, 1, 2, 2, 3}
+	if len(counter.frames) != len(want) {
+		t.Fatalf("got frames %v, want %v", counter.frames, want)
+	}
+	for i := range want {
+		if counter.frames[i] != want[i] {
+			t.Fatalf("got frames %v, want %v", counter.frames, want)
+		}
+	}
+}
+
+// timedFrameCounter also records the frame timestamps
+type timedFrameCounter struct {
+	frameCounter
+	pts []time.Duration
+}
+
+func (c *timedFrameCounter) EncodeAt(img image.Image, pts time.Duration) {
+	c.Encode(img)
+	c.pts = append(c.pts, pts)
+}
+
+func TestFBSPlayHelperRenderTimedFrames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fbs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fbsFile := filepath.Join(dir, "session.fbs")
+	expected := writeTestRecording(t, fbsFile, 4)
+
+	canvas := NewVncCanvas(100, 70)
+	encs := []Encoding{&ZRLEEncoding{Image: canvas}, &ZLibEncoding{Image: canvas}, &TightEncoding{Image: canvas}}
+	conn, err := NewFbsConn(fbsFile, encs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// unchanged frames are skipped, each update is encoded once at the first frame showing it
+	counter := &timedFrameCounter{frameCounter: frameCounter{t: t, expected: expected}}
+	if err := NewFBSPlayHelper(conn).RenderFrames(canvas, 2, counter); err != nil {
+		t.Fatal(err)
+	}
+	want := []time.Duration{0, time.Second, 2 * time.Second, 3 * time.Second}
+	if len(counter.pts) != len(want) {
+		t.Fatalf("got frames %v at %v, want %v", counter.frames, counter.pts, want)
+	}
+	for i := range want {
+		if counter.frames[i] != i || counter.pts[i] != want[i] {
+			t.Fatalf("got frames %v at %v, want %v", counter.frames, counter.pts, want)
+		}
+	}
+}
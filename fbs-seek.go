@@ -0,0 +1,221 @@
+package vnc2video
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/amitbet/vnc2video/logger"
+)
+
+// DefaultKeyframeInterval is the recording time between two keyframes
+const DefaultKeyframeInterval = 30 * time.Second
+
+// fbsKeyframe is everything needed to resume rendering a recording between two messages:
+// the read position, the connection and decoder stream state and the canvas content
+type fbsKeyframe struct {
+	timestamp   int
+	position    *fbsPosition
+	pixelFormat PixelFormat
+	width       uint16
+	height      uint16
+	streams     map[EncodingType]interface{}
+	// zlib compressed canvas pixels
+	pixels []byte
+	// the canvas cursor fields, the cursor images are replaced rather than changed
+	cursor VncCanvas
+}
+
+// EnableSeeking indexes the recording and starts keeping keyframes of the canvas the encodings
+// draw on, one every interval of recording time (DefaultKeyframeInterval when zero). Keyframes
+// are added as messages are read, the first one at the current position.
+func (h *FBSPlayHelper) EnableSeeking(canvas *VncCanvas, interval time.Duration) error {
+	if _, err := canvasPixels(canvas); err != nil {
+		return err
+	}
+	index, err := h.Conn.ReadIndex()
+	if err != nil {
+		return err
+	}
+	if interval <= 0 {
+		interval = DefaultKeyframeInterval
+	}
+	h.canvas = canvas
+	h.index = index
+	h.keyframes = nil
+	h.keyframeInterval = interval
+	return h.addKeyframe()
+}
+
+// Duration returns the recording length, EnableSeeking must be called first
+func (h *FBSPlayHelper) Duration() time.Duration {
+	if len(h.index) == 0 {
+		return 0
+	}
+	return time.Duration(h.index[len(h.index)-1].Timestamp) * time.Millisecond
+}
+
+// SeekTo renders the recording up to the given time, starting from the closest keyframe before it.
+// Times past the last keyframe are reached by rendering forward, adding keyframes on the way,
+// so the first seek to the end of a long recording decodes it once.
+func (h *FBSPlayHelper) SeekTo(t time.Duration) error {
+	if h.canvas == nil {
+		return errors.New("FBSPlayHelper.SeekTo: seeking is not enabled")
+	}
+	target := int(t / time.Millisecond)
+	i := sort.Search(len(h.keyframes), func(i int) bool { return h.keyframes[i].timestamp > target })
+	if i > 0 {
+		i--
+	}
+	keyframe := h.keyframes[i]
+
+	// keep rendering from the current position when it is between the keyframe and the target
+	current := h.Conn.CurrentTimestamp()
+	if current < keyframe.timestamp || current > target {
+		logger.Debugf("FBSPlayHelper.SeekTo: restoring keyframe at %dms for %dms", keyframe.timestamp, target)
+		if err := h.restoreKeyframe(keyframe); err != nil {
+			return err
+		}
+	}
+
+	for {
+		next, ok := h.nextMessageTimestamp()
+		if !ok || next > target {
+			break
+		}
+		if _, err := h.readMessage(); err != nil {
+			return err
+		}
+	}
+
+	// playback with timestamp sync continues from the seek target
+	speedFactor := h.speedFactor
+	if speedFactor <= 0 {
+		speedFactor = 1
+	}
+	h.startTime = int(time.Now().UnixNano()/int64(time.Millisecond)) - int(float64(target)/speedFactor)
+	return nil
+}
+
+// nextMessageTimestamp returns the timestamp of the segment the next message starts in
+func (h *FBSPlayHelper) nextMessageTimestamp() (int, bool) {
+	fbs := h.Conn
+	if fbs.buffer.Len() > 0 {
+		return fbs.CurrentTimestamp(), true
+	}
+	pos, err := fbs.position()
+	if err != nil {
+		return 0, false
+	}
+	i := sort.Search(len(h.index), func(i int) bool { return h.index[i].Offset >= pos.offset })
+	if i == len(h.index) {
+		return 0, false
+	}
+	return int(h.index[i].Timestamp), true
+}
+
+func (h *FBSPlayHelper) keyframeDue() bool {
+	if h.canvas == nil || len(h.keyframes) == 0 {
+		return false
+	}
+	last := h.keyframes[len(h.keyframes)-1]
+	return h.Conn.CurrentTimestamp() >= last.timestamp+int(h.keyframeInterval/time.Millisecond)
+}
+
+func (h *FBSPlayHelper) addKeyframe() error {
+	fbs := h.Conn
+	pos, err := fbs.position()
+	if err != nil {
+		return err
+	}
+	pix, err := canvasPixels(h.canvas)
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	zipper, err := zlib.NewWriterLevel(buf, zlib.BestSpeed)
+	if err != nil {
+		return err
+	}
+	if _, err := zipper.Write(pix); err != nil {
+		return err
+	}
+	if err := zipper.Close(); err != nil {
+		return err
+	}
+
+	keyframe := &fbsKeyframe{
+		timestamp:   fbs.CurrentTimestamp(),
+		position:    pos,
+		pixelFormat: fbs.PixelFormat(),
+		width:       fbs.Width(),
+		height:      fbs.Height(),
+		streams:     make(map[EncodingType]interface{}),
+		pixels:      buf.Bytes(),
+		cursor:      *h.canvas,
+	}
+	for _, enc := range fbs.Encodings() {
+		if senc, ok := enc.(streamEncoding); ok {
+			keyframe.streams[enc.Type()] = senc.streamState()
+		}
+	}
+	logger.Debugf("FBSPlayHelper: added keyframe at %dms, %d compressed bytes", keyframe.timestamp, len(keyframe.pixels))
+	h.keyframes = append(h.keyframes, keyframe)
+	return nil
+}
+
+func (h *FBSPlayHelper) restoreKeyframe(keyframe *fbsKeyframe) error {
+	fbs := h.Conn
+	// the desktop may have been resized since the keyframe
+	h.canvas.Resize(int(keyframe.width), int(keyframe.height))
+	pix, err := canvasPixels(h.canvas)
+	if err != nil {
+		return err
+	}
+	unzipper, err := zlib.NewReader(bytes.NewReader(keyframe.pixels))
+	if err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(unzipper, pix); err != nil {
+		return fmt.Errorf("FBSPlayHelper: keyframe doesn't match the canvas: %v", err)
+	}
+	if err := fbs.setPosition(keyframe.position); err != nil {
+		return err
+	}
+
+	fbs.SetPixelFormat(keyframe.pixelFormat)
+	fbs.SetWidth(keyframe.width)
+	fbs.SetHeight(keyframe.height)
+	for _, enc := range fbs.Encodings() {
+		if senc, ok := enc.(streamEncoding); ok {
+			if state, ok := keyframe.streams[enc.Type()]; ok {
+				senc.restoreStreamState(state)
+			} else {
+				enc.Reset()
+			}
+		}
+	}
+	h.canvas.Cursor = keyframe.cursor.Cursor
+	h.canvas.CursorMask = keyframe.cursor.CursorMask
+	h.canvas.CursorBackup = keyframe.cursor.CursorBackup
+	h.canvas.CursorOffset = keyframe.cursor.CursorOffset
+	h.canvas.CursorLocation = keyframe.cursor.CursorLocation
+	h.canvas.SetChanged(&Rectangle{Width: keyframe.width, Height: keyframe.height})
+	return nil
+}
+
+// canvasPixels returns the pixel buffer backing the canvas image
+func canvasPixels(canvas *VncCanvas) ([]byte, error) {
+	switch img := canvas.Image.(type) {
+	case *RGBImage:
+		return img.Pix, nil
+	case *image.RGBA:
+		return img.Pix, nil
+	}
+	return nil, fmt.Errorf("keyframes can't snapshot a %T canvas image", canvas.Image)
+}
@@ -0,0 +1,104 @@
+package vnc2video
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestRecording records frames of a changing image, one per second, encoded as ZRLE,
+// ZLib and Tight rects so every zlib stream decoder carries state from frame to frame.
+func writeTestRecording(t *testing.T, fbsFile string, frames int) []*image.RGBA {
+	fbs, err := NewFbsWriter(fbsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fbs.Close()
+	if err := fbs.WriteStartSession(&ServerInit{FBWidth: 100, FBHeight: 70, PixelFormat: PixelFormat32bit}); err != nil {
+		t.Fatal(err)
+	}
+
+	src := testSourceImage(100, 70)
+	conn := &bufferConn{pf: PixelFormat32bit}
+	encs := []Encoding{&ZRLEEncoding{Image: src}, &ZLibEncoding{Image: src}, &TightEncoding{Image: src}}
+	var expected []*image.RGBA
+	for i := 0; i < frames; i++ {
+		box := image.Rect(i*9, i*5, i*9+20, i*5+15)
+		FillRect(src, &box, color.RGBA{R: uint8(i * 25), G: 255 - uint8(i*25), B: 128, A: 255})
+		for x := 0; x < 100; x++ {
+			src.Set(x, 65, color.RGBA{R: uint8(x * i), G: uint8(i), B: uint8(x), A: 255})
+		}
+		snapshot := image.NewRGBA(src.Bounds())
+		copy(snapshot.Pix, src.Pix)
+		expected = append(expected, snapshot)
+
+		update := &FramebufferUpdate{NumRect: uint16(len(encs))}
+		for _, enc := range encs {
+			update.Rects = append(update.Rects, &Rectangle{Width: 100, Height: 70, EncType: enc.Type(), Enc: enc})
+		}
+		if err := update.Write(conn); err != nil {
+			t.Fatal(err)
+		}
+		if err := fbs.writeSegment(&FbsSegment{bytes: conn.Next(conn.Len()), timestamp: uint32(i * 1000)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return expected
+}
+
+func checkFrame(t *testing.T, canvas *VncCanvas, want *image.RGBA, frame int) {
+	for y := 0; y < 70; y++ {
+		for x := 0; x < 100; x++ {
+			w, g := rgbaAt(want, x, y), rgbaAt(canvas, x, y)
+			if w.R != g.R || w.G != g.G || w.B != g.B {
+				t.Fatalf("frame %d pixel %d,%d: got %v, want %v", frame, x, y, g, w)
+			}
+		}
+	}
+}
+
+func TestFBSPlayHelperSeekTo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fbs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fbsFile := filepath.Join(dir, "session.fbs")
+	expected := writeTestRecording(t, fbsFile, 10)
+
+	canvas := NewVncCanvas(100, 70)
+	encs := []Encoding{&ZRLEEncoding{Image: canvas}, &ZLibEncoding{Image: canvas}, &TightEncoding{Image: canvas}}
+	conn, err := NewFbsConn(fbsFile, encs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	player := NewFBSPlayHelper(conn)
+	if err := player.EnableSeeking(canvas, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if player.Duration() != 9*time.Second {
+		t.Fatalf("got duration %v", player.Duration())
+	}
+
+	// jumping ahead renders forward and leaves keyframes behind
+	if err := player.SeekTo(7500 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	checkFrame(t, canvas, expected[7], 7)
+	if len(player.keyframes) != 4 {
+		t.Fatalf("got %d keyframes, want 4", len(player.keyframes))
+	}
+
+	// going back resumes the zlib streams from the keyframe at 4s
+	for _, frame := range []int{5, 1, 9, 4, 6} {
+		if err := player.SeekTo(time.Duration(frame) * time.Second); err != nil {
+			t.Fatal(err)
+		}
+		checkFrame(t, canvas, expected[frame], frame)
+	}
+}
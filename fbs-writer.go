@@ -0,0 +1,171 @@
+package vnc2video
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/amitbet/vnc2video/logger"
+)
+
+const (
+	fbsFileVersion = "FBS 001.000\n"
+	fbsRfbVersion  = "RFB 003.008\n"
+)
+
+// FbsWriter records server to client bytes as FBS 001.000 segments, the format read by FbsReader
+type FbsWriter struct {
+	writer    io.WriteCloser
+	mu        sync.Mutex
+	startTime time.Time
+	started   bool
+}
+
+// NewFbsWriter creates an fbs file, the session starts with WriteStartSession
+func NewFbsWriter(fbsFile string) (*FbsWriter, error) {
+	writer, err := os.OpenFile(fbsFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		logger.Error("NewFbsWriter: can't create fbs file: ", fbsFile)
+		return nil, err
+	}
+	return &FbsWriter{writer: writer}, nil
+}
+
+func (fbs *FbsWriter) Close() error {
+	return fbs.writer.Close()
+}
+
+// WriteStartSession writes the fbs header and a first segment holding the rfb version,
+// the None security type and the ServerInit message, as expected by FbsReader.ReadStartSession
+func (fbs *FbsWriter) WriteStartSession(initMsg *ServerInit) error {
+	fbs.mu.Lock()
+	defer fbs.mu.Unlock()
+	if fbs.started {
+		return errors.New("FbsWriter.WriteStartSession: session already started")
+	}
+	if _, err := io.WriteString(fbs.writer, fbsFileVersion); err != nil {
+		logger.Error("FbsWriter.WriteStartSession: error writing fbs file version: ", err)
+		return err
+	}
+
+	initMsg.NameLength = uint32(len(initMsg.NameText))
+	buf := &bytes.Buffer{}
+	buf.WriteString(fbsRfbVersion)
+	header := []interface{}{
+		uint32(SecTypeNone),
+		initMsg.FBWidth,
+		initMsg.FBHeight,
+		initMsg.PixelFormat,
+		initMsg.NameLength,
+		initMsg.NameText,
+	}
+	for _, field := range header {
+		if err := binary.Write(buf, binary.BigEndian, field); err != nil {
+			return err
+		}
+	}
+
+	fbs.startTime = time.Now()
+	fbs.started = true
+	return fbs.writeSegment(&FbsSegment{bytes: buf.Bytes()})
+}
+
+// Write records p as one segment, timestamped with the time elapsed since the session start
+func (fbs *FbsWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	fbs.mu.Lock()
+	defer fbs.mu.Unlock()
+	if !fbs.started {
+		return 0, errors.New("FbsWriter.Write: session not started")
+	}
+	millisSinceStart := time.Since(fbs.startTime) / time.Millisecond
+	if err := fbs.writeSegment(&FbsSegment{bytes: p, timestamp: uint32(millisSinceStart)}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (fbs *FbsWriter) writeSegment(seg *FbsSegment) error {
+	paddedSize := (len(seg.bytes) + 3) &^ 3
+	buf := make([]byte, 4+paddedSize+4)
+	binary.BigEndian.PutUint32(buf, uint32(len(seg.bytes)))
+	copy(buf[4:], seg.bytes)
+	binary.BigEndian.PutUint32(buf[4+paddedSize:], seg.timestamp)
+	if _, err := fbs.writer.Write(buf); err != nil {
+		logger.Error("FbsWriter.writeSegment: error writing fbs file: ", err)
+		return err
+	}
+	return nil
+}
+
+// FbsRecordHandler records a client session, it must run after DefaultClientServerInitHandler
+// and before DefaultClientMessageHandler so every server message goes to the recording
+type FbsRecordHandler struct {
+	Writer *FbsWriter
+}
+
+// Handle starts the recording session and tees the connection's reads into the fbs writer
+func (h *FbsRecordHandler) Handle(c Conn) error {
+	cc, ok := c.(*ClientConn)
+	if !ok {
+		return errors.New("FbsRecordHandler: fbs recording needs a *ClientConn")
+	}
+	initMsg := &ServerInit{
+		FBWidth:     cc.Width(),
+		FBHeight:    cc.Height(),
+		PixelFormat: cc.PixelFormat(),
+		NameText:    cc.DesktopName(),
+	}
+	if err := h.Writer.WriteStartSession(initMsg); err != nil {
+		return err
+	}
+	// bytes already buffered by br are recorded when they are consumed
+	cc.br = bufio.NewReader(io.TeeReader(cc.br, h.Writer))
+	return nil
+}
+
+// FbsRecordingConn is a net.Conn recording the bytes read from it once StartRecording was called,
+// proxies use it on the server side connection after relaying the handshake.
+type FbsRecordingConn struct {
+	net.Conn
+	fbs       *FbsWriter
+	mu        sync.Mutex
+	recording bool
+}
+
+// NewFbsRecordingConn returns a net.Conn recording the reads from c into fbs
+func NewFbsRecordingConn(c net.Conn, fbs *FbsWriter) *FbsRecordingConn {
+	return &FbsRecordingConn{Conn: c, fbs: fbs}
+}
+
+// StartRecording writes the session start, all bytes read afterwards are recorded
+func (c *FbsRecordingConn) StartRecording(initMsg *ServerInit) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.fbs.WriteStartSession(initMsg); err != nil {
+		return err
+	}
+	c.recording = true
+	return nil
+}
+
+func (c *FbsRecordingConn) Read(buf []byte) (int, error) {
+	n, err := c.Conn.Read(buf)
+	c.mu.Lock()
+	recording := c.recording
+	c.mu.Unlock()
+	if recording && n > 0 {
+		if _, werr := c.fbs.Write(buf[:n]); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,127 @@
+package vnc2video
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFbsWriterRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fbs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fbsFile := filepath.Join(dir, "session.fbs")
+
+	// the recorded session is a raw update of the test image
+	src := testSourceImage(100, 70)
+	update := &bufferConn{pf: PixelFormat32bit}
+	rect := &Rectangle{Width: 100, Height: 70, EncType: EncRaw, Enc: &RawEncoding{Image: src}}
+	if err := (&FramebufferUpdate{NumRect: 1, Rects: []*Rectangle{rect}}).Write(update); err != nil {
+		t.Fatal(err)
+	}
+
+	fbs, err := NewFbsWriter(fbsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	initMsg := &ServerInit{FBWidth: 100, FBHeight: 70, PixelFormat: PixelFormat32bit, NameText: []byte("recorded desktop")}
+	if err := fbs.WriteStartSession(initMsg); err != nil {
+		t.Fatal(err)
+	}
+	// split the message over segments of odd sizes to exercise the padding
+	data := update.Bytes()
+	for len(data) > 0 {
+		n := Min(len(data), 4093)
+		if _, err := fbs.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	if err := fbs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := NewRGBImage(src.Bounds())
+	conn, err := NewFbsConn(fbsFile, []Encoding{&RawEncoding{Image: dst}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.Width() != 100 || conn.Height() != 70 || string(conn.DesktopName()) != "recorded desktop" || conn.PixelFormat() != PixelFormat32bit {
+		t.Fatalf("unexpected session start: %dx%d %q %v", conn.Width(), conn.Height(), conn.DesktopName(), conn.PixelFormat())
+	}
+	msg, err := NewFBSPlayHelper(conn).ReadFbsMessage(false, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.(*FramebufferUpdate).NumRect != 1 {
+		t.Fatalf("got %v", msg)
+	}
+	for _, p := range [][2]int{{0, 0}, {10, 10}, {35, 40}, {99, 55}} {
+		want, got := rgbaAt(src, p[0], p[1]), rgbaAt(dst, p[0], p[1])
+		if want.R != got.R || want.G != got.G || want.B != got.B {
+			t.Fatalf("pixel %v: got %v, want %v", p, got, want)
+		}
+	}
+}
+
+func TestFbsRecordHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fbs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fbsFile := filepath.Join(dir, "session.fbs")
+	fbs, err := NewFbsWriter(fbsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, client := net.Pipe()
+	defer server.Close()
+	cc, err := NewClientConn(client, &ClientConfig{Encodings: []Encoding{&RawEncoding{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	cc.SetWidth(640)
+	cc.SetHeight(480)
+	cc.SetPixelFormat(PixelFormat32bit)
+	cc.SetDesktopName([]byte("desk"))
+	if err := (&FbsRecordHandler{Writer: fbs}).Handle(cc); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := []byte("server to client bytes")
+	go server.Write(sent)
+	got := make([]byte, len(sent))
+	if _, err := io.ReadFull(cc, got); err != nil {
+		t.Fatal(err)
+	}
+	fbs.Close()
+
+	reader, err := NewFbsReader(fbsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	initMsg, err := reader.ReadStartSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if initMsg.FBWidth != 640 || initMsg.FBHeight != 480 || string(initMsg.NameText) != "desk" {
+		t.Fatalf("unexpected session start %v", initMsg)
+	}
+	recorded := make([]byte, len(sent))
+	if _, err := io.ReadFull(reader, recorded); err != nil {
+		t.Fatal(err)
+	}
+	if string(recorded) != string(sent) {
+		t.Fatalf("recorded %q, want %q", recorded, sent)
+	}
+}
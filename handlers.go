@@ -60,18 +60,22 @@ func (*DefaultClientVersionHandler) Handle(c Conn) error {
 		return err
 	}
 
+	// the client answers with the version it speaks, the unknown 3.x versions below 3.7 are
+	// handled as 3.3
 	pv := ProtoVersionUnknown
 	if major == 3 {
 		if minor >= 8 {
 			pv = ProtoVersion38
+		} else if minor == 7 {
+			pv = ProtoVersion37
 		} else if minor >= 3 {
-			pv = ProtoVersion38
+			pv = ProtoVersion33
 		}
 	}
 	if pv == ProtoVersionUnknown {
 		return fmt.Errorf("ProtocolVersion handshake failed; unsupported version '%v'", string(version[:]))
 	}
-	c.SetProtoVersion(string(version[:]))
+	c.SetProtoVersion(pv)
 
 	if err := binary.Write(c, binary.BigEndian, []byte(pv)); err != nil {
 		return err
@@ -118,33 +122,64 @@ func (*DefaultServerVersionHandler) Handle(c Conn) error {
 // DefaultClientSecurityHandler used for client security handler
 type DefaultClientSecurityHandler struct{}
 
-// Handle provide client side security handler
+// Handle provide client side security handler. With 3.3 the server decides the security type,
+// with 3.7 and 3.8 the client picks the first of its handlers the server offers. Only 3.8
+// servers send the SecurityResult of the None type and a reason with failures.
 func (*DefaultClientSecurityHandler) Handle(c Conn) error {
 	cfg := c.Config().(*ClientConfig)
-	var numSecurityTypes uint8
-	if err := binary.Read(c, binary.BigEndian, &numSecurityTypes); err != nil {
-		return err
-	}
-	secTypes := make([]SecurityType, numSecurityTypes)
-	if err := binary.Read(c, binary.BigEndian, &secTypes); err != nil {
-		return err
-	}
+	// the security handler may change the protocol, as ATEN does
+	proto := c.Protocol()
 
 	var secType SecurityHandler
-	for _, st := range cfg.SecurityHandlers {
-		for _, sc := range secTypes {
-			if st.Type() == sc {
-				secType = st
+	if proto == ProtoVersion33 {
+		var st uint32
+		if err := binary.Read(c, binary.BigEndian, &st); err != nil {
+			return err
+		}
+		if st == uint32(SecTypeUnknown) {
+			return readSecurityFailure(c)
+		}
+		for _, sh := range cfg.SecurityHandlers {
+			if uint32(sh.Type()) == st {
+				secType = sh
+				break
 			}
 		}
-	}
+		if secType == nil {
+			return fmt.Errorf("security type %d not supported", st)
+		}
+	} else {
+		var numSecurityTypes uint8
+		if err := binary.Read(c, binary.BigEndian, &numSecurityTypes); err != nil {
+			return err
+		}
+		if numSecurityTypes == 0 {
+			return readSecurityFailure(c)
+		}
+		secTypes := make([]SecurityType, numSecurityTypes)
+		if err := binary.Read(c, binary.BigEndian, &secTypes); err != nil {
+			return err
+		}
 
-	if err := binary.Write(c, binary.BigEndian, cfg.SecurityHandlers[0].Type()); err != nil {
-		return err
-	}
+	handlers:
+		for _, sh := range cfg.SecurityHandlers {
+			for _, st := range secTypes {
+				if sh.Type() == st {
+					secType = sh
+					break handlers
+				}
+			}
+		}
+		if secType == nil {
+			return fmt.Errorf("no supported security type in %v", secTypes)
+		}
 
-	if err := c.Flush(); err != nil {
-		return err
+		if err := binary.Write(c, binary.BigEndian, secType.Type()); err != nil {
+			return err
+		}
+		if err := c.Flush(); err != nil {
+			return err
+		}
 	}
 
 	err := secType.Auth(c)
@@ -153,27 +188,40 @@ func (*DefaultClientSecurityHandler) Handle(c Conn) error {
 		return err
 	}
 
+	if secType.Type() == SecTypeNone && proto != ProtoVersion38 {
+		c.SetSecurityHandler(secType)
+		return nil
+	}
+
 	var authCode uint32
 	if err := binary.Read(c, binary.BigEndian, &authCode); err != nil {
 		return err
 	}
 
 	logger.Tracef("authenticating, secType: %d, auth code(0=success): %d", secType.Type(), authCode)
-	if authCode == 1 {
-		var reasonLength uint32
-		if err := binary.Read(c, binary.BigEndian, &reasonLength); err != nil {
-			return err
-		}
-		reasonText := make([]byte, reasonLength)
-		if err := binary.Read(c, binary.BigEndian, &reasonText); err != nil {
-			return err
+	if authCode != 0 {
+		if proto == ProtoVersion38 {
+			return readSecurityFailure(c)
 		}
-		return fmt.Errorf("%s", reasonText)
+		return fmt.Errorf("security handshake failed")
 	}
 	c.SetSecurityHandler(secType)
 	return nil
 }
 
+// readSecurityFailure returns the reason of a failed security handshake sent by the server
+func readSecurityFailure(c Conn) error {
+	var reasonLength uint32
+	if err := binary.Read(c, binary.BigEndian, &reasonLength); err != nil {
+		return err
+	}
+	reasonText := make([]byte, reasonLength)
+	if err := binary.Read(c, binary.BigEndian, &reasonText); err != nil {
+		return err
+	}
+	return fmt.Errorf("%s", reasonText)
+}
+
 // DefaultServerSecurityHandler used for server security handler
 type DefaultServerSecurityHandler struct{}
 
@@ -287,8 +335,8 @@ func (*DefaultClientServerInitHandler) Handle(c Conn) error {
 		c.SetHeight(600)
 		c.SetPixelFormat(NewPixelFormatAten())
 	} else {
-		c.SetWidth(srvInit.FBWidth)
-		c.SetHeight(srvInit.FBHeight)
+		// a canvas kept across a redirect takes the size of the new server
+		resizeDesktop(c, nil, srvInit.FBWidth, srvInit.FBHeight)
 
 		//telling the server to use 32bit pixels (with 24 dept, tight standard format)
 		pixelMsg := SetPixelFormat{PF: PixelFormat32bit}
@@ -308,43 +356,12 @@ func (*DefaultClientServerInitHandler) Handle(c Conn) error {
 			return err
 		}
 	}
-	/*
-		caps := struct {
-			ServerMessagesNum uint16
-			ClientMessagesNum uint16
-			EncodingsNum      uint16
-			_                 [2]byte
-		}{}
-		if err := binary.Read(c, binary.BigEndian, &caps); err != nil {
+	if tight, ok := c.SecurityHandler().(*ClientAuthTight); ok && tight.tight {
+		// TightVNC servers follow ServerInit with their interaction capabilities
+		if err = readTightInteractionCaps(c); err != nil {
 			return err
 		}
-
-		caps.ServerMessagesNum = uint16(1)
-		var item [16]byte
-		for i := uint16(0); i < caps.ServerMessagesNum; i++ {
-			if err := binary.Read(c, binary.BigEndian, &item); err != nil {
-				return err
-			}
-			fmt.Printf("server message cap %s\n", item)
-		}
-
-			for i := uint16(0); i < caps.ClientMessagesNum; i++ {
-				if err := binary.Read(c, binary.BigEndian, &item); err != nil {
-					return err
-				}
-				fmt.Printf("client message cap %s\n", item)
-			}
-			for i := uint16(0); i < caps.EncodingsNum; i++ {
-				if err := binary.Read(c, binary.BigEndian, &item); err != nil {
-					return err
-				}
-				fmt.Printf("encoding cap %s\n", item)
-			}
-		//	var pad [1]byte
-		//	if err := binary.Read(c, binary.BigEndian, &pad); err != nil {
-		//		return err
-		//	}
-	}*/
+	}
 	return nil
 }
 
@@ -0,0 +1,216 @@
+package vnc2video
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// handshakeStep is written by the test server, then it reads and checks what the client sends
+type handshakeStep struct {
+	write []byte
+	read  []byte
+}
+
+// u32 returns the wire format of the values
+func u32(values ...uint32) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, values)
+	return buf.Bytes()
+}
+
+// serverInitSteps are the init steps following a successful security handshake
+func serverInitSteps() []handshakeStep {
+	serverInit := &bytes.Buffer{}
+	binary.Write(serverInit, binary.BigEndian, []uint16{64, 48})
+	binary.Write(serverInit, binary.BigEndian, PixelFormat32bit)
+	binary.Write(serverInit, binary.BigEndian, uint32(4))
+	serverInit.WriteString("test")
+	pf := &bufferConn{}
+	(&SetPixelFormat{PF: PixelFormat32bit}).Write(pf)
+	return []handshakeStep{
+		{read: []byte{1}},
+		{write: serverInit.Bytes(), read: pf.Bytes()},
+	}
+}
+
+// runHandshake connects a client with the given security handlers to a server following steps
+func runHandshake(t *testing.T, steps []handshakeStep, handlers ...SecurityHandler) (*ClientConn, error) {
+	server, client := net.Pipe()
+	serverErr := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		for i, step := range steps {
+			if len(step.write) > 0 {
+				if _, err := server.Write(step.write); err != nil {
+					serverErr <- err
+					return
+				}
+			}
+			got := make([]byte, len(step.read))
+			if _, err := io.ReadFull(server, got); err != nil {
+				serverErr <- fmt.Errorf("step %d: %v", i, err)
+				return
+			}
+			if !bytes.Equal(got, step.read) {
+				serverErr <- fmt.Errorf("step %d: client sent %q, want %q", i, got, step.read)
+				return
+			}
+		}
+		serverErr <- nil
+	}()
+	cfg := &ClientConfig{SecurityHandlers: handlers, Encodings: []Encoding{&RawEncoding{}}, ErrorCh: make(chan error, 1)}
+	cc, err := Connect(context.Background(), client, cfg)
+	if err != nil {
+		client.Close()
+	}
+	if err := <-serverErr; err != nil {
+		t.Fatal(err)
+	}
+	return cc, err
+}
+
+func TestClientHandshake(t *testing.T) {
+	challenge := []byte("0123456789abcdef")
+	// the challenge is encrypted in place
+	response, _ := AuthVNCEncode([]byte("secret"), append([]byte{}, challenge...))
+	vnc := &ClientAuthVNC{Password: []byte("secret")}
+	none := &ClientAuthNone{}
+
+	for _, test := range []struct {
+		name     string
+		steps    []handshakeStep
+		handlers []SecurityHandler
+		protocol string
+		// err is a part of the handshake error, empty when it succeeds
+		err string
+	}{
+		{"3.3 none", []handshakeStep{
+			{write: []byte(ProtoVersion33), read: []byte(ProtoVersion33)},
+			// no security result follows the None type
+			{write: u32(1)},
+		}, []SecurityHandler{vnc, none}, ProtoVersion33, ""},
+		{"3.3 vnc", []handshakeStep{
+			{write: []byte(ProtoVersion33), read: []byte(ProtoVersion33)},
+			{write: append(u32(2), challenge...), read: response},
+			{write: u32(0)},
+		}, []SecurityHandler{none, vnc}, ProtoVersion33, ""},
+		{"3.3 failure", []handshakeStep{
+			{write: []byte(ProtoVersion33), read: []byte(ProtoVersion33)},
+			{write: append(u32(0, 7), "refused"...)},
+		}, []SecurityHandler{none}, ProtoVersion33, "refused"},
+		{"3.3 unsupported", []handshakeStep{
+			{write: []byte(ProtoVersion33), read: []byte(ProtoVersion33)},
+			{write: u32(2)},
+		}, []SecurityHandler{none}, ProtoVersion33, "security type 2 not supported"},
+		{"3.5 as 3.3", []handshakeStep{
+			{write: []byte("RFB 003.005\n"), read: []byte(ProtoVersion33)},
+			{write: u32(1)},
+		}, []SecurityHandler{none}, ProtoVersion33, ""},
+		{"3.7 none", []handshakeStep{
+			// the type the server offers is picked, and no security result follows it
+			{write: []byte(ProtoVersion37), read: []byte(ProtoVersion37)},
+			{write: []byte{1, 1}, read: []byte{1}},
+		}, []SecurityHandler{vnc, none}, ProtoVersion37, ""},
+		{"3.7 vnc failure", []handshakeStep{
+			{write: []byte(ProtoVersion37), read: []byte(ProtoVersion37)},
+			{write: []byte{2, 1, 2}, read: []byte{2}},
+			{write: challenge, read: response},
+			// 3.7 servers close the connection without a reason
+			{write: u32(1)},
+		}, []SecurityHandler{vnc, none}, ProtoVersion37, "security handshake failed"},
+		{"3.7 no types", []handshakeStep{
+			{write: []byte(ProtoVersion37), read: []byte(ProtoVersion37)},
+			{write: append([]byte{0}, u32(4)...)},
+			{write: []byte("busy")},
+		}, []SecurityHandler{none}, ProtoVersion37, "busy"},
+		{"3.8 none", []handshakeStep{
+			{write: []byte(ProtoVersion38), read: []byte(ProtoVersion38)},
+			{write: []byte{2, 2, 1}, read: []byte{1}},
+			{write: u32(0)},
+		}, []SecurityHandler{none, vnc}, ProtoVersion38, ""},
+		{"3.8 vnc failure", []handshakeStep{
+			{write: []byte(ProtoVersion38), read: []byte(ProtoVersion38)},
+			{write: []byte{1, 2}, read: []byte{2}},
+			{write: challenge, read: response},
+			{write: append(u32(1, 14), "wrong password"...)},
+		}, []SecurityHandler{none, vnc}, ProtoVersion38, "wrong password"},
+		{"3.8 no common type", []handshakeStep{
+			{write: []byte(ProtoVersion38), read: []byte(ProtoVersion38)},
+			{write: []byte{1, 30}},
+		}, []SecurityHandler{none, vnc}, ProtoVersion38, "no supported security type"},
+		{"apple 3.889", []handshakeStep{
+			{write: []byte("RFB 003.889\n"), read: []byte(ProtoVersion38)},
+			{write: []byte{1, 1}, read: []byte{1}},
+			{write: u32(0)},
+		}, []SecurityHandler{none}, ProtoVersion38, ""},
+		{"4.0", []handshakeStep{
+			{write: []byte("RFB 004.000\n")},
+		}, []SecurityHandler{none}, "", "unsupported version"},
+	} {
+		steps := test.steps
+		if test.err == "" {
+			steps = append(steps, serverInitSteps()...)
+		}
+		cc, err := runHandshake(t, steps, test.handlers...)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if cc.Protocol() != test.protocol || cc.Width() != 64 || string(cc.DesktopName()) != "test" {
+			t.Errorf("%s: got protocol %q, %dx%d %q", test.name, cc.Protocol(), cc.Width(), cc.Height(), cc.DesktopName())
+		}
+		cc.Close()
+	}
+}
+
+func TestDefaultClientMessageHandler(t *testing.T) {
+	server, conn := net.Pipe()
+	defer server.Close()
+	cfg := &ClientConfig{
+		Encodings: []Encoding{&RawEncoding{}},
+		ErrorCh:   make(chan error, 1),
+	}
+	client, err := NewClientConn(conn, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetWidth(64)
+	client.SetHeight(48)
+
+	// the first messages are queued for the writing goroutine, the pipe blocks a direct write
+	done := make(chan error)
+	go func() { done <- (&DefaultClientMessageHandler{}).Handle(client) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handle wrote to the conn")
+	}
+
+	want := &bufferConn{}
+	(&SetEncodings{Encodings: []EncodingType{EncRaw, EncLastRectPseudo}}).Write(want)
+	(&FramebufferUpdateRequest{Width: 64, Height: 48}).Write(want)
+	got := make([]byte, want.Len())
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Fatalf("got %v, want %v", got, want.Bytes())
+	}
+}
@@ -182,9 +182,14 @@ func (rect *Rectangle) Read(c Conn) error {
 	// 		rect.Enc = &RawEncoding{}
 	// 	}
 	case EncDesktopSizePseudo:
-		rect.Enc = &DesktopSizePseudoEncoding{}
+		rect.Enc = c.GetEncInstance(rect.EncType)
+		if rect.Enc == nil {
+			rect.Enc = &DesktopSizePseudoEncoding{}
+		}
 	case EncDesktopNamePseudo:
 		rect.Enc = &DesktopNamePseudoEncoding{}
+	case EncLastRectPseudo:
+		rect.Enc = &LastRectPseudoEncoding{}
 	// case EncXCursorPseudo:
 	// 	rect.Enc = &XCursorPseudoEncoding{}
 	// case EncAtenHermon:
@@ -0,0 +1,68 @@
+package vnc2video
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"io"
+)
+
+// inflateWindowSize is the deflate history size, all a resumed stream needs to know of its past
+const inflateWindowSize = 32 * 1024
+
+// inflateStream decodes a zlib stream that arrives one rect at a time. Servers end each rect's
+// data with a zlib sync flush, so between rects the decoder state is only the last 32KB of
+// output, which is kept to allow saving the stream state and resuming it later.
+type inflateStream struct {
+	input  *bytes.Buffer
+	reader io.Reader
+	window []byte
+}
+
+// newInflateStream starts a zlib stream with the first rect's compressed data
+func newInflateStream(data []byte) (*inflateStream, error) {
+	input := bytes.NewBuffer(data)
+	reader, err := zlib.NewReader(input)
+	if err != nil {
+		return nil, err
+	}
+	return &inflateStream{input: input, reader: reader}, nil
+}
+
+// Write feeds the stream with the next rect's compressed data
+func (s *inflateStream) Write(data []byte) (int, error) {
+	return s.input.Write(data)
+}
+
+func (s *inflateStream) Read(p []byte) (int, error) {
+	n, err := s.reader.Read(p)
+	s.window = append(s.window, p[:n]...)
+	if len(s.window) > 2*inflateWindowSize {
+		s.window = append(s.window[:0], s.window[len(s.window)-inflateWindowSize:]...)
+	}
+	return n, err
+}
+
+// inflateState is a saved inflateStream, only valid between rects
+type inflateState struct {
+	window []byte
+}
+
+func (s *inflateStream) state() *inflateState {
+	window := s.window
+	if len(window) > inflateWindowSize {
+		window = window[len(window)-inflateWindowSize:]
+	}
+	return &inflateState{window: append([]byte{}, window...)}
+}
+
+// resume returns a stream continuing after the saved state, the zlib header and the sync flush
+// marker of the last rect were already consumed so it reads raw deflate blocks.
+func (st *inflateState) resume() *inflateStream {
+	input := &bytes.Buffer{}
+	return &inflateStream{
+		input:  input,
+		reader: flate.NewReaderDict(input, st.window),
+		window: append([]byte{}, st.window...),
+	}
+}
@@ -163,10 +163,11 @@ const ( // Cursor control & motion.
 )
 
 const ( // Misc functions.
-	Select Key = 0xff60
+	Select Key = iota + 0xff60
 	Print
 	Execute
 	Insert
+	_
 	Undo
 	Redo
 	Menu
@@ -195,14 +196,17 @@ const ( // Keypad functions cont.
 	KeypadRight
 	KeypadDown
 	KeypadPrior
-	KeypadPageUp
 	KeypadNext
-	KeypadPageDown
 	KeypadEnd
 	KeypadBegin
 	KeypadInsert
 	KeypadDelete
-	KeypadMultiply
+	KeypadPageUp   = KeypadPrior
+	KeypadPageDown = KeypadNext
+)
+
+const ( // Keypad operators and digits.
+	KeypadMultiply Key = iota + 0xffaa
 	KeypadAdd
 	KeypadSeparator
 	KeypadSubtract
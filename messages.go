@@ -16,6 +16,11 @@ var (
 		&KeyEvent{},
 		&PointerEvent{},
 		&ClientCutText{},
+		&SetDesktopSize{},
+		&EnableContinuousUpdates{},
+		&ClientFence{},
+		&QEMUExtendedKeyEvent{},
+		&ClientXvp{},
 	}
 
 	// DefaultServerMessages slice of default server messages sent to client
@@ -24,6 +29,9 @@ var (
 		&SetColorMapEntries{},
 		&Bell{},
 		&ServerCutText{},
+		&EndOfContinuousUpdates{},
+		&ServerFence{},
+		&ServerXvp{},
 	}
 )
 
@@ -43,6 +51,9 @@ const (
 	ClientCutTextMsgType
 )
 
+// SetDesktopSizeMsgType is the ExtendedDesktopSize client message type
+const SetDesktopSizeMsgType ClientMessageType = 251
+
 // ServerMessageType represents RFB message type
 type ServerMessageType uint8
 
@@ -85,8 +96,9 @@ type ServerMessage interface {
 
 // FramebufferUpdate holds a FramebufferUpdate wire format message.
 type FramebufferUpdate struct {
-	_       [1]byte      // pad
-	NumRect uint16       // number-of-rectangles
+	_ [1]byte // pad
+	// NumRect is the number of rects, or 0xffff when the update is ended by a LastRect rect
+	NumRect uint16
 	Rects   []*Rectangle // rectangles
 }
 
@@ -124,11 +136,12 @@ func (*FramebufferUpdate) Read(c Conn) (ServerMessage, error) {
 		if err := rect.Read(c); err != nil {
 			return nil, err
 		}
-		if rect.EncType == EncDesktopSizePseudo {
-			c.(*ClientConn).ResetAllEncodings()
-		}
 		logger.Tracef("----End RECT #%d Info (%dx%d) encType:%s", i, rect.Width, rect.Height, rect.EncType)
 		msg.Rects = append(msg.Rects, rect)
+		// the LastRect rect is kept so the update is written back as it was read
+		if rect.EncType == EncLastRectPseudo {
+			break
+		}
 	}
 	return &msg, nil
 }
@@ -155,9 +168,11 @@ func (msg *FramebufferUpdate) Write(c Conn) error {
 
 // ServerCutText represents server message
 type ServerCutText struct {
-	_      [1]byte
+	_      [3]byte
 	Length uint32
 	Text   []byte
+	// Clipboard is set instead of Text for extended clipboard messages
+	Clipboard *ExtendedClipboard
 }
 
 func (msg *ServerCutText) Supported(c Conn) bool {
@@ -166,6 +181,9 @@ func (msg *ServerCutText) Supported(c Conn) bool {
 
 // String returns string
 func (msg *ServerCutText) String() string {
+	if msg.Clipboard != nil {
+		return fmt.Sprintf("extended clipboard: %v", msg.Clipboard)
+	}
 	return fmt.Sprintf("lenght: %d text: %s", msg.Length, msg.Text)
 }
 
@@ -178,7 +196,7 @@ func (*ServerCutText) Type() ServerMessageType {
 func (*ServerCutText) Read(c Conn) (ServerMessage, error) {
 	msg := ServerCutText{}
 
-	var pad [1]byte
+	var pad [3]byte
 	if err := binary.Read(c, binary.BigEndian, &pad); err != nil {
 		return nil, err
 	}
@@ -186,6 +204,14 @@ func (*ServerCutText) Read(c Conn) (ServerMessage, error) {
 	if err := binary.Read(c, binary.BigEndian, &msg.Length); err != nil {
 		return nil, err
 	}
+	if int32(msg.Length) < 0 {
+		clipboard, err := readExtendedClipboard(c, msg.Length)
+		if err != nil {
+			return nil, err
+		}
+		msg.Clipboard = clipboard
+		return &msg, nil
+	}
 
 	msg.Text = make([]byte, msg.Length)
 	if err := binary.Read(c, binary.BigEndian, &msg.Text); err != nil {
@@ -196,10 +222,13 @@ func (*ServerCutText) Read(c Conn) (ServerMessage, error) {
 
 // Write marshal message to conn
 func (msg *ServerCutText) Write(c Conn) error {
+	if msg.Clipboard != nil {
+		return writeExtendedClipboard(c, uint8(msg.Type()), msg.Clipboard)
+	}
 	if err := binary.Write(c, binary.BigEndian, msg.Type()); err != nil {
 		return err
 	}
-	var pad [1]byte
+	var pad [3]byte
 	if err := binary.Write(c, binary.BigEndian, pad); err != nil {
 		return err
 	}
@@ -372,7 +401,8 @@ func (msg *SetPixelFormat) Write(c Conn) error {
 	return c.Flush()
 }
 
-// Read unmarshal message from conn
+// Read unmarshal message from conn, the pixel format is set on the conn by the message handler
+// once the updates encoded in the previous one are sent
 func (*SetPixelFormat) Read(c Conn) (ClientMessage, error) {
 	msg := SetPixelFormat{}
 	if err := binary.Read(c, binary.BigEndian, &msg); err != nil {
@@ -576,6 +606,8 @@ type ClientCutText struct {
 	_      [3]byte // padding
 	Length uint32  // length
 	Text   []byte
+	// Clipboard is set instead of Text for extended clipboard messages
+	Clipboard *ExtendedClipboard
 }
 
 func (msg *ClientCutText) Supported(c Conn) bool {
@@ -584,6 +616,9 @@ func (msg *ClientCutText) Supported(c Conn) bool {
 
 // String returns string
 func (msg *ClientCutText) String() string {
+	if msg.Clipboard != nil {
+		return fmt.Sprintf("extended clipboard: %v", msg.Clipboard)
+	}
 	return fmt.Sprintf("length: %d, text: %s", msg.Length, msg.Text)
 }
 
@@ -603,6 +638,14 @@ func (*ClientCutText) Read(c Conn) (ClientMessage, error) {
 	if err := binary.Read(c, binary.BigEndian, &msg.Length); err != nil {
 		return nil, err
 	}
+	if int32(msg.Length) < 0 {
+		clipboard, err := readExtendedClipboard(c, msg.Length)
+		if err != nil {
+			return nil, err
+		}
+		msg.Clipboard = clipboard
+		return &msg, nil
+	}
 
 	msg.Text = make([]byte, msg.Length)
 	if err := binary.Read(c, binary.BigEndian, &msg.Text); err != nil {
@@ -613,6 +656,9 @@ func (*ClientCutText) Read(c Conn) (ClientMessage, error) {
 
 // Write marshal message to conn
 func (msg *ClientCutText) Write(c Conn) error {
+	if msg.Clipboard != nil {
+		return writeExtendedClipboard(c, uint8(msg.Type()), msg.Clipboard)
+	}
 	if err := binary.Write(c, binary.BigEndian, msg.Type()); err != nil {
 		return err
 	}
@@ -636,3 +682,70 @@ func (msg *ClientCutText) Write(c Conn) error {
 
 	return c.Flush()
 }
+
+// SetDesktopSize asks the server to change the framebuffer size and the screen layout, the
+// server answers with an ExtendedDesktopSize rect.
+type SetDesktopSize struct {
+	Width, Height uint16
+	// Screens is the requested layout, a single screen of the whole framebuffer when empty
+	Screens []Screen
+}
+
+func (msg *SetDesktopSize) Supported(c Conn) bool {
+	return true
+}
+
+// String returns string
+func (msg *SetDesktopSize) String() string {
+	return fmt.Sprintf("width: %d, height: %d, screens: %v", msg.Width, msg.Height, msg.Screens)
+}
+
+// Type returns MessageType
+func (*SetDesktopSize) Type() ClientMessageType {
+	return SetDesktopSizeMsgType
+}
+
+// Read unmarshal message from conn
+func (*SetDesktopSize) Read(c Conn) (ClientMessage, error) {
+	header := struct {
+		_             [1]byte
+		Width, Height uint16
+		NumScreens    uint8
+		_             [1]byte
+	}{}
+	if err := binary.Read(c, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	msg := SetDesktopSize{Width: header.Width, Height: header.Height, Screens: make([]Screen, header.NumScreens)}
+	if err := binary.Read(c, binary.BigEndian, &msg.Screens); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// Write marshal message to conn
+func (msg *SetDesktopSize) Write(c Conn) error {
+	screens := msg.Screens
+	if len(screens) == 0 {
+		screens = []Screen{{Width: msg.Width, Height: msg.Height}}
+	}
+	if len(screens) > maxScreens {
+		return fmt.Errorf("too many screens: %d", len(screens))
+	}
+	if err := binary.Write(c, binary.BigEndian, msg.Type()); err != nil {
+		return err
+	}
+	header := struct {
+		_             [1]byte
+		Width, Height uint16
+		NumScreens    uint8
+		_             [1]byte
+	}{Width: msg.Width, Height: msg.Height, NumScreens: uint8(len(screens))}
+	if err := binary.Write(c, binary.BigEndian, header); err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, screens); err != nil {
+		return err
+	}
+	return c.Flush()
+}
@@ -0,0 +1,401 @@
+package vnc2video
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// ClipboardFlags are the formats and the actions of an extended clipboard message
+type ClipboardFlags uint32
+
+// Extended clipboard formats and actions
+const (
+	ClipboardText  ClipboardFlags = 1 << 0
+	ClipboardRTF   ClipboardFlags = 1 << 1
+	ClipboardHTML  ClipboardFlags = 1 << 2
+	ClipboardDIB   ClipboardFlags = 1 << 3
+	ClipboardFiles ClipboardFlags = 1 << 4
+
+	// ClipboardCaps lists the supported formats and actions, with the largest size of each
+	// format the peer may provide without a request
+	ClipboardCaps ClipboardFlags = 1 << 24
+	// ClipboardRequest asks the peer to provide its clipboard in the given formats
+	ClipboardRequest ClipboardFlags = 1 << 25
+	// ClipboardPeek asks the peer to notify the formats of its clipboard
+	ClipboardPeek ClipboardFlags = 1 << 26
+	// ClipboardNotify tells the peer the clipboard changed and has the given formats
+	ClipboardNotify ClipboardFlags = 1 << 27
+	// ClipboardProvide holds the clipboard in the given formats
+	ClipboardProvide ClipboardFlags = 1 << 28
+
+	clipboardFormats ClipboardFlags = 0xffff
+	// clipboardSupported are the formats and actions handled by this package
+	clipboardSupported = ClipboardText | ClipboardRTF | ClipboardHTML |
+		ClipboardRequest | ClipboardPeek | ClipboardNotify | ClipboardProvide
+	// clipboardMaxSize is the largest format accepted, and provided without a request
+	clipboardMaxSize = 20 << 20
+)
+
+// ExtendedClipboard is an extended clipboard message, carried by ServerCutText and
+// ClientCutText with a negative length
+type ExtendedClipboard struct {
+	Flags ClipboardFlags
+	// Sizes are the largest unsolicited size of each format of a caps message
+	Sizes map[ClipboardFlags]uint32
+	// Data is each format of a provide message, the text is UTF-8 with LF line endings
+	Data map[ClipboardFlags][]byte
+}
+
+// String returns string
+func (msg *ExtendedClipboard) String() string {
+	formats := make([]string, 0, len(msg.Data))
+	for _, format := range clipboardFormatList(msg.Flags) {
+		if data, ok := msg.Data[format]; ok {
+			formats = append(formats, fmt.Sprintf("%#x: %q", uint32(format), data))
+		}
+	}
+	return fmt.Sprintf("flags: %#x, sizes: %v, data: { %s }", uint32(msg.Flags), msg.Sizes, strings.Join(formats, ", "))
+}
+
+// clipboardFormatList returns the formats set in flags, lowest first as they are sent
+func clipboardFormatList(flags ClipboardFlags) []ClipboardFlags {
+	var formats []ClipboardFlags
+	for format := ClipboardFlags(1); format&clipboardFormats != 0; format <<= 1 {
+		if flags&format != 0 {
+			formats = append(formats, format)
+		}
+	}
+	return formats
+}
+
+// readExtendedClipboard reads the rest of a cut text message of the given (negated) length
+func readExtendedClipboard(c Conn, length uint32) (*ExtendedClipboard, error) {
+	length = -length
+	if length < 4 || length > clipboardMaxSize {
+		return nil, fmt.Errorf("invalid extended clipboard length: %d", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c, payload); err != nil {
+		return nil, err
+	}
+	msg := &ExtendedClipboard{Flags: ClipboardFlags(binary.BigEndian.Uint32(payload))}
+	payload = payload[4:]
+	formats := clipboardFormatList(msg.Flags)
+
+	switch {
+	case msg.Flags&ClipboardCaps != 0:
+		msg.Sizes = make(map[ClipboardFlags]uint32)
+		for _, format := range formats {
+			if len(payload) < 4 {
+				return nil, fmt.Errorf("extended clipboard caps too short")
+			}
+			msg.Sizes[format] = binary.BigEndian.Uint32(payload)
+			payload = payload[4:]
+		}
+	case msg.Flags&ClipboardProvide != 0:
+		zr, err := zlib.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		msg.Data = make(map[ClipboardFlags][]byte)
+		for _, format := range formats {
+			var size uint32
+			if err := binary.Read(zr, binary.BigEndian, &size); err != nil {
+				return nil, err
+			}
+			if size > clipboardMaxSize {
+				return nil, fmt.Errorf("extended clipboard format %#x too large: %d", uint32(format), size)
+			}
+			data := make([]byte, size)
+			if _, err := io.ReadFull(zr, data); err != nil {
+				return nil, err
+			}
+			if format == ClipboardText {
+				data = clipboardTextFromWire(data)
+			}
+			msg.Data[format] = data
+		}
+	}
+	return msg, nil
+}
+
+// writeExtendedClipboard writes a cut text message of the given type holding msg
+func writeExtendedClipboard(c Conn, msgType uint8, msg *ExtendedClipboard) error {
+	payload := &bytes.Buffer{}
+	binary.Write(payload, binary.BigEndian, uint32(msg.Flags))
+	switch {
+	case msg.Flags&ClipboardCaps != 0:
+		for _, format := range clipboardFormatList(msg.Flags) {
+			binary.Write(payload, binary.BigEndian, msg.Sizes[format])
+		}
+	case msg.Flags&ClipboardProvide != 0:
+		zw := zlib.NewWriter(payload)
+		for _, format := range clipboardFormatList(msg.Flags) {
+			data := msg.Data[format]
+			if format == ClipboardText {
+				data = clipboardTextToWire(data)
+			}
+			binary.Write(zw, binary.BigEndian, uint32(len(data)))
+			zw.Write(data)
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+	if payload.Len() > clipboardMaxSize {
+		return fmt.Errorf("extended clipboard message too large: %d", payload.Len())
+	}
+
+	var pad [3]byte
+	if err := binary.Write(c, binary.BigEndian, msgType); err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, pad); err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, -uint32(payload.Len())); err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, payload.Bytes()); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+// clipboardTextFromWire returns extended clipboard text without its null terminator and with LF
+// line endings
+func clipboardTextFromWire(data []byte) []byte {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		data = data[:i]
+	}
+	return bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+}
+
+// clipboardTextToWire returns text with CRLF line endings and a null terminator
+func clipboardTextToWire(text []byte) []byte {
+	text = bytes.Replace(text, []byte("\r\n"), []byte("\n"), -1)
+	return append(bytes.Replace(text, []byte("\n"), []byte("\r\n"), -1), 0)
+}
+
+// latin1ToUTF8 decodes the text of a legacy cut text message
+func latin1ToUTF8(text []byte) []byte {
+	buf := make([]byte, 0, len(text))
+	for _, b := range text {
+		buf = append(buf, string(rune(b))...)
+	}
+	return buf
+}
+
+// utf8ToLatin1 encodes the text of a legacy cut text message, characters out of Latin-1 are
+// replaced with '?'
+func utf8ToLatin1(text []byte) []byte {
+	buf := make([]byte, 0, len(text))
+	for len(text) > 0 {
+		r, size := utf8.DecodeRune(text)
+		text = text[size:]
+		if r > 0xff {
+			r = '?'
+		}
+		buf = append(buf, byte(r))
+	}
+	return buf
+}
+
+// ClipboardEvent is the clipboard of the peer, from a cut text message or provided by the
+// extended clipboard
+type ClipboardEvent struct {
+	// Data is each format of the clipboard, the text is UTF-8 with LF line endings
+	Data map[ClipboardFlags][]byte
+	// Extended is set when the clipboard came through the extended clipboard
+	Extended bool
+}
+
+// Text returns the clipboard text
+func (e *ClipboardEvent) Text() string {
+	return string(e.Data[ClipboardText])
+}
+
+// String returns string
+func (e *ClipboardEvent) String() string {
+	return fmt.Sprintf("extended: %v, text: %q, formats: %d", e.Extended, e.Text(), len(e.Data))
+}
+
+// clipboard is the clipboard state of a connection, shared by the client and the server
+type clipboard struct {
+	mu sync.Mutex
+	// peer are the caps of the peer, nil until it sent them
+	peer *ExtendedClipboard
+	// data is this side's clipboard
+	data map[ClipboardFlags][]byte
+}
+
+// clipboardCaps returns the caps of this side
+func clipboardCaps() *ExtendedClipboard {
+	msg := &ExtendedClipboard{Flags: ClipboardCaps | clipboardSupported, Sizes: make(map[ClipboardFlags]uint32)}
+	for _, format := range clipboardFormatList(msg.Flags) {
+		msg.Sizes[format] = clipboardMaxSize
+	}
+	return msg
+}
+
+// receive handles a clipboard message from the peer, returning the extended clipboard messages
+// to reply with and the peer's clipboard when the message holds it
+func (cb *clipboard) receive(text []byte, msg *ExtendedClipboard, replyCaps bool) ([]*ExtendedClipboard, *ClipboardEvent) {
+	if msg == nil {
+		return nil, &ClipboardEvent{Data: map[ClipboardFlags][]byte{ClipboardText: latin1ToUTF8(text)}}
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch {
+	case msg.Flags&ClipboardCaps != 0:
+		cb.peer = msg
+		if replyCaps {
+			return []*ExtendedClipboard{clipboardCaps()}, nil
+		}
+	case msg.Flags&ClipboardRequest != 0:
+		return []*ExtendedClipboard{cb.provide(msg.Flags, nil)}, nil
+	case msg.Flags&ClipboardPeek != 0:
+		return []*ExtendedClipboard{{Flags: ClipboardNotify | cb.formats()}}, nil
+	case msg.Flags&ClipboardNotify != 0:
+		if formats := msg.Flags & clipboardSupported & clipboardFormats; formats != 0 {
+			return []*ExtendedClipboard{{Flags: ClipboardRequest | formats}}, nil
+		}
+	case msg.Flags&ClipboardProvide != 0:
+		return nil, &ClipboardEvent{Data: msg.Data, Extended: true}
+	}
+	return nil, nil
+}
+
+// set changes this side's clipboard, returning the extended clipboard message telling the peer,
+// or the legacy cut text when the peer doesn't support the extended clipboard
+func (cb *clipboard) set(data map[ClipboardFlags][]byte) (*ExtendedClipboard, []byte) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.data = data
+	switch {
+	case cb.peer == nil:
+		return nil, utf8ToLatin1(data[ClipboardText])
+	case cb.peer.Flags&ClipboardNotify != 0:
+		return &ExtendedClipboard{Flags: ClipboardNotify | cb.formats()}, nil
+	case cb.peer.Flags&ClipboardProvide != 0:
+		return cb.provide(cb.peer.Flags, cb.peer.Sizes), nil
+	}
+	return nil, nil
+}
+
+// formats returns the formats of this side's clipboard, called with the lock held
+func (cb *clipboard) formats() ClipboardFlags {
+	var formats ClipboardFlags
+	for format := range cb.data {
+		formats |= format & clipboardSupported & clipboardFormats
+	}
+	return formats
+}
+
+// provide returns the requested formats of this side's clipboard, the formats larger than the
+// given sizes are left out. Called with the lock held.
+func (cb *clipboard) provide(requested ClipboardFlags, sizes map[ClipboardFlags]uint32) *ExtendedClipboard {
+	msg := &ExtendedClipboard{Flags: ClipboardProvide, Data: make(map[ClipboardFlags][]byte)}
+	for _, format := range clipboardFormatList(requested & cb.formats()) {
+		data := cb.data[format]
+		if sizes != nil && uint32(len(data)) > sizes[format] {
+			continue
+		}
+		msg.Flags |= format
+		msg.Data[format] = data
+	}
+	return msg
+}
+
+// SetClipboard changes the client's clipboard, the server gets the text as Latin-1 unless it
+// supports the extended clipboard. The text is UTF-8.
+func (c *ClientConn) SetClipboard(data map[ClipboardFlags][]byte) {
+	msg, text := c.clipboard.set(data)
+	if msg != nil {
+		c.queue(&ClientCutText{Clipboard: msg})
+	} else if text != nil {
+		c.queue(&ClientCutText{Text: text})
+	}
+}
+
+// SetClipboardText changes the client's clipboard to UTF-8 text
+func (c *ClientConn) SetClipboardText(text string) {
+	c.SetClipboard(map[ClipboardFlags][]byte{ClipboardText: []byte(text)})
+}
+
+// RequestClipboard asks a server supporting the extended clipboard for its clipboard, which is
+// sent to ClipboardCh
+func (c *ClientConn) RequestClipboard(formats ClipboardFlags) {
+	c.queue(&ClientCutText{Clipboard: &ExtendedClipboard{Flags: ClipboardRequest | formats&clipboardFormats}})
+}
+
+// queue sends a message with the handler writing the client messages
+func (c *ClientConn) queue(msg ClientMessage) {
+	c.messages <- msg
+}
+
+// handleClipboard answers the clipboard messages of the server and sends its clipboard to
+// ClipboardCh, called by the goroutine reading the server messages
+func (c *ClientConn) handleClipboard(msg ServerMessage) {
+	cut, ok := msg.(*ServerCutText)
+	if !ok {
+		return
+	}
+	replies, event := c.clipboard.receive(cut.Text, cut.Clipboard, true)
+	for _, reply := range replies {
+		c.queue(&ClientCutText{Clipboard: reply})
+	}
+	if event != nil && c.cfg.ClipboardCh != nil {
+		c.cfg.ClipboardCh <- event
+	}
+}
+
+// SetClipboard changes the server's clipboard, the client gets the text as Latin-1 unless it
+// supports the extended clipboard. The text is UTF-8.
+func (c *ServerConn) SetClipboard(data map[ClipboardFlags][]byte) {
+	msg, text := c.clipboard.set(data)
+	if msg != nil {
+		c.queue(&ServerCutText{Clipboard: msg})
+	} else if text != nil {
+		c.queue(&ServerCutText{Text: text})
+	}
+}
+
+// SetClipboardText changes the server's clipboard to UTF-8 text
+func (c *ServerConn) SetClipboardText(text string) {
+	c.SetClipboard(map[ClipboardFlags][]byte{ClipboardText: []byte(text)})
+}
+
+// RequestClipboard asks a client supporting the extended clipboard for its clipboard, which is
+// sent to ClipboardCh
+func (c *ServerConn) RequestClipboard(formats ClipboardFlags) {
+	c.queue(&ServerCutText{Clipboard: &ExtendedClipboard{Flags: ClipboardRequest | formats&clipboardFormats}})
+}
+
+// queue sends a message with the handler writing the server messages
+func (c *ServerConn) queue(msg ServerMessage) {
+	c.messages <- msg
+}
+
+// handleClipboard answers the clipboard messages of the client and sends its clipboard to
+// ClipboardCh, called by the goroutine reading the client messages
+func (c *ServerConn) handleClipboard(msg ClientMessage) {
+	cut, ok := msg.(*ClientCutText)
+	if !ok {
+		return
+	}
+	replies, event := c.clipboard.receive(cut.Text, cut.Clipboard, false)
+	for _, reply := range replies {
+		c.queue(&ServerCutText{Clipboard: reply})
+	}
+	if event != nil && c.cfg.ClipboardCh != nil {
+		c.cfg.ClipboardCh <- event
+	}
+}
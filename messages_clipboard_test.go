@@ -0,0 +1,185 @@
+package vnc2video
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// clipboardData is a clipboard with non Latin-1 text and the rich formats
+var clipboardData = map[ClipboardFlags][]byte{
+	ClipboardText: []byte("héllo 世界\nline2"),
+	ClipboardRTF:  []byte(`{\rtf1 h\'e9llo}`),
+	ClipboardHTML: []byte("<b>héllo</b>"),
+}
+
+// wireServerCutText writes msg and reads it back
+func wireServerCutText(t *testing.T, msg *ServerCutText) *ServerCutText {
+	conn := &bufferConn{}
+	if err := msg.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	if msgType, _ := conn.ReadByte(); msgType != uint8(ServerCutTextMsgType) {
+		t.Fatalf("got message type %d", msgType)
+	}
+	read, err := (&ServerCutText{}).Read(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return read.(*ServerCutText)
+}
+
+// wireClientCutText writes msg and reads it back
+func wireClientCutText(t *testing.T, msg *ClientCutText) *ClientCutText {
+	conn := &bufferConn{}
+	if err := msg.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	if msgType, _ := conn.ReadByte(); msgType != uint8(ClientCutTextMsgType) {
+		t.Fatalf("got message type %d", msgType)
+	}
+	read, err := (&ClientCutText{}).Read(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return read.(*ClientCutText)
+}
+
+func TestExtendedClipboardMessages(t *testing.T) {
+	caps := clipboardCaps()
+	conn := &bufferConn{}
+	(&ServerCutText{Clipboard: caps}).Write(conn)
+	// the length is negative, the caps have a size for each format
+	want := []byte{3, 0, 0, 0, 0xff, 0xff, 0xff, 0xf0, 0x1f, 0, 0, 7}
+	if got := conn.Next(len(want)); !bytes.Equal(got, want) {
+		t.Fatalf("got caps header %v, want %v", got, want)
+	}
+
+	read := wireServerCutText(t, &ServerCutText{Clipboard: caps}).Clipboard
+	if read.Flags != caps.Flags || !reflect.DeepEqual(read.Sizes, caps.Sizes) {
+		t.Fatalf("read caps %v, wrote %v", read, caps)
+	}
+
+	provide := &ExtendedClipboard{Flags: ClipboardProvide | ClipboardText | ClipboardRTF | ClipboardHTML, Data: clipboardData}
+	read = wireClientCutText(t, &ClientCutText{Clipboard: provide}).Clipboard
+	if read.Flags != provide.Flags || !reflect.DeepEqual(read.Data, clipboardData) {
+		t.Fatalf("read %v, wrote %v", read, provide)
+	}
+
+	for _, flags := range []ClipboardFlags{ClipboardRequest | ClipboardText, ClipboardNotify | ClipboardHTML, ClipboardPeek} {
+		if read := wireServerCutText(t, &ServerCutText{Clipboard: &ExtendedClipboard{Flags: flags}}).Clipboard; read.Flags != flags {
+			t.Errorf("read flags %#x, wrote %#x", uint32(read.Flags), uint32(flags))
+		}
+	}
+}
+
+func TestExtendedClipboardText(t *testing.T) {
+	// the text is sent with CRLF line endings and a null terminator
+	conn := &bufferConn{}
+	(&ClientCutText{Clipboard: &ExtendedClipboard{Flags: ClipboardProvide | ClipboardText, Data: map[ClipboardFlags][]byte{ClipboardText: []byte("a\nb")}}}).Write(conn)
+	conn.Next(12)
+	zr, err := zlib.NewReader(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadAll(zr); !bytes.Equal(got, []byte("\x00\x00\x00\x05a\r\nb\x00")) {
+		t.Fatalf("got text %q", got)
+	}
+
+	if got := wireServerCutText(t, &ServerCutText{Text: []byte("caf\xe9")}); got.Clipboard != nil || string(got.Text) != "caf\xe9" {
+		t.Fatalf("read legacy cut text %v", got)
+	}
+	if got := string(utf8ToLatin1([]byte("café 世界"))); got != "caf\xe9 ??" {
+		t.Fatalf("got Latin-1 %q", got)
+	}
+}
+
+func TestClipboardLegacy(t *testing.T) {
+	events := make(chan *ClipboardEvent, 1)
+	client, err := NewClientConn(&recordConn{}, &ClientConfig{Encodings: []Encoding{&RawEncoding{}}, ClipboardCh: events})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.handleClipboard(wireServerCutText(t, &ServerCutText{Text: []byte("caf\xe9")}))
+	if event := <-events; event.Extended || event.Text() != "café" {
+		t.Fatalf("got event %v", event)
+	}
+
+	// the server didn't send caps, the text is sent as Latin-1
+	client.SetClipboardText("café 世界")
+	if msg := (<-client.messages).(*ClientCutText); msg.Clipboard != nil || string(msg.Text) != "caf\xe9 ??" {
+		t.Fatalf("sent %v", msg)
+	}
+}
+
+func TestClipboardExchange(t *testing.T) {
+	clientEvents := make(chan *ClipboardEvent, 1)
+	serverEvents := make(chan *ClipboardEvent, 1)
+	client, err := NewClientConn(&recordConn{}, &ClientConfig{Encodings: []Encoding{&RawEncoding{}}, ExtendedClipboard: true, ClipboardCh: clientEvents})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServerConn(&recordConn{}, &ServerConfig{ClipboardCh: serverEvents})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// toClient and toServer pass the next queued message to the peer through the wire
+	toClient := func() *ExtendedClipboard {
+		msg := wireServerCutText(t, (<-server.messages).(*ServerCutText))
+		client.handleClipboard(msg)
+		return msg.Clipboard
+	}
+	toServer := func() *ExtendedClipboard {
+		msg := wireClientCutText(t, (<-client.messages).(*ClientCutText))
+		server.handleClipboard(msg)
+		return msg.Clipboard
+	}
+
+	// the server sends its caps once the client announces the extension, the client answers
+	server.SetEncodings([]EncodingType{EncRaw, EncExtendedClipboardPseudo})
+	server.SetEncodings([]EncodingType{EncExtendedClipboardPseudo})
+	if caps := toClient(); caps.Flags&ClipboardCaps == 0 {
+		t.Fatalf("server sent %v", caps)
+	}
+	if caps := toServer(); caps.Flags&ClipboardCaps == 0 {
+		t.Fatalf("client sent %v", caps)
+	}
+	if len(server.messages) != 0 || len(client.messages) != 0 {
+		t.Fatal("caps sent twice")
+	}
+
+	// the server notifies its clipboard, the client requests and gets it
+	server.SetClipboard(clipboardData)
+	if notify := toClient(); notify.Flags != ClipboardNotify|ClipboardText|ClipboardRTF|ClipboardHTML {
+		t.Fatalf("server sent %v", notify)
+	}
+	toServer()
+	toClient()
+	if event := <-clientEvents; !event.Extended || event.Text() != "héllo 世界\nline2" || !reflect.DeepEqual(event.Data, clipboardData) {
+		t.Fatalf("client got %v", event)
+	}
+
+	// the client notifies its text, the server requests and gets it
+	client.SetClipboardText("文字")
+	toServer()
+	toClient()
+	toServer()
+	if event := <-serverEvents; !event.Extended || event.Text() != "文字" {
+		t.Fatalf("server got %v", event)
+	}
+
+	// requests and peeks are answered with the clipboard
+	server.RequestClipboard(ClipboardText | ClipboardHTML)
+	toClient()
+	if provide := toServer(); provide.Flags != ClipboardProvide|ClipboardText || len(provide.Data) != 1 {
+		t.Fatalf("client provided %v", provide)
+	}
+	<-serverEvents
+	client.queue(&ClientCutText{Clipboard: &ExtendedClipboard{Flags: ClipboardPeek}})
+	toServer()
+	if notify := toClient(); notify.Flags != ClipboardNotify|ClipboardText|ClipboardRTF|ClipboardHTML {
+		t.Fatalf("server answered the peek with %v", notify)
+	}
+}
@@ -0,0 +1,253 @@
+package vnc2video
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+)
+
+// Continuous updates and fence message types, both extensions use the same type in each direction
+const (
+	EnableContinuousUpdatesMsgType ClientMessageType = 150
+	ClientFenceMsgType             ClientMessageType = 248
+)
+
+// Continuous updates and fence server message types
+const (
+	EndOfContinuousUpdatesMsgType ServerMessageType = 150
+	ServerFenceMsgType            ServerMessageType = 248
+)
+
+// Fence flags
+const (
+	// FenceBlockBefore asks to handle all the messages before the fence first
+	FenceBlockBefore uint32 = 1 << 0
+	// FenceBlockAfter asks not to handle the messages after the fence until it is answered
+	FenceBlockAfter uint32 = 1 << 1
+	// FenceSyncNext asks to handle the message after the fence before the ones following it
+	FenceSyncNext uint32 = 1 << 2
+	// FenceRequest is set on fences to answer, and cleared on the answers
+	FenceRequest uint32 = 1 << 31
+
+	// fenceFlags are the flags kept by the answers, messages are handled in order anyway
+	fenceFlags = FenceBlockBefore | FenceBlockAfter | FenceSyncNext
+	// fenceMaxPayload is the largest fence payload allowed
+	fenceMaxPayload = 64
+)
+
+// EnableContinuousUpdates asks the server to send updates of a region whenever it changes,
+// without FramebufferUpdateRequests, or to stop doing so.
+type EnableContinuousUpdates struct {
+	Enable        uint8
+	X, Y          uint16
+	Width, Height uint16
+}
+
+func (msg *EnableContinuousUpdates) Supported(c Conn) bool {
+	return true
+}
+
+// String returns string
+func (msg *EnableContinuousUpdates) String() string {
+	return fmt.Sprintf("enable: %d, x: %d, y: %d, width: %d, height: %d", msg.Enable, msg.X, msg.Y, msg.Width, msg.Height)
+}
+
+// Type returns MessageType
+func (*EnableContinuousUpdates) Type() ClientMessageType {
+	return EnableContinuousUpdatesMsgType
+}
+
+// Read unmarshal message from conn
+func (*EnableContinuousUpdates) Read(c Conn) (ClientMessage, error) {
+	msg := EnableContinuousUpdates{}
+	if err := binary.Read(c, binary.BigEndian, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// Write marshal message to conn
+func (msg *EnableContinuousUpdates) Write(c Conn) error {
+	if err := binary.Write(c, binary.BigEndian, msg.Type()); err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, msg); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+// EndOfContinuousUpdates tells the client continuous updates are supported, the first time it is
+// sent, and then that they stopped.
+type EndOfContinuousUpdates struct{}
+
+func (*EndOfContinuousUpdates) Supported(c Conn) bool {
+	return true
+}
+
+// String return string
+func (*EndOfContinuousUpdates) String() string {
+	return "end of continuous updates"
+}
+
+// Type returns MessageType
+func (*EndOfContinuousUpdates) Type() ServerMessageType {
+	return EndOfContinuousUpdatesMsgType
+}
+
+// Read unmarshal message from conn
+func (*EndOfContinuousUpdates) Read(c Conn) (ServerMessage, error) {
+	return &EndOfContinuousUpdates{}, nil
+}
+
+// Write marshal message to conn
+func (msg *EndOfContinuousUpdates) Write(c Conn) error {
+	if err := binary.Write(c, binary.BigEndian, msg.Type()); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+// ClientFence is a fence sent by the client, either answering a server fence or, once the server
+// sent one, a request for the server to answer.
+type ClientFence struct {
+	Flags   uint32
+	Payload []byte
+}
+
+func (msg *ClientFence) Supported(c Conn) bool {
+	return true
+}
+
+// String returns string
+func (msg *ClientFence) String() string {
+	return fmt.Sprintf("flags: %#x, payload: %v", msg.Flags, msg.Payload)
+}
+
+// Type returns MessageType
+func (*ClientFence) Type() ClientMessageType {
+	return ClientFenceMsgType
+}
+
+// Read unmarshal message from conn
+func (*ClientFence) Read(c Conn) (ClientMessage, error) {
+	flags, payload, err := readFence(c)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientFence{Flags: flags, Payload: payload}, nil
+}
+
+// Write marshal message to conn
+func (msg *ClientFence) Write(c Conn) error {
+	return writeFence(c, uint8(msg.Type()), msg.Flags, msg.Payload)
+}
+
+// ServerFence is a fence sent by the server, either a request the client has to answer or the
+// answer to a client fence.
+type ServerFence struct {
+	Flags   uint32
+	Payload []byte
+}
+
+func (msg *ServerFence) Supported(c Conn) bool {
+	return true
+}
+
+// String returns string
+func (msg *ServerFence) String() string {
+	return fmt.Sprintf("flags: %#x, payload: %v", msg.Flags, msg.Payload)
+}
+
+// Type returns MessageType
+func (*ServerFence) Type() ServerMessageType {
+	return ServerFenceMsgType
+}
+
+// Read unmarshal message from conn
+func (*ServerFence) Read(c Conn) (ServerMessage, error) {
+	flags, payload, err := readFence(c)
+	if err != nil {
+		return nil, err
+	}
+	return &ServerFence{Flags: flags, Payload: payload}, nil
+}
+
+// Write marshal message to conn
+func (msg *ServerFence) Write(c Conn) error {
+	return writeFence(c, uint8(msg.Type()), msg.Flags, msg.Payload)
+}
+
+// fenceHeader is the wire format of a fence, before the payload
+type fenceHeader struct {
+	_      [3]byte
+	Flags  uint32
+	Length uint8
+}
+
+func readFence(c Conn) (uint32, []byte, error) {
+	header := fenceHeader{}
+	if err := binary.Read(c, binary.BigEndian, &header); err != nil {
+		return 0, nil, err
+	}
+	if header.Length > fenceMaxPayload {
+		return 0, nil, fmt.Errorf("fence payload too long: %d", header.Length)
+	}
+	payload := make([]byte, header.Length)
+	if err := binary.Read(c, binary.BigEndian, &payload); err != nil {
+		return 0, nil, err
+	}
+	return header.Flags, payload, nil
+}
+
+func writeFence(c Conn, msgType uint8, flags uint32, payload []byte) error {
+	if len(payload) > fenceMaxPayload {
+		return fmt.Errorf("fence payload too long: %d", len(payload))
+	}
+	if err := binary.Write(c, binary.BigEndian, msgType); err != nil {
+		return err
+	}
+	header := fenceHeader{Flags: flags, Length: uint8(len(payload))}
+	if err := binary.Write(c, binary.BigEndian, header); err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, payload); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+// ContinuousUpdates returns true while the server sends updates without update requests
+func (c *ClientConn) ContinuousUpdates() bool {
+	return atomic.LoadInt32(&c.continuousUpdates) != 0
+}
+
+// handleContinuousUpdates is called by the goroutine reading the server messages. It answers the
+// server's fence requests right away, since the server holds continuous updates back until its
+// fences are answered, and enables continuous updates once the server announces them when the
+// client is configured to. They are enabled again for the whole framebuffer after it was resized.
+// The replies are queued for the goroutine writing the client messages.
+func (c *ClientConn) handleContinuousUpdates(msg ServerMessage) {
+	switch msg := msg.(type) {
+	case *ServerFence:
+		if msg.Flags&FenceRequest == 0 {
+			return
+		}
+		c.queue(&ClientFence{Flags: msg.Flags & fenceFlags, Payload: msg.Payload})
+		return
+	case *EndOfContinuousUpdates:
+		if atomic.CompareAndSwapInt32(&c.continuousUpdates, 1, 0) || c.continuousRegion != nil || !c.cfg.ContinuousUpdates {
+			// the server stopped them, or they were enabled already
+			return
+		}
+	case *FramebufferUpdate:
+		if !c.ContinuousUpdates() || (c.continuousRegion.Width == c.Width() && c.continuousRegion.Height == c.Height()) {
+			return
+		}
+	default:
+		return
+	}
+	c.continuousRegion = &EnableContinuousUpdates{Enable: 1, Width: c.Width(), Height: c.Height()}
+	atomic.StoreInt32(&c.continuousUpdates, 1)
+	c.queue(c.continuousRegion)
+}
@@ -0,0 +1,197 @@
+package vnc2video
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"net"
+	"testing"
+)
+
+// recordConn is a net.Conn recording what is written to it
+type recordConn struct {
+	net.Conn
+	bytes.Buffer
+}
+
+func (c *recordConn) Read(b []byte) (int, error)  { return c.Buffer.Read(b) }
+func (c *recordConn) Write(b []byte) (int, error) { return c.Buffer.Write(b) }
+func (c *recordConn) Close() error                { return nil }
+
+// readServerMessages reads all the server messages in data, decoding the updates with raw
+func readServerMessages(t *testing.T, data []byte) []ServerMessage {
+	conn := &bufferConn{pf: PixelFormat32bit, encodings: []Encoding{&RawEncoding{Image: NewRGBImage(image.Rect(0, 0, 100, 70))}}}
+	conn.Write(data)
+	messages := make(map[ServerMessageType]ServerMessage)
+	for _, msg := range DefaultServerMessages {
+		messages[msg.Type()] = msg
+	}
+	var read []ServerMessage
+	for conn.Len() > 0 {
+		var msgType ServerMessageType
+		if err := binary.Read(conn, binary.BigEndian, &msgType); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := messages[msgType].Read(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read = append(read, msg)
+	}
+	return read
+}
+
+// expectMessages checks the messages written to conn since the last call have the given types
+func expectMessages(t *testing.T, step string, conn *recordConn, types ...ServerMessageType) []ServerMessage {
+	msgs := readServerMessages(t, conn.Bytes())
+	conn.Reset()
+	ok := len(msgs) == len(types)
+	for i := 0; ok && i < len(msgs); i++ {
+		ok = msgs[i].Type() == types[i]
+	}
+	if !ok {
+		t.Fatalf("%s: got messages %v, want types %v", step, msgs, types)
+	}
+	return msgs
+}
+
+func TestFenceMessages(t *testing.T) {
+	conn := &bufferConn{}
+	client := &ClientFence{Flags: FenceRequest | FenceBlockAfter, Payload: []byte("payload")}
+	server := &ServerFence{Flags: FenceSyncNext}
+	enable := &EnableContinuousUpdates{Enable: 1, X: 1, Y: 2, Width: 3, Height: 4}
+	for _, msg := range []interface{ Write(Conn) error }{client, server, enable} {
+		if err := msg.Write(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := conn.Next(12); !bytes.Equal(got, []byte{248, 0, 0, 0, 0x80, 0, 0, 2, 7, 'p', 'a', 'y'}) {
+		t.Fatalf("got client fence %v", got)
+	}
+	conn.Next(4)
+	if msgType, _ := conn.ReadByte(); msgType != uint8(ServerFenceMsgType) {
+		t.Fatalf("got message type %d", msgType)
+	}
+	read, err := (&ServerFence{}).Read(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := read.(*ServerFence); got.Flags != server.Flags || len(got.Payload) != 0 {
+		t.Fatalf("read %v, wrote %v", got, server)
+	}
+	if msgType, _ := conn.ReadByte(); msgType != uint8(EnableContinuousUpdatesMsgType) {
+		t.Fatalf("got message type %d", msgType)
+	}
+	readEnable, err := (&EnableContinuousUpdates{}).Read(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *readEnable.(*EnableContinuousUpdates) != *enable {
+		t.Fatalf("read %v, wrote %v", readEnable, enable)
+	}
+
+	if err := (&ClientFence{Payload: make([]byte, 65)}).Write(conn); err == nil {
+		t.Fatal("wrote a 65 byte payload")
+	}
+}
+
+func TestContinuousUpdatesServer(t *testing.T) {
+	img := testSourceImage(100, 70)
+	source := NewImageSource(img)
+	conn := &recordConn{}
+	server, err := NewServerConn(conn, &ServerConfig{PixelFormat: PixelFormat32bit, Encodings: []Encoding{&RawEncoding{}}, Source: source})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetEncodings([]EncodingType{EncRaw, EncContinuousUpdatesPseudo, EncFencePseudo})
+	scheduler := &updateScheduler{source: source}
+
+	// the extensions are announced, then the region is updated without a request
+	if err := scheduler.handle(server, &EnableContinuousUpdates{Enable: 1, Width: 100, Height: 70}); err != nil {
+		t.Fatal(err)
+	}
+	msgs := expectMessages(t, "enable", conn, EndOfContinuousUpdatesMsgType, ServerFenceMsgType, FramebufferUpdateMsgType, ServerFenceMsgType)
+	if msgs[3].(*ServerFence).Flags != FenceRequest|FenceBlockBefore {
+		t.Fatalf("got fence %v after the update", msgs[3])
+	}
+
+	source.Invalidate(image.Rect(1, 1, 2, 2))
+	scheduler.update(server)
+	expectMessages(t, "second update", conn, FramebufferUpdateMsgType, ServerFenceMsgType)
+
+	// the updates wait for the fences to be answered
+	source.Invalidate(image.Rect(3, 3, 4, 4))
+	scheduler.update(server)
+	expectMessages(t, "unanswered fences", conn)
+	scheduler.handle(server, &ClientFence{Flags: FenceBlockBefore})
+	msgs = expectMessages(t, "answered fence", conn, FramebufferUpdateMsgType, ServerFenceMsgType)
+	if rect := msgs[0].(*FramebufferUpdate).Rects[0]; rect.X != 3 || rect.Y != 3 || rect.Width != 1 {
+		t.Fatalf("got update %v", rect)
+	}
+
+	// client fences are answered with the flags this side handles
+	scheduler.handle(server, &ClientFence{Flags: FenceRequest | FenceSyncNext | 1<<10, Payload: []byte{1, 2}})
+	msgs = expectMessages(t, "client fence", conn, ServerFenceMsgType)
+	if fence := msgs[0].(*ServerFence); fence.Flags != FenceSyncNext || !bytes.Equal(fence.Payload, []byte{1, 2}) {
+		t.Fatalf("got fence answer %v", fence)
+	}
+
+	scheduler.handle(server, &EnableContinuousUpdates{Enable: 0})
+	expectMessages(t, "disable", conn, EndOfContinuousUpdatesMsgType)
+	scheduler.handle(server, &ClientFence{})
+	scheduler.handle(server, &ClientFence{})
+	source.Invalidate()
+	scheduler.update(server)
+	expectMessages(t, "disabled", conn)
+}
+
+func TestContinuousUpdatesClient(t *testing.T) {
+	conn := &recordConn{}
+	client, err := NewClientConn(conn, &ClientConfig{Encodings: []Encoding{&RawEncoding{}}, ContinuousUpdates: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetWidth(100)
+	client.SetHeight(70)
+	client.SetEncodings([]EncodingType{EncRaw})
+	sent := &bufferConn{}
+	sent.Write(conn.Next(conn.Len())[1:])
+	encodings, err := (&SetEncodings{}).Read(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := encodings.(*SetEncodings).Encodings; len(got) != 4 || got[1] != EncContinuousUpdatesPseudo || got[2] != EncFencePseudo || got[3] != EncLastRectPseudo {
+		t.Fatalf("got encodings %v", got)
+	}
+
+	client.handleContinuousUpdates(&EndOfContinuousUpdates{})
+	if enable := (<-client.messages).(*EnableContinuousUpdates); *enable != (EnableContinuousUpdates{Enable: 1, Width: 100, Height: 70}) || !client.ContinuousUpdates() {
+		t.Fatalf("continuous updates not enabled, sent %v", enable)
+	}
+	client.handleContinuousUpdates(&ServerFence{Flags: FenceRequest | FenceBlockBefore | 1<<8, Payload: []byte{7}})
+	if fence := (<-client.messages).(*ClientFence); fence.Flags != FenceBlockBefore || !bytes.Equal(fence.Payload, []byte{7}) {
+		t.Fatalf("got fence answer %v", fence)
+	}
+	client.handleContinuousUpdates(&ServerFence{Flags: FenceBlockBefore})
+	if len(client.messages) != 0 {
+		t.Fatal("answered a fence answer")
+	}
+
+	// a resized framebuffer is enabled again
+	client.handleContinuousUpdates(&FramebufferUpdate{})
+	if len(client.messages) != 0 {
+		t.Fatal("enabled again without a resize")
+	}
+	client.SetWidth(120)
+	client.handleContinuousUpdates(&FramebufferUpdate{})
+	if enable := (<-client.messages).(*EnableContinuousUpdates); enable.Width != 120 || enable.Height != 70 {
+		t.Fatalf("sent %v after the resize", enable)
+	}
+
+	// the server stopping them isn't answered
+	client.handleContinuousUpdates(&EndOfContinuousUpdates{})
+	client.handleContinuousUpdates(&EndOfContinuousUpdates{})
+	if client.ContinuousUpdates() || len(client.messages) != 0 {
+		t.Fatalf("continuous updates %v after the server stopped them, queued %d messages", client.ContinuousUpdates(), len(client.messages))
+	}
+}
@@ -0,0 +1,118 @@
+package vnc2video
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+)
+
+// QEMUMsgType is the client message type of the QEMU messages, which start with a submessage type
+const QEMUMsgType ClientMessageType = 255
+
+// QEMU client submessage types
+const (
+	QEMUExtendedKeyEventSubmsg uint8 = 0
+)
+
+// relativePointerCenter is the pointer position of no motion in relative mode
+const relativePointerCenter = 0x7fff
+
+// QEMUExtendedKeyEvent is a key event with the XT scancode of the key, which the server uses
+// instead of the keysym so the input doesn't depend on its keyboard layout.
+type QEMUExtendedKeyEvent struct {
+	Down uint16 // down-flag
+	Key  Key    // keysym
+	// Keycode is the XT scancode, see Key.XTScancode. 0 lets the server use the keysym.
+	Keycode uint32
+}
+
+func (msg *QEMUExtendedKeyEvent) Supported(c Conn) bool {
+	return true
+}
+
+// String returns string
+func (msg *QEMUExtendedKeyEvent) String() string {
+	return fmt.Sprintf("down: %d, key: %v, keycode: %#x", msg.Down, msg.Key, msg.Keycode)
+}
+
+// Type returns MessageType
+func (*QEMUExtendedKeyEvent) Type() ClientMessageType {
+	return QEMUMsgType
+}
+
+// Read unmarshal message from conn
+func (*QEMUExtendedKeyEvent) Read(c Conn) (ClientMessage, error) {
+	var submsg uint8
+	if err := binary.Read(c, binary.BigEndian, &submsg); err != nil {
+		return nil, err
+	}
+	if submsg != QEMUExtendedKeyEventSubmsg {
+		return nil, fmt.Errorf("unsupported qemu submessage-type: %d", submsg)
+	}
+	msg := QEMUExtendedKeyEvent{}
+	if err := binary.Read(c, binary.BigEndian, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// Write marshal message to conn
+func (msg *QEMUExtendedKeyEvent) Write(c Conn) error {
+	if err := binary.Write(c, binary.BigEndian, msg.Type()); err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, QEMUExtendedKeyEventSubmsg); err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, msg); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+// QEMUExtendedKeyEvents returns true once the server announced it accepts QEMUExtendedKeyEvent
+func (c *ClientConn) QEMUExtendedKeyEvents() bool {
+	return atomic.LoadInt32(&c.qemuKeyEvents) != 0
+}
+
+// RelativePointer returns true while the server asks for relative pointer motion
+func (c *ClientConn) RelativePointer() bool {
+	return atomic.LoadInt32(&c.relativePointer) != 0
+}
+
+// KeyEvent returns the message pressing or releasing key: a QEMUExtendedKeyEvent with the XT
+// scancode of the key when the server accepts them, a KeyEvent otherwise.
+func (c *ClientConn) KeyEvent(key Key, down bool) ClientMessage {
+	if c.QEMUExtendedKeyEvents() {
+		msg := &QEMUExtendedKeyEvent{Key: key, Keycode: key.XTScancode()}
+		if down {
+			msg.Down = 1
+		}
+		return msg
+	}
+	msg := &KeyEvent{Key: key}
+	if down {
+		msg.Down = 1
+	}
+	return msg
+}
+
+// PointerEvent returns the message moving the pointer to x, y with the buttons of mask pressed,
+// or by x, y while the server asks for relative pointer motion.
+func (c *ClientConn) PointerEvent(mask uint8, x, y int) *PointerEvent {
+	if c.RelativePointer() {
+		return &PointerEvent{Mask: mask, X: relativeMotion(x), Y: relativeMotion(y)}
+	}
+	return &PointerEvent{Mask: mask, X: uint16(x), Y: uint16(y)}
+}
+
+// relativeMotion returns the pointer position sent for a motion of delta in relative mode
+func relativeMotion(delta int) uint16 {
+	switch {
+	case delta < -relativePointerCenter:
+		delta = -relativePointerCenter
+	case delta > 0xffff-relativePointerCenter:
+		delta = 0xffff - relativePointerCenter
+	}
+	return uint16(relativePointerCenter + delta)
+}
@@ -0,0 +1,103 @@
+package vnc2video
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestQEMUExtendedKeyEvent(t *testing.T) {
+	conn := &bufferConn{}
+	msg := &QEMUExtendedKeyEvent{Down: 1, Key: Up, Keycode: Up.XTScancode()}
+	if err := msg.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{255, 0, 0, 1, 0, 0, 0xff, 0x52, 0, 0, 0, 0xc8}
+	if !bytes.Equal(conn.Bytes(), want) {
+		t.Fatalf("wrote %v, want %v", conn.Bytes(), want)
+	}
+	conn.ReadByte()
+	read, err := (&QEMUExtendedKeyEvent{}).Read(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *read.(*QEMUExtendedKeyEvent) != *msg {
+		t.Fatalf("read %v, wrote %v", read, msg)
+	}
+
+	conn.Write([]byte{1, 0, 0})
+	if _, err := (&QEMUExtendedKeyEvent{}).Read(conn); err == nil {
+		t.Fatal("read an audio submessage")
+	}
+}
+
+func TestXTScancode(t *testing.T) {
+	for _, test := range []struct {
+		key  Key
+		want uint32
+	}{
+		{SmallA, 0x1e},
+		{A, 0x1e},
+		{Exclaim, 0x02},
+		{Return, 0x1c},
+		{KeypadEnter, 0x9c},
+		{KeypadPageUp, 0x49},
+		{Insert, 0xd2},
+		{ControlRight, 0x9d},
+		{F12, 0x58},
+		{HyperLeft, 0},
+	} {
+		if got := test.key.XTScancode(); got != test.want {
+			t.Errorf("%v: got scancode %#x, want %#x", test.key, got, test.want)
+		}
+	}
+}
+
+func TestClientQEMUInput(t *testing.T) {
+	conn := &recordConn{}
+	client, err := NewClientConn(conn, &ClientConfig{Encodings: []Encoding{
+		&RawEncoding{},
+		&QEMUExtendedKeyEventPseudoEncoding{},
+		&QEMUPointerMotionChangePseudoEncoding{},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// update reads the pseudo rects of an update written to the conn
+	update := func(rects ...*Rectangle) {
+		for _, rect := range rects {
+			rect.Enc = client.GetEncInstance(rect.EncType)
+		}
+		if err := (&FramebufferUpdate{NumRect: uint16(len(rects)), Rects: rects}).Write(client); err != nil {
+			t.Fatal(err)
+		}
+		var msgType ServerMessageType
+		binary.Read(client, binary.BigEndian, &msgType)
+		if _, err := (&FramebufferUpdate{}).Read(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if msg, ok := client.KeyEvent(SmallA, true).(*KeyEvent); !ok || msg.Down != 1 || msg.Key != SmallA {
+		t.Fatalf("sent %v before the server accepted extended key events", msg)
+	}
+	if msg := client.PointerEvent(Mask(BtnLeft), 10, 20); msg.X != 10 || msg.Y != 20 {
+		t.Fatalf("sent %v in absolute mode", msg)
+	}
+
+	update(&Rectangle{EncType: EncQEMUExtendedKeyEventPseudo}, &Rectangle{X: 0, EncType: EncQEMUPointerMotionChangePseudo})
+	if msg, ok := client.KeyEvent(A, false).(*QEMUExtendedKeyEvent); !ok || msg.Down != 0 || msg.Keycode != 0x1e {
+		t.Fatalf("sent %v once the server accepted extended key events", client.KeyEvent(A, false))
+	}
+	if msg := client.PointerEvent(Mask(BtnNone), -5, 7); !client.RelativePointer() || msg.X != 0x7ffa || msg.Y != 0x8006 {
+		t.Fatalf("sent %v in relative mode", msg)
+	}
+	if msg := client.PointerEvent(Mask(BtnNone), -100000, 100000); msg.X != 0 || msg.Y != 0xffff {
+		t.Fatalf("sent %v for a large motion", msg)
+	}
+
+	update(&Rectangle{X: 1, EncType: EncQEMUPointerMotionChangePseudo})
+	if client.RelativePointer() {
+		t.Fatal("still in relative mode")
+	}
+}
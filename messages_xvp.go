@@ -0,0 +1,169 @@
+package vnc2video
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+)
+
+// Xvp message types, the extension uses the same type in each direction
+const (
+	ClientXvpMsgType ClientMessageType = 250
+	ServerXvpMsgType ServerMessageType = 250
+)
+
+// XvpCode is the code of an xvp message
+type XvpCode uint8
+
+// Xvp message codes, the server sends XvpFail and XvpInit, the client the actions
+const (
+	XvpFail     XvpCode = 0
+	XvpInit     XvpCode = 1
+	XvpShutdown XvpCode = 2
+	XvpReboot   XvpCode = 3
+	XvpReset    XvpCode = 4
+)
+
+// xvpVersion is the xvp extension version supported
+const xvpVersion = 1
+
+// String returns string
+func (code XvpCode) String() string {
+	switch code {
+	case XvpFail:
+		return "fail"
+	case XvpInit:
+		return "init"
+	case XvpShutdown:
+		return "shutdown"
+	case XvpReboot:
+		return "reboot"
+	case XvpReset:
+		return "reset"
+	}
+	return fmt.Sprintf("XvpCode(%d)", uint8(code))
+}
+
+// ClientXvp asks the server to shut down, reboot or reset the machine, see ClientConn.XvpAction
+type ClientXvp struct {
+	_       [1]byte // padding
+	Version uint8
+	Code    XvpCode
+}
+
+func (msg *ClientXvp) Supported(c Conn) bool {
+	return true
+}
+
+// String returns string
+func (msg *ClientXvp) String() string {
+	return fmt.Sprintf("version: %d, code: %v", msg.Version, msg.Code)
+}
+
+// Type returns MessageType
+func (*ClientXvp) Type() ClientMessageType {
+	return ClientXvpMsgType
+}
+
+// Read unmarshal message from conn
+func (*ClientXvp) Read(c Conn) (ClientMessage, error) {
+	msg := ClientXvp{}
+	if err := binary.Read(c, binary.BigEndian, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// Write marshal message to conn
+func (msg *ClientXvp) Write(c Conn) error {
+	if err := binary.Write(c, binary.BigEndian, msg.Type()); err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, msg); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+// ServerXvp tells the client the server supports xvp, with XvpInit, or that an action failed,
+// with XvpFail
+type ServerXvp struct {
+	_       [1]byte // padding
+	Version uint8
+	Code    XvpCode
+}
+
+func (msg *ServerXvp) Supported(c Conn) bool {
+	return true
+}
+
+// String returns string
+func (msg *ServerXvp) String() string {
+	return fmt.Sprintf("version: %d, code: %v", msg.Version, msg.Code)
+}
+
+// Type returns MessageType
+func (*ServerXvp) Type() ServerMessageType {
+	return ServerXvpMsgType
+}
+
+// Read unmarshal message from conn
+func (*ServerXvp) Read(c Conn) (ServerMessage, error) {
+	msg := ServerXvp{}
+	if err := binary.Read(c, binary.BigEndian, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// Write marshal message to conn
+func (msg *ServerXvp) Write(c Conn) error {
+	if err := binary.Write(c, binary.BigEndian, msg.Type()); err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, msg); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+// Xvp returns true once the server sent XvpInit, and accepts XvpAction
+func (c *ClientConn) Xvp() bool {
+	return atomic.LoadInt32(&c.xvpVersion) != 0
+}
+
+// XvpAction asks the server to shut down, reboot or reset the machine. The server only answers
+// failures, which are passed to ClientConfig.XvpFailed.
+func (c *ClientConn) XvpAction(action XvpCode) error {
+	if action != XvpShutdown && action != XvpReboot && action != XvpReset {
+		return fmt.Errorf("invalid xvp action: %v", action)
+	}
+	version := atomic.LoadInt32(&c.xvpVersion)
+	if version == 0 {
+		return fmt.Errorf("xvp not supported by the server")
+	}
+	atomic.StoreInt32(&c.xvpAction, int32(action))
+	c.queue(&ClientXvp{Version: uint8(version), Code: action})
+	return nil
+}
+
+// handleXvp keeps the xvp version of the server and passes its failures to XvpFailed, called by
+// the goroutine reading the server messages
+func (c *ClientConn) handleXvp(msg ServerMessage) {
+	xvp, ok := msg.(*ServerXvp)
+	if !ok {
+		return
+	}
+	switch xvp.Code {
+	case XvpInit:
+		version := xvp.Version
+		if version > xvpVersion {
+			version = xvpVersion
+		}
+		atomic.StoreInt32(&c.xvpVersion, int32(version))
+	case XvpFail:
+		if c.cfg.XvpFailed != nil {
+			c.cfg.XvpFailed(c, XvpCode(atomic.LoadInt32(&c.xvpAction)))
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package vnc2video
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestXvpMessages(t *testing.T) {
+	conn := &bufferConn{}
+	(&ClientXvp{Version: 1, Code: XvpReboot}).Write(conn)
+	if got := conn.Next(4); !bytes.Equal(got, []byte{250, 0, 1, 3}) {
+		t.Fatalf("wrote %v", got)
+	}
+	conn.Write([]byte{0, 1, 1})
+	msg, err := (&ServerXvp{}).Read(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if xvp := msg.(*ServerXvp); xvp.Version != 1 || xvp.Code != XvpInit {
+		t.Fatalf("read %v", xvp)
+	}
+	if ClientXvpMsgType.String() != "ClientXvpMsgType" || SetDesktopSizeMsgType.String() != "SetDesktopSizeMsgType" {
+		t.Fatalf("got names %v, %v", ClientXvpMsgType, SetDesktopSizeMsgType)
+	}
+}
+
+func TestClientXvp(t *testing.T) {
+	conn := &recordConn{}
+	var failed []XvpCode
+	client, err := NewClientConn(conn, &ClientConfig{
+		Encodings: []Encoding{&RawEncoding{}},
+		Xvp:       true,
+		XvpFailed: func(c *ClientConn, action XvpCode) { failed = append(failed, action) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetEncodings([]EncodingType{EncRaw})
+	sent := &bufferConn{}
+	sent.Write(conn.Next(conn.Len())[1:])
+	encodings, err := (&SetEncodings{}).Read(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := encodings.(*SetEncodings).Encodings; len(got) != 3 || got[1] != EncXvpPseudo {
+		t.Fatalf("got encodings %v", got)
+	}
+
+	if err := client.XvpAction(XvpShutdown); err == nil || client.Xvp() {
+		t.Fatal("sent an action before the server init")
+	}
+	// a newer server is answered with the version supported here
+	client.handleXvp(&ServerXvp{Version: 2, Code: XvpInit})
+	if err := client.XvpAction(XvpReboot); err != nil {
+		t.Fatal(err)
+	}
+	if msg := (<-client.messages).(*ClientXvp); msg.Version != 1 || msg.Code != XvpReboot {
+		t.Fatalf("sent %v", msg)
+	}
+	if err := client.XvpAction(XvpInit); err == nil {
+		t.Fatal("sent an init")
+	}
+
+	client.handleXvp(&ServerXvp{Version: 1, Code: XvpFail})
+	if len(failed) != 1 || failed[0] != XvpReboot {
+		t.Fatalf("got failures %v", failed)
+	}
+}
@@ -8,9 +8,14 @@ const (
 	SecTypeUnknown  SecurityType = SecurityType(0)
 	SecTypeNone     SecurityType = SecurityType(1)
 	SecTypeVNC      SecurityType = SecurityType(2)
+	SecTypeRA2      SecurityType = SecurityType(5)
+	SecTypeRA2ne    SecurityType = SecurityType(6)
 	SecTypeTight    SecurityType = SecurityType(16)
 	SecTypeATEN     SecurityType = SecurityType(16)
 	SecTypeVeNCrypt SecurityType = SecurityType(19)
+	SecTypeARD      SecurityType = SecurityType(30)
+	SecTypeRA256    SecurityType = SecurityType(129)
+	SecTypeRAne256  SecurityType = SecurityType(130)
 )
 
 type SecuritySubType uint32
@@ -0,0 +1,128 @@
+package vnc2video
+
+import (
+	"crypto/aes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// ardCredentialLength is the size of the username and the password fields, each holding a
+// null terminated string
+const ardCredentialLength = 64
+
+// ClientAuthARD is the Apple Remote Desktop authentication (type 30) of macOS screen sharing.
+// The credentials are encrypted with AES-128-ECB, keyed with the MD5 of a Diffie-Hellman shared secret.
+type ClientAuthARD struct {
+	Username []byte
+	Password []byte
+	// rand is the source of the private key and the credential padding, crypto/rand when nil
+	rand io.Reader
+}
+
+func (*ClientAuthARD) Type() SecurityType {
+	return SecTypeARD
+}
+
+func (*ClientAuthARD) SubType() SecuritySubType {
+	return SecSubTypeUnknown
+}
+
+func (auth *ClientAuthARD) Auth(c Conn) error {
+	if len(auth.Username) >= ardCredentialLength || len(auth.Password) >= ardCredentialLength {
+		return fmt.Errorf("username/password is too long, allowed 0-%d", ardCredentialLength-1)
+	}
+	random := auth.rand
+	if random == nil {
+		random = rand.Reader
+	}
+
+	var params struct {
+		Generator uint16
+		KeyLength uint16
+	}
+	if err := binary.Read(c, binary.BigEndian, &params); err != nil {
+		return err
+	}
+	if params.KeyLength == 0 || params.KeyLength > 1024 {
+		return fmt.Errorf("ARD: invalid key length %d", params.KeyLength)
+	}
+	prime := make([]byte, params.KeyLength)
+	serverKey := make([]byte, params.KeyLength)
+	if err := binary.Read(c, binary.BigEndian, &prime); err != nil {
+		return err
+	}
+	if err := binary.Read(c, binary.BigEndian, &serverKey); err != nil {
+		return err
+	}
+
+	publicKey, secret, err := ardKeyAgreement(random, big.NewInt(int64(params.Generator)), new(big.Int).SetBytes(prime), new(big.Int).SetBytes(serverKey), int(params.KeyLength))
+	if err != nil {
+		return err
+	}
+	credentials := make([]byte, 2*ardCredentialLength)
+	if _, err := io.ReadFull(random, credentials); err != nil {
+		return err
+	}
+	// NUL terminated, the rest stays random
+	credentials[copy(credentials, auth.Username)] = 0
+	credentials[ardCredentialLength+copy(credentials[ardCredentialLength:], auth.Password)] = 0
+	key := md5.Sum(secret)
+	ciphertext, err := aesECBEncrypt(key[:], credentials)
+	if err != nil {
+		return err
+	}
+
+	if err := binary.Write(c, binary.BigEndian, ciphertext); err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, publicKey); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+// ardKeyAgreement returns the client public key and the shared secret, padded to the key length
+func ardKeyAgreement(random io.Reader, generator, prime, serverKey *big.Int, keyLength int) ([]byte, []byte, error) {
+	one := big.NewInt(1)
+	if prime.Cmp(one) <= 0 || serverKey.Cmp(one) <= 0 || serverKey.Cmp(prime) >= 0 {
+		return nil, nil, fmt.Errorf("ARD: invalid Diffie-Hellman parameters")
+	}
+	privateKey := make([]byte, keyLength)
+	if _, err := io.ReadFull(random, privateKey); err != nil {
+		return nil, nil, err
+	}
+	private := new(big.Int).SetBytes(privateKey)
+	publicKey := new(big.Int).Exp(generator, private, prime)
+	secret := new(big.Int).Exp(serverKey, private, prime)
+	return leftPad(publicKey.Bytes(), keyLength), leftPad(secret.Bytes(), keyLength), nil
+}
+
+// leftPad returns b as a big endian number of the given length
+func leftPad(b []byte, length int) []byte {
+	if len(b) >= length {
+		return b
+	}
+	padded := make([]byte, length)
+	copy(padded[length-len(b):], b)
+	return padded
+}
+
+// aesECBEncrypt encrypts each block on its own, data must be a multiple of the block size
+func aesECBEncrypt(key, data []byte) ([]byte, error) {
+	cipher, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%cipher.BlockSize() != 0 {
+		return nil, fmt.Errorf("data size %d isn't a multiple of the block size", len(data))
+	}
+	out := make([]byte, len(data))
+	for i := 0; i < len(data); i += cipher.BlockSize() {
+		cipher.Encrypt(out[i:i+cipher.BlockSize()], data[i:i+cipher.BlockSize()])
+	}
+	return out, nil
+}
@@ -0,0 +1,94 @@
+package vnc2video
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"math/big"
+	"testing"
+)
+
+// the 1024 bit MODP group of RFC 2409, which macOS uses
+const ardTestPrime = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE65381FFFFFFFFFFFFFFFF"
+
+// ardServerHello returns the server's Diffie-Hellman parameters message
+func ardServerHello(t *testing.T, serverKey []byte) []byte {
+	prime, err := hex.DecodeString(ardTestPrime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := &bytes.Buffer{}
+	binary.Write(hello, binary.BigEndian, []uint16{2, uint16(len(prime))})
+	hello.Write(prime)
+	hello.Write(serverKey)
+	return hello.Bytes()
+}
+
+func TestClientAuthARDVector(t *testing.T) {
+	// computed independently, with the server private key 0x0102...20, the client private key
+	// 128 bytes of 0x42 and zero credential padding
+	serverKey, _ := hex.DecodeString("457120764f3a1e6fd58103e41a4093a6c8bc1d97cb8759de41c21afdd2d3048a5ef3d88ce24aa6ba4fe30bcfb0b0f75abf1a8aeaff3723f1bf53740c902005e1199fabad7c538e94a7034fd585339a02f3634893f748929d2a7257643e398130541ae64124c17d4507a97f1cbebeb7b933642b8df479eb59e36cfeffbf1671dd")
+	clientKey, _ := hex.DecodeString("efeedfe6b21cae4d2fa21e68011ac68cba9076cc29573375c4d40d77cd513bcb6e6c116253e417aed8fa60f07cd10bbfc97461c8dd5af396bb2b202834ff8570c54e896481e790eff259b430ebd8621c233b9073d4d57ec27a13be3599cf4b41963c70ca43b0696a56efb1fd13bd8e71b60e9ef72bd890540228cb9f95e9f2b7")
+	ciphertext, _ := hex.DecodeString("39f8fcef5f7f7cf8c3dcef2c92df15b0718f55a35ef13d787f85feb2481ee7af718f55a35ef13d787f85feb2481ee7af718f55a35ef13d787f85feb2481ee7af52a105bb7868ac9d8647f74d977b681b718f55a35ef13d787f85feb2481ee7af718f55a35ef13d787f85feb2481ee7af718f55a35ef13d787f85feb2481ee7af")
+
+	conn := &bufferConn{}
+	conn.Write(ardServerHello(t, serverKey))
+	random := append(bytes.Repeat([]byte{0x42}, 128), make([]byte, 128)...)
+	// spare capacity behind the credentials must stay the caller's
+	username := append(bytes.Repeat([]byte{0xff}, 16)[:0], "ard-user"...)
+	password := append(bytes.Repeat([]byte{0xff}, 16)[:0], "secret"...)
+	auth := &ClientAuthARD{Username: username, Password: password, rand: bytes.NewReader(random)}
+	if err := auth.Auth(conn); err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.Next(128); !bytes.Equal(got, ciphertext) {
+		t.Fatalf("got credentials %x, want %x", got, ciphertext)
+	}
+	if username[:cap(username)][len(username)] != 0xff || password[:cap(password)][len(password)] != 0xff {
+		t.Errorf("credentials written past the caller's slices")
+	}
+	if got := conn.Next(128); !bytes.Equal(got, clientKey) {
+		t.Fatalf("got public key %x, want %x", got, clientKey)
+	}
+}
+
+func TestClientAuthARDKeyAgreement(t *testing.T) {
+	prime, _ := new(big.Int).SetString(ardTestPrime, 16)
+	serverPrivate := big.NewInt(0x123456789)
+	serverKey := leftPad(new(big.Int).Exp(big.NewInt(2), serverPrivate, prime).Bytes(), 128)
+
+	conn := &bufferConn{}
+	conn.Write(ardServerHello(t, serverKey))
+	auth := &ClientAuthARD{Username: []byte("user"), Password: []byte("a password")}
+	if err := auth.Auth(conn); err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := conn.Next(128)
+	clientKey := new(big.Int).SetBytes(conn.Next(128))
+
+	// the server decrypts the credentials with its side of the shared secret
+	secret := leftPad(new(big.Int).Exp(clientKey, serverPrivate, prime).Bytes(), 128)
+	key := md5.Sum(secret)
+	cipher, err := aes.NewCipher(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials := make([]byte, len(ciphertext))
+	for i := 0; i < len(ciphertext); i += aes.BlockSize {
+		cipher.Decrypt(credentials[i:], ciphertext[i:])
+	}
+	username := credentials[:bytes.IndexByte(credentials, 0)]
+	password := credentials[64 : 64+bytes.IndexByte(credentials[64:], 0)]
+	if string(username) != "user" || string(password) != "a password" {
+		t.Fatalf("server decrypted %q/%q", username, password)
+	}
+}
+
+func TestClientAuthARDTooLong(t *testing.T) {
+	auth := &ClientAuthARD{Username: bytes.Repeat([]byte("u"), 64)}
+	if err := auth.Auth(&bufferConn{}); err == nil {
+		t.Fatal("accepted a 64 byte username")
+	}
+}
@@ -29,16 +29,25 @@ func charCodeAt(s string, n int) rune {
 }
 
 func (auth *ClientAuthATEN) Auth(c Conn) error {
+	nt, err := readTightTunnels(c)
+	if err != nil {
+		return err
+	}
+	return auth.authTunnels(c, nt)
+}
+
+// isATENTunnelCount tells whether the Tight tunnel count is an ATEN iKVM one
+func isATENTunnelCount(nt uint32) bool {
+	return ((nt&0xffff0ff0)>>0 == 0xaff90fb0) || (nt <= 0 || nt > 0x1000000)
+}
+
+// authTunnels authenticates after the tunnel count
+func (auth *ClientAuthATEN) authTunnels(c Conn, nt uint32) error {
 	var definedAuthLen = 24
 
 	if len(auth.Username) > definedAuthLen || len(auth.Password) > definedAuthLen {
 		return fmt.Errorf("username/password is too long, allowed 0-23")
 	}
-
-	nt, err := readTightTunnels(c)
-	if err != nil {
-		return err
-	}
 	/*
 		fmt.Printf("tunnels %d\n", nt)
 		for i := uint32(0); i < nt; i++ {
@@ -49,7 +58,7 @@ func (auth *ClientAuthATEN) Auth(c Conn) error {
 			fmt.Printf("code %d vendor %s signature %s\n", code, vendor, signature)
 		}
 	*/
-	if ((nt&0xffff0ff0)>>0 == 0xaff90fb0) || (nt <= 0 || nt > 0x1000000) {
+	if isATENTunnelCount(nt) {
 		c.SetProtoVersion("aten1")
 		var skip [20]byte
 		binary.Read(c, binary.BigEndian, &skip)
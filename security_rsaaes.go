@@ -0,0 +1,412 @@
+package vnc2video
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"net"
+)
+
+// RSA-AES key lengths in bits
+const (
+	rsaaesMinKeyLength    = 1024
+	rsaaesMaxKeyLength    = 8192
+	rsaaesClientKeyLength = 2048
+)
+
+// rsaaesMaxMessageSize limits the plain text of an encrypted message
+const rsaaesMaxMessageSize = 8192
+
+// RSA-AES credential sub types
+const (
+	rsaaesSubTypeUserPass = 1
+	rsaaesSubTypePass     = 2
+)
+
+// ClientAuthRSAAES is the RSA-AES security of TigerVNC and RealVNC servers. Both ends exchange
+// RSA keys and random session keys, then the credentials are sent encrypted with AES-EAX. The RA2
+// and RA256 types keep encrypting the whole connection after the handshake, the RA2ne and
+// RAne256 types only the handshake.
+type ClientAuthRSAAES struct {
+	// SecType is SecTypeRA2, SecTypeRA2ne, SecTypeRA256 or SecTypeRAne256, SecTypeRA2 when zero
+	SecType  SecurityType
+	Username []byte
+	Password []byte
+	// VerifyServerKey checks the server public key before the credentials are sent, the
+	// fingerprint is the 8 byte one TigerVNC viewers show (see RSAAESFingerprint). Any key is
+	// accepted when nil.
+	VerifyServerKey func(key *rsa.PublicKey, fingerprint []byte) error
+	// rand is the source of the keys and random data, crypto/rand when nil
+	rand io.Reader
+	// clientKey is the client RSA key, generated when nil
+	clientKey *rsa.PrivateKey
+}
+
+func (auth *ClientAuthRSAAES) Type() SecurityType {
+	if auth.SecType == SecTypeUnknown {
+		return SecTypeRA2
+	}
+	return auth.SecType
+}
+
+func (*ClientAuthRSAAES) SubType() SecuritySubType {
+	return SecSubTypeUnknown
+}
+
+// RSAAESFingerprint returns the fingerprint of an RSA-AES public key, as sent by the server
+func RSAAESFingerprint(key []byte) []byte {
+	sum := sha1.Sum(key)
+	return sum[:8]
+}
+
+func (auth *ClientAuthRSAAES) Auth(c Conn) error {
+	if len(auth.Username) > 255 || len(auth.Password) > 255 {
+		return fmt.Errorf("username/password is too long, allowed 0-255")
+	}
+	random := auth.rand
+	if random == nil {
+		random = rand.Reader
+	}
+	keySize, newHash := 16, sha1.New
+	switch auth.Type() {
+	case SecTypeRA2, SecTypeRA2ne:
+	case SecTypeRA256, SecTypeRAne256:
+		keySize, newHash = 32, sha256.New
+	default:
+		return fmt.Errorf("RSA-AES: unsupported security type %v", auth.Type())
+	}
+
+	serverKey, serverKeyData, err := readRSAAESPublicKey(c)
+	if err != nil {
+		return err
+	}
+	if auth.VerifyServerKey != nil {
+		if err := auth.VerifyServerKey(serverKey, RSAAESFingerprint(serverKeyData)); err != nil {
+			return fmt.Errorf("RSA-AES: server key rejected: %v", err)
+		}
+	}
+
+	clientKey := auth.clientKey
+	if clientKey == nil {
+		if clientKey, err = rsa.GenerateKey(random, rsaaesClientKeyLength); err != nil {
+			return err
+		}
+	}
+	clientKeyData := rsaaesPublicKey(&clientKey.PublicKey)
+	if err := binary.Write(c, binary.BigEndian, clientKeyData); err != nil {
+		return err
+	}
+
+	clientRandom := make([]byte, keySize)
+	if _, err := io.ReadFull(random, clientRandom); err != nil {
+		return err
+	}
+	encrypted, err := rsa.EncryptPKCS1v15(random, serverKey, clientRandom)
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, uint16(len(encrypted))); err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, encrypted); err != nil {
+		return err
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+
+	var length uint16
+	if err := binary.Read(c, binary.BigEndian, &length); err != nil {
+		return err
+	}
+	if int(length) != clientKey.Size() {
+		return fmt.Errorf("RSA-AES: invalid server random length %d", length)
+	}
+	encrypted = make([]byte, length)
+	if err := binary.Read(c, binary.BigEndian, &encrypted); err != nil {
+		return err
+	}
+	serverRandom, err := rsa.DecryptPKCS1v15(random, clientKey, encrypted)
+	if err != nil {
+		return fmt.Errorf("RSA-AES: can't decrypt the server random: %v", err)
+	}
+	if len(serverRandom) != keySize {
+		return fmt.Errorf("RSA-AES: invalid server random length %d", len(serverRandom))
+	}
+
+	clientSessionKey := rsaaesHash(newHash, serverRandom, clientRandom)[:keySize]
+	serverSessionKey := rsaaesHash(newHash, clientRandom, serverRandom)[:keySize]
+	stream, err := newEAXStream(c, c, clientSessionKey, serverSessionKey)
+	if err != nil {
+		return err
+	}
+
+	// both ends hash the keys they know of, which a man in the middle can't make match
+	if _, err := stream.Write(rsaaesHash(newHash, clientKeyData, serverKeyData)); err != nil {
+		return err
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	serverHash := make([]byte, newHash().Size())
+	if _, err := io.ReadFull(stream, serverHash); err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(serverHash, rsaaesHash(newHash, serverKeyData, clientKeyData)) != 1 {
+		return errors.New("RSA-AES: server key hash mismatch")
+	}
+
+	var subType uint8
+	if err := binary.Read(stream, binary.BigEndian, &subType); err != nil {
+		return err
+	}
+	credentials := &bytes.Buffer{}
+	switch subType {
+	case rsaaesSubTypeUserPass:
+		credentials.WriteByte(uint8(len(auth.Username)))
+		credentials.Write(auth.Username)
+	case rsaaesSubTypePass:
+		credentials.WriteByte(0)
+	default:
+		return fmt.Errorf("RSA-AES: unsupported sub type %d", subType)
+	}
+	credentials.WriteByte(uint8(len(auth.Password)))
+	credentials.Write(auth.Password)
+	if _, err := stream.Write(credentials.Bytes()); err != nil {
+		return err
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+
+	if auth.Type() == SecTypeRA2ne || auth.Type() == SecTypeRAne256 {
+		return nil
+	}
+	setter, ok := c.(connSetter)
+	if !ok {
+		return fmt.Errorf("RSA-AES: %T can't be encrypted", c)
+	}
+	raw := c.Conn()
+	stream.in, stream.out = raw, raw
+	return setter.SetConn(&rsaaesConn{Conn: raw, stream: stream})
+}
+
+// readRSAAESPublicKey reads a public key, returning it with its data
+func readRSAAESPublicKey(c Conn) (*rsa.PublicKey, []byte, error) {
+	var bits uint32
+	if err := binary.Read(c, binary.BigEndian, &bits); err != nil {
+		return nil, nil, err
+	}
+	if bits < rsaaesMinKeyLength || bits > rsaaesMaxKeyLength {
+		return nil, nil, fmt.Errorf("RSA-AES: invalid server key length %d", bits)
+	}
+	size := (bits + 7) / 8
+	data := make([]byte, 4+2*size)
+	binary.BigEndian.PutUint32(data, bits)
+	if err := binary.Read(c, binary.BigEndian, data[4:]); err != nil {
+		return nil, nil, err
+	}
+	e := new(big.Int).SetBytes(data[4+size:])
+	if !e.IsInt64() || e.Int64() < 2 || e.Int64() > 1<<31-1 {
+		return nil, nil, fmt.Errorf("RSA-AES: unsupported server key exponent %v", e)
+	}
+	key := &rsa.PublicKey{N: new(big.Int).SetBytes(data[4 : 4+size]), E: int(e.Int64())}
+	return key, data, nil
+}
+
+// rsaaesPublicKey returns the data of a public key: its length in bits, the modulus and the
+// exponent, both of the modulus size
+func rsaaesPublicKey(key *rsa.PublicKey) []byte {
+	size := key.Size()
+	data := make([]byte, 4, 4+2*size)
+	binary.BigEndian.PutUint32(data, uint32(key.N.BitLen()))
+	data = append(data, leftPad(key.N.Bytes(), size)...)
+	return append(data, leftPad(big.NewInt(int64(key.E)).Bytes(), size)...)
+}
+
+func rsaaesHash(newHash func() hash.Hash, data ...[]byte) []byte {
+	h := newHash()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// eaxStream reads and writes AES-EAX encrypted messages: a 2 byte length, also authenticated,
+// the cipher text and a 16 byte tag. The nonces are little endian message counters.
+type eaxStream struct {
+	in          io.Reader
+	out         io.Writer
+	readCipher  cipher.Block
+	writeCipher cipher.Block
+	readNonce   [aes.BlockSize]byte
+	writeNonce  [aes.BlockSize]byte
+	plain       []byte
+}
+
+func newEAXStream(in io.Reader, out io.Writer, writeKey, readKey []byte) (*eaxStream, error) {
+	writeCipher, err := aes.NewCipher(writeKey)
+	if err != nil {
+		return nil, err
+	}
+	readCipher, err := aes.NewCipher(readKey)
+	if err != nil {
+		return nil, err
+	}
+	return &eaxStream{in: in, out: out, readCipher: readCipher, writeCipher: writeCipher}, nil
+}
+
+func (s *eaxStream) Read(buf []byte) (int, error) {
+	if len(s.plain) == 0 {
+		var header [2]byte
+		if _, err := io.ReadFull(s.in, header[:]); err != nil {
+			return 0, err
+		}
+		message := make([]byte, int(binary.BigEndian.Uint16(header[:]))+aes.BlockSize)
+		if _, err := io.ReadFull(s.in, message); err != nil {
+			return 0, err
+		}
+		tagStart := len(message) - aes.BlockSize
+		plain, err := eaxOpen(s.readCipher, s.readNonce[:], header[:], message[:tagStart], message[tagStart:])
+		if err != nil {
+			return 0, err
+		}
+		incrementNonce(&s.readNonce)
+		s.plain = plain
+	}
+	n := copy(buf, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+func (s *eaxStream) Write(buf []byte) (int, error) {
+	written := 0
+	for len(buf) > 0 {
+		n := len(buf)
+		if n > rsaaesMaxMessageSize {
+			n = rsaaesMaxMessageSize
+		}
+		message := make([]byte, 2, 2+n+aes.BlockSize)
+		binary.BigEndian.PutUint16(message, uint16(n))
+		message = append(message, eaxSeal(s.writeCipher, s.writeNonce[:], message[:2], buf[:n])...)
+		if _, err := s.out.Write(message); err != nil {
+			return written, err
+		}
+		incrementNonce(&s.writeNonce)
+		written += n
+		buf = buf[n:]
+	}
+	return written, nil
+}
+
+func incrementNonce(nonce *[aes.BlockSize]byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// rsaaesConn encrypts a connection after the RSA-AES handshake
+type rsaaesConn struct {
+	net.Conn
+	stream *eaxStream
+}
+
+func (c *rsaaesConn) Read(buf []byte) (int, error) {
+	return c.stream.Read(buf)
+}
+
+func (c *rsaaesConn) Write(buf []byte) (int, error) {
+	return c.stream.Write(buf)
+}
+
+// eaxSeal returns the cipher text followed by the tag
+func eaxSeal(block cipher.Block, nonce, header, plain []byte) []byte {
+	n := eaxOMAC(block, 0, nonce)
+	h := eaxOMAC(block, 1, header)
+	out := make([]byte, len(plain), len(plain)+aes.BlockSize)
+	cipher.NewCTR(block, n).XORKeyStream(out, plain)
+	tag := eaxOMAC(block, 2, out)
+	for i := range tag {
+		tag[i] ^= n[i] ^ h[i]
+	}
+	return append(out, tag...)
+}
+
+// eaxOpen returns the plain text of an authenticated cipher text
+func eaxOpen(block cipher.Block, nonce, header, ciphertext, tag []byte) ([]byte, error) {
+	n := eaxOMAC(block, 0, nonce)
+	h := eaxOMAC(block, 1, header)
+	expected := eaxOMAC(block, 2, ciphertext)
+	for i := range expected {
+		expected[i] ^= n[i] ^ h[i]
+	}
+	if subtle.ConstantTimeCompare(expected, tag) != 1 {
+		return nil, errors.New("RSA-AES: message authentication failed")
+	}
+	plain := make([]byte, len(ciphertext))
+	cipher.NewCTR(block, n).XORKeyStream(plain, ciphertext)
+	return plain, nil
+}
+
+// eaxOMAC is the CMAC of the block holding t followed by the data
+func eaxOMAC(block cipher.Block, t byte, data []byte) []byte {
+	k1 := make([]byte, aes.BlockSize)
+	block.Encrypt(k1, k1)
+	k1 = cmacDouble(k1)
+	k2 := cmacDouble(k1)
+
+	message := make([]byte, aes.BlockSize, aes.BlockSize+len(data))
+	message[aes.BlockSize-1] = t
+	message = append(message, data...)
+	blocks := (len(message) + aes.BlockSize - 1) / aes.BlockSize
+	last := make([]byte, aes.BlockSize)
+	rest := copy(last, message[(blocks-1)*aes.BlockSize:])
+	key := k1
+	if rest < aes.BlockSize {
+		last[rest] = 0x80
+		key = k2
+	}
+
+	mac := make([]byte, aes.BlockSize)
+	for i := 0; i < blocks-1; i++ {
+		xorBlock(mac, message[i*aes.BlockSize:])
+		block.Encrypt(mac, mac)
+	}
+	xorBlock(mac, last)
+	xorBlock(mac, key)
+	block.Encrypt(mac, mac)
+	return mac
+}
+
+// cmacDouble multiplies by x in GF(2^128)
+func cmacDouble(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i := 0; i < len(b)-1; i++ {
+		out[i] = b[i]<<1 | b[i+1]>>7
+	}
+	out[len(b)-1] = b[len(b)-1] << 1
+	if b[0]&0x80 != 0 {
+		out[len(b)-1] ^= 0x87
+	}
+	return out
+}
+
+func xorBlock(dst, src []byte) {
+	for i := 0; i < aes.BlockSize; i++ {
+		dst[i] ^= src[i]
+	}
+}
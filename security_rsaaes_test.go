@@ -0,0 +1,224 @@
+package vnc2video
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestEAXVectors(t *testing.T) {
+	// from the EAX paper by Bellare, Rogaway and Wagner
+	for _, v := range []struct{ msg, key, nonce, header, cipher string }{
+		{"", "233952DEE4D5ED5F9B9C6D6FF80FF478", "62EC67F9C3A4A407FCB2A8C49031A8B3", "6BFB914FD07EAE6B", "E037830E8389F27B025A2D6527E79D01"},
+		{"F7FB", "91945D3F4DCBEE0BF45EF52255F095A4", "BECAF043B0A23D843194BA972C66DEBD", "FA3BFD4806EB53FA", "19DD5C4C9331049D0BDAB0277408F67967E5"},
+		{"1A47CB4933", "01F74AD64077F2E704C0F60ADA3DD523", "70C3DB4F0D26368400A10ED05D2BFF5E", "234A3463C1264AC6", "D851D5BAE03A59F238A23E39199DC9266626C40F80"},
+	} {
+		decode := func(s string) []byte {
+			b, err := hex.DecodeString(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return b
+		}
+		block, err := aes.NewCipher(decode(v.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed := eaxSeal(block, decode(v.nonce), decode(v.header), decode(v.msg))
+		if !bytes.Equal(sealed, decode(v.cipher)) {
+			t.Errorf("sealed %X, want %s", sealed, v.cipher)
+		}
+		tagStart := len(sealed) - aes.BlockSize
+		plain, err := eaxOpen(block, decode(v.nonce), decode(v.header), sealed[:tagStart], sealed[tagStart:])
+		if err != nil || !bytes.Equal(plain, decode(v.msg)) {
+			t.Errorf("opened %X, err %v", plain, err)
+		}
+		sealed[0] ^= 1
+		if _, err := eaxOpen(block, decode(v.nonce), decode(v.header), sealed[:tagStart], sealed[tagStart:]); err == nil {
+			t.Errorf("opened a modified message")
+		}
+	}
+}
+
+// fakeRSAAESServer runs the server side of an RSA-AES handshake asking for a username and a
+// password, returning them. It reads before writing, net.Pipe doesn't buffer.
+func fakeRSAAESServer(conn net.Conn, secType SecurityType, key *rsa.PrivateKey, creds chan<- string, errs chan<- error) {
+	err := func() error {
+		keySize, newHash := 16, sha1.New
+		if secType == SecTypeRA256 || secType == SecTypeRAne256 {
+			keySize, newHash = 32, sha256.New
+		}
+		if _, err := conn.Write([]byte{1, uint8(secType)}); err != nil {
+			return err
+		}
+		var chosen [1]byte
+		if _, err := io.ReadFull(conn, chosen[:]); err != nil {
+			return err
+		}
+		serverKeyData := rsaaesPublicKey(&key.PublicKey)
+		if _, err := conn.Write(serverKeyData); err != nil {
+			return err
+		}
+
+		var bits uint32
+		if err := binary.Read(conn, binary.BigEndian, &bits); err != nil {
+			return err
+		}
+		clientKeyData := make([]byte, 4+2*((bits+7)/8))
+		binary.BigEndian.PutUint32(clientKeyData, bits)
+		if _, err := io.ReadFull(conn, clientKeyData[4:]); err != nil {
+			return err
+		}
+		keyConn := &bufferConn{}
+		keyConn.Write(clientKeyData)
+		clientKey, _, err := readRSAAESPublicKey(keyConn)
+		if err != nil {
+			return err
+		}
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return err
+		}
+		encrypted := make([]byte, length)
+		if _, err := io.ReadFull(conn, encrypted); err != nil {
+			return err
+		}
+		clientRandom, err := rsa.DecryptPKCS1v15(rand.Reader, key, encrypted)
+		if err != nil {
+			return err
+		}
+		serverRandom := make([]byte, keySize)
+		rand.Read(serverRandom)
+		if encrypted, err = rsa.EncryptPKCS1v15(rand.Reader, clientKey, serverRandom); err != nil {
+			return err
+		}
+		binary.Write(conn, binary.BigEndian, uint16(len(encrypted)))
+		conn.Write(encrypted)
+
+		stream, err := newEAXStream(conn, conn, rsaaesHash(newHash, clientRandom, serverRandom)[:keySize], rsaaesHash(newHash, serverRandom, clientRandom)[:keySize])
+		if err != nil {
+			return err
+		}
+		clientHash := make([]byte, newHash().Size())
+		if _, err := io.ReadFull(stream, clientHash); err != nil {
+			return err
+		}
+		if !bytes.Equal(clientHash, rsaaesHash(newHash, clientKeyData, serverKeyData)) {
+			return errors.New("client hash mismatch")
+		}
+		stream.Write(rsaaesHash(newHash, serverKeyData, clientKeyData))
+		stream.Write([]byte{rsaaesSubTypeUserPass})
+
+		var cred [256]byte
+		if _, err := io.ReadFull(stream, cred[:1]); err != nil {
+			return err
+		}
+		username := make([]byte, cred[0])
+		if _, err := io.ReadFull(stream, username); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(stream, cred[:1]); err != nil {
+			return err
+		}
+		password := make([]byte, cred[0])
+		if _, err := io.ReadFull(stream, password); err != nil {
+			return err
+		}
+		creds <- string(username) + ":" + string(password)
+
+		// security result, then the first server init bytes
+		if secType == SecTypeRA2ne || secType == SecTypeRAne256 {
+			_, err = conn.Write([]byte{0, 0, 0, 0, 'o', 'k'})
+		} else {
+			_, err = stream.Write([]byte{0, 0, 0, 0, 'o', 'k'})
+		}
+		return err
+	}()
+	errs <- err
+}
+
+func TestClientAuthRSAAES(t *testing.T) {
+	serverKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secType := range []SecurityType{SecTypeRA2, SecTypeRA2ne, SecTypeRA256, SecTypeRAne256} {
+		server, client := net.Pipe()
+		creds := make(chan string, 1)
+		errs := make(chan error, 1)
+		go fakeRSAAESServer(server, secType, serverKey, creds, errs)
+
+		var fingerprint []byte
+		auth := &ClientAuthRSAAES{
+			SecType:  secType,
+			Username: []byte("user"),
+			Password: []byte("secret"),
+			VerifyServerKey: func(key *rsa.PublicKey, f []byte) error {
+				fingerprint = f
+				return nil
+			},
+			clientKey: clientKey,
+		}
+		cc, err := NewClientConn(client, &ClientConfig{Encodings: []Encoding{&RawEncoding{}}, SecurityHandlers: []SecurityHandler{auth}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := (&DefaultClientSecurityHandler{}).Handle(cc); err != nil {
+			t.Fatalf("%v: %v", secType, err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatalf("%v: server error %v", secType, err)
+		}
+		if got := <-creds; got != "user:secret" {
+			t.Errorf("%v: server got credentials %q", secType, got)
+		}
+		if want := RSAAESFingerprint(rsaaesPublicKey(&serverKey.PublicKey)); !bytes.Equal(fingerprint, want) {
+			t.Errorf("%v: fingerprint %x, want %x", secType, fingerprint, want)
+		}
+		var rest [2]byte
+		if _, err := io.ReadFull(cc, rest[:]); err != nil || string(rest[:]) != "ok" {
+			t.Errorf("%v: read %q after the handshake, err %v", secType, rest, err)
+		}
+		cc.Close()
+		server.Close()
+	}
+}
+
+func TestClientAuthRSAAESRejectsServerKey(t *testing.T) {
+	serverKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	defer server.Close()
+	go fakeRSAAESServer(server, SecTypeRA2, serverKey, make(chan string, 1), make(chan error, 1))
+
+	auth := &ClientAuthRSAAES{
+		Username: []byte("user"),
+		Password: []byte("secret"),
+		VerifyServerKey: func(*rsa.PublicKey, []byte) error {
+			return errors.New("unknown key")
+		},
+	}
+	cc, err := NewClientConn(client, &ClientConfig{Encodings: []Encoding{&RawEncoding{}}, SecurityHandlers: []SecurityHandler{auth}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	if err := (&DefaultClientSecurityHandler{}).Handle(cc); err == nil {
+		t.Fatal("handshake succeeded with a rejected server key")
+	}
+}
@@ -1,6 +1,25 @@
 package vnc2video
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/amitbet/vnc2video/logger"
+)
+
+// Tight security capability codes
+const (
+	tightTunnelNone = 0
+	tightAuthNone   = 1
+	tightAuthVNC    = 2
+)
+
+// tightMaxCaps limits the capability lists, longer ones aren't TightVNC's
+const tightMaxCaps = 16
+
+// peeker is implemented by the connections that can look at data before reading it
+type peeker interface {
+	Peek(n int) ([]byte, error)
+}
 
 func readTightTunnels(c Conn) (uint32, error) {
 	var n uint32
@@ -25,3 +44,175 @@ func readTightCaps(c Conn) (int32, []byte, []byte, error) {
 	}
 	return code, vendor[:], signature[:], nil
 }
+
+// readTightCapList reads n capabilities, returning their codes
+func readTightCapList(c Conn, n uint32) ([]int32, error) {
+	codes := make([]int32, 0, n)
+	for i := uint32(0); i < n; i++ {
+		code, vendor, signature, err := readTightCaps(c)
+		if err != nil {
+			return nil, err
+		}
+		logger.Tracef("tight capability %d vendor %s signature %s", code, vendor, signature)
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// isTightVendor tells whether a capability vendor is one TightVNC servers use
+func isTightVendor(vendor []byte) bool {
+	switch string(vendor) {
+	case "TGHT", "STDV", "TRDV", "GGI_", "VENC":
+		return true
+	}
+	return false
+}
+
+// ClientAuthTight is the TightVNC security type, which negotiates tunneling (only no tunneling is
+// supported) and then the VNC or None authentication. ATEN iKVM servers use the same type number
+// with other data, they are told apart by the capability data and authenticated by ATEN when set.
+type ClientAuthTight struct {
+	// Password is used when the server asks for VNC authentication
+	Password []byte
+	// ATEN authenticates servers found to be ATEN iKVMs
+	ATEN *ClientAuthATEN
+	// tight is set when the server is a TightVNC one, which sends its capabilities after ServerInit
+	tight bool
+}
+
+func (*ClientAuthTight) Type() SecurityType {
+	return SecTypeTight
+}
+
+func (*ClientAuthTight) SubType() SecuritySubType {
+	return SecSubTypeUnknown
+}
+
+// isTight probes the data following the tunnel count: a TightVNC server sends capability lists
+// of known vendors, an ATEN iKVM its own data (see ClientAuthATEN).
+func (auth *ClientAuthTight) isTight(c Conn, numTunnels uint32) (bool, error) {
+	p, ok := c.(peeker)
+	if !ok {
+		return auth.ATEN == nil, nil
+	}
+	if numTunnels > 0 {
+		if isATENTunnelCount(numTunnels) {
+			return false, nil
+		}
+		if numTunnels > tightMaxCaps {
+			return false, nil
+		}
+		caps, err := p.Peek(16)
+		if err != nil {
+			return false, err
+		}
+		return isTightVendor(caps[4:8]), nil
+	}
+
+	// no tunnels, the auth capabilities follow
+	count, err := p.Peek(4)
+	if err != nil {
+		return false, err
+	}
+	numAuths := binary.BigEndian.Uint32(count)
+	if numAuths == 0 {
+		// no authentication looks like ATEN data
+		return auth.ATEN == nil, nil
+	}
+	if numAuths > tightMaxCaps {
+		return false, nil
+	}
+	caps, err := p.Peek(20)
+	if err != nil {
+		return false, err
+	}
+	return isTightVendor(caps[8:12]), nil
+}
+
+func (auth *ClientAuthTight) Auth(c Conn) error {
+	numTunnels, err := readTightTunnels(c)
+	if err != nil {
+		return err
+	}
+	auth.tight, err = auth.isTight(c, numTunnels)
+	if err != nil {
+		return err
+	}
+	if !auth.tight {
+		if auth.ATEN == nil {
+			return fmt.Errorf("Tight security: the server is an ATEN iKVM, ClientAuthTight.ATEN isn't set")
+		}
+		return auth.ATEN.authTunnels(c, numTunnels)
+	}
+
+	if numTunnels > 0 {
+		tunnels, err := readTightCapList(c, numTunnels)
+		if err != nil {
+			return err
+		}
+		if !hasTightCap(tunnels, tightTunnelNone) {
+			return fmt.Errorf("Tight security: tunneling is required, tunnels %v", tunnels)
+		}
+		if err := binary.Write(c, binary.BigEndian, uint32(tightTunnelNone)); err != nil {
+			return err
+		}
+		if err := c.Flush(); err != nil {
+			return err
+		}
+	}
+
+	var numAuths uint32
+	if err := binary.Read(c, binary.BigEndian, &numAuths); err != nil {
+		return err
+	}
+	if numAuths == 0 {
+		return nil
+	}
+	auths, err := readTightCapList(c, numAuths)
+	if err != nil {
+		return err
+	}
+	var authType int32
+	switch {
+	case len(auth.Password) > 0 && hasTightCap(auths, tightAuthVNC):
+		authType = tightAuthVNC
+	case hasTightCap(auths, tightAuthNone):
+		authType = tightAuthNone
+	default:
+		return fmt.Errorf("Tight security: no supported authentication in %v", auths)
+	}
+	if err := binary.Write(c, binary.BigEndian, authType); err != nil {
+		return err
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	if authType == tightAuthVNC {
+		return (&ClientAuthVNC{Password: auth.Password}).Auth(c)
+	}
+	return nil
+}
+
+func hasTightCap(codes []int32, code int32) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// readTightInteractionCaps reads the capabilities a TightVNC server sends after ServerInit
+func readTightInteractionCaps(c Conn) error {
+	caps := struct {
+		ServerMessagesNum uint16
+		ClientMessagesNum uint16
+		EncodingsNum      uint16
+		_                 [2]byte
+	}{}
+	if err := binary.Read(c, binary.BigEndian, &caps); err != nil {
+		return err
+	}
+	_, err := readTightCapList(c, uint32(caps.ServerMessagesNum)+uint32(caps.ClientMessagesNum)+uint32(caps.EncodingsNum))
+	return err
+}
@@ -0,0 +1,111 @@
+package vnc2video
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// tightCap returns a Tight capability
+func tightCap(code int32, vendor, signature string) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, code)
+	buf.WriteString(vendor)
+	buf.WriteString(signature)
+	return buf.Bytes()
+}
+
+// tightHandshake runs auth against a server sending hello, then replying with reply to the
+// client's first write of replyAfter bytes. It returns what the client wrote.
+func tightHandshake(t *testing.T, auth SecurityHandler, hello []byte, replyAfter int, reply []byte) ([]byte, *ClientConn, error) {
+	server, client := net.Pipe()
+	cc, err := NewClientConn(client, &ClientConfig{Encodings: []Encoding{&RawEncoding{}}, SecurityHandlers: []SecurityHandler{auth}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := make(chan []byte, 1)
+	go func() {
+		defer server.Close()
+		if _, err := server.Write(hello); err != nil {
+			written <- nil
+			return
+		}
+		buf := make([]byte, replyAfter)
+		if _, err := io.ReadFull(server, buf); err != nil {
+			written <- nil
+			return
+		}
+		server.Write(reply)
+		rest, _ := ioutil.ReadAll(server)
+		written <- append(buf, rest...)
+	}()
+	authErr := auth.Auth(cc)
+	client.Close()
+	return <-written, cc, authErr
+}
+
+func TestClientAuthTightVNC(t *testing.T) {
+	hello := &bytes.Buffer{}
+	binary.Write(hello, binary.BigEndian, uint32(1))
+	hello.Write(tightCap(tightTunnelNone, "TGHT", "NOTUNNEL"))
+	// the auth capabilities only follow the tunnel choice, but servers may send them at once
+	binary.Write(hello, binary.BigEndian, uint32(2))
+	hello.Write(tightCap(tightAuthNone, "STDV", "NOAUTH__"))
+	hello.Write(tightCap(tightAuthVNC, "STDV", "VNCAUTH_"))
+	challenge := []byte("0123456789abcdef")
+
+	auth := &ClientAuthTight{Password: []byte("secret")}
+	written, cc, err := tightHandshake(t, auth, hello.Bytes(), 8, challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &bytes.Buffer{}
+	binary.Write(want, binary.BigEndian, []uint32{tightTunnelNone, tightAuthVNC})
+	response, _ := AuthVNCEncode([]byte("secret"), challenge)
+	want.Write(response)
+	if !bytes.Equal(written, want.Bytes()) {
+		t.Fatalf("client wrote %x, want %x", written, want.Bytes())
+	}
+	if !auth.tight || cc.Protocol() == "aten1" {
+		t.Fatalf("server not detected as TightVNC")
+	}
+}
+
+func TestClientAuthTightNone(t *testing.T) {
+	hello := &bytes.Buffer{}
+	binary.Write(hello, binary.BigEndian, []uint32{0, 1})
+	hello.Write(tightCap(tightAuthNone, "STDV", "NOAUTH__"))
+
+	auth := &ClientAuthTight{Password: []byte("secret")}
+	written, _, err := tightHandshake(t, auth, hello.Bytes(), 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0, 0, 0, tightAuthNone}; !bytes.Equal(written, want) {
+		t.Fatalf("client wrote %x, want %x", written, want)
+	}
+}
+
+func TestClientAuthTightATEN(t *testing.T) {
+	// ATEN iKVMs send a tunnel count with their magic, then 20 bytes
+	hello := append([]byte{0xaf, 0xf9, 0x0f, 0xb0}, make([]byte, 20)...)
+
+	auth := &ClientAuthTight{ATEN: &ClientAuthATEN{Username: []byte("admin"), Password: []byte("pass")}}
+	written, cc, err := tightHandshake(t, auth, hello, 48, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.tight || cc.Protocol() != "aten1" {
+		t.Fatalf("server not detected as ATEN")
+	}
+	if !bytes.HasPrefix(written, []byte("admin\x00")) || !bytes.HasPrefix(written[24:], []byte("pass\x00")) {
+		t.Fatalf("client wrote %q", written)
+	}
+
+	if _, _, err := tightHandshake(t, &ClientAuthTight{}, hello, 0, nil); err == nil {
+		t.Fatal("authenticated an ATEN server without ATEN credentials")
+	}
+}
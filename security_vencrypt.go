@@ -0,0 +1,363 @@
+package vnc2video
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// vencryptMaxCredentialLength limits the username and password sizes a server accepts
+const vencryptMaxCredentialLength = 1024
+
+// connSetter is implemented by the connections whose net.Conn can be replaced
+type connSetter interface {
+	SetConn(net.Conn) error
+}
+
+// vencryptTLS tells whether a VeNCrypt sub type runs over TLS, and whether it verifies certificates
+func vencryptTLS(subType SecuritySubType) (useTLS bool, x509 bool) {
+	switch subType {
+	case SecSubTypeVeNCrypt02TLSNone, SecSubTypeVeNCrypt02TLSVNC, SecSubTypeVeNCrypt02TLSPlain:
+		return true, false
+	case SecSubTypeVeNCrypt02X509None, SecSubTypeVeNCrypt02X509VNC, SecSubTypeVeNCrypt02X509Plain:
+		return true, true
+	}
+	return false, false
+}
+
+// upgradeTLS replaces the connection's net.Conn with the TLS stream started by newTLS
+func upgradeTLS(c Conn, newTLS func(net.Conn) *tls.Conn) error {
+	setter, ok := c.(connSetter)
+	if !ok {
+		return fmt.Errorf("VeNCrypt: %T can't be upgraded to TLS", c)
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	tlsConn := newTLS(c.Conn())
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("VeNCrypt: TLS handshake failed: %v", err)
+	}
+	return setter.SetConn(tlsConn)
+}
+
+// ClientAuthVeNCrypt is the VeNCrypt 0.2 security type, see
+// https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#vencrypt
+//
+// The X509 sub types verify the server certificate with TLSConfig (RootCAs for a custom CA pool,
+// ServerName for the expected host). The TLS sub types use anonymous Diffie-Hellman, which
+// crypto/tls doesn't implement, so they are not supported: the handshake fails with an
+// "anonymous TLS not supported" error when the server offers nothing else, as QEMU and TigerVNC
+// servers do unless they are set up with x509 certificates.
+type ClientAuthVeNCrypt struct {
+	// SubTypes are the accepted sub types in order of preference, when empty the X509 sub types
+	// the credentials allow are accepted.
+	SubTypes  []SecuritySubType
+	TLSConfig *tls.Config
+	Username  []byte
+	Password  []byte
+	subType   SecuritySubType
+}
+
+func (*ClientAuthVeNCrypt) Type() SecurityType {
+	return SecTypeVeNCrypt
+}
+
+// SubType returns the negotiated sub type
+func (auth *ClientAuthVeNCrypt) SubType() SecuritySubType {
+	return auth.subType
+}
+
+// subTypes returns the accepted sub types in order of preference
+func (auth *ClientAuthVeNCrypt) subTypes() []SecuritySubType {
+	if len(auth.SubTypes) > 0 {
+		return auth.SubTypes
+	}
+	var subTypes []SecuritySubType
+	for _, subType := range []SecuritySubType{
+		SecSubTypeVeNCrypt02X509Plain, SecSubTypeVeNCrypt02X509VNC, SecSubTypeVeNCrypt02X509None,
+	} {
+		switch subType {
+		case SecSubTypeVeNCrypt02X509Plain:
+			if len(auth.Username) == 0 {
+				continue
+			}
+		case SecSubTypeVeNCrypt02X509VNC:
+			if len(auth.Password) == 0 {
+				continue
+			}
+		}
+		subTypes = append(subTypes, subType)
+	}
+	return subTypes
+}
+
+func (auth *ClientAuthVeNCrypt) Auth(c Conn) error {
+	var version [2]uint8
+	if err := binary.Read(c, binary.BigEndian, &version); err != nil {
+		return err
+	}
+	if version[0] != 0 || version[1] < 2 {
+		binary.Write(c, binary.BigEndian, []uint8{0, 0})
+		c.Flush()
+		return fmt.Errorf("VeNCrypt: unsupported version %d.%d", version[0], version[1])
+	}
+	if err := binary.Write(c, binary.BigEndian, []uint8{0, 2}); err != nil {
+		return err
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	var status uint8
+	if err := binary.Read(c, binary.BigEndian, &status); err != nil {
+		return err
+	}
+	if status != 0 {
+		return fmt.Errorf("VeNCrypt: server rejected version 0.2")
+	}
+
+	var numSubTypes uint8
+	if err := binary.Read(c, binary.BigEndian, &numSubTypes); err != nil {
+		return err
+	}
+	serverSubTypes := make([]SecuritySubType, numSubTypes)
+	if err := binary.Read(c, binary.BigEndian, &serverSubTypes); err != nil {
+		return err
+	}
+	auth.subType = SecSubTypeVeNCrypt02Unknown
+	chosen := SecSubTypeVeNCrypt02Unknown
+	for _, subType := range auth.subTypes() {
+		for _, st := range serverSubTypes {
+			if subType == st && chosen == SecSubTypeVeNCrypt02Unknown {
+				chosen = subType
+			}
+		}
+	}
+	if chosen == SecSubTypeVeNCrypt02Unknown {
+		for _, st := range serverSubTypes {
+			if useTLS, x509 := vencryptTLS(st); useTLS && !x509 {
+				return fmt.Errorf("VeNCrypt: no accepted sub type in %v, anonymous TLS not supported", serverSubTypes)
+			}
+		}
+		return fmt.Errorf("VeNCrypt: no accepted sub type in %v", serverSubTypes)
+	}
+	if useTLS, x509 := vencryptTLS(chosen); useTLS && !x509 {
+		return fmt.Errorf("VeNCrypt: anonymous TLS not supported, can't use sub type %v", chosen)
+	}
+	auth.subType = chosen
+	if err := binary.Write(c, binary.BigEndian, auth.subType); err != nil {
+		return err
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	var accepted uint8
+	if err := binary.Read(c, binary.BigEndian, &accepted); err != nil {
+		return err
+	}
+	if accepted != 1 {
+		return fmt.Errorf("VeNCrypt: server rejected sub type %v", auth.subType)
+	}
+
+	if useTLS, _ := vencryptTLS(auth.subType); useTLS {
+		cfg := &tls.Config{}
+		if auth.TLSConfig != nil {
+			cfg = auth.TLSConfig.Clone()
+		}
+		if cfg.ServerName == "" && !cfg.InsecureSkipVerify {
+			if host, _, err := net.SplitHostPort(c.Conn().RemoteAddr().String()); err == nil {
+				cfg.ServerName = host
+			}
+		}
+		if cc, ok := c.(*ClientConn); ok && cc.x509Subject != "" {
+			cfg.VerifyPeerCertificate = verifyRedirectSubject(cfg.VerifyPeerCertificate, cc.x509Subject)
+		}
+		if err := upgradeTLS(c, func(conn net.Conn) *tls.Conn { return tls.Client(conn, cfg) }); err != nil {
+			return err
+		}
+	}
+
+	switch auth.subType {
+	case SecSubTypeVeNCrypt02TLSVNC, SecSubTypeVeNCrypt02X509VNC:
+		return (&ClientAuthVNC{Password: auth.Password}).Auth(c)
+	case SecSubTypeVeNCrypt02Plain, SecSubTypeVeNCrypt02TLSPlain, SecSubTypeVeNCrypt02X509Plain:
+		return auth.plainAuth(c)
+	}
+	return nil
+}
+
+// plainAuth sends the username and password
+func (auth *ClientAuthVeNCrypt) plainAuth(c Conn) error {
+	if len(auth.Username) == 0 {
+		return fmt.Errorf("Security Handshake failed; no username provided for VeNCrypt plain auth.")
+	}
+	if err := binary.Write(c, binary.BigEndian, []uint32{uint32(len(auth.Username)), uint32(len(auth.Password))}); err != nil {
+		return err
+	}
+	if _, err := c.Write(auth.Username); err != nil {
+		return err
+	}
+	if _, err := c.Write(auth.Password); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+// CredentialVerifier checks the username and password of VeNCrypt plain authentication
+type CredentialVerifier interface {
+	Verify(username, password []byte) error
+}
+
+// CredentialVerifierFunc is a function used as a CredentialVerifier
+type CredentialVerifierFunc func(username, password []byte) error
+
+// Verify calls f(username, password)
+func (f CredentialVerifierFunc) Verify(username, password []byte) error {
+	return f(username, password)
+}
+
+// ServerAuthVeNCrypt is the server side of the VeNCrypt 0.2 security type. It offers the sub
+// types the credential checks allow: X509Plain when Verifier is set, X509VNC when Password is
+// set, and X509None when neither is. They need TLSConfig with the server certificate and aren't
+// offered without it. The anonymous TLS sub types are never offered: crypto/tls has no anonymous
+// Diffie-Hellman, and clients choosing them, such as TigerVNC and QEMU, expect it.
+type ServerAuthVeNCrypt struct {
+	// SubTypes are the offered sub types in order of preference, instead of the default ones.
+	// Listing X509None or Plain lets clients in without the credential checks they skip.
+	SubTypes  []SecuritySubType
+	TLSConfig *tls.Config
+	// Verifier checks the plain authentication credentials
+	Verifier CredentialVerifier
+	// Password is the VNC authentication password
+	Password []byte
+}
+
+func (*ServerAuthVeNCrypt) Type() SecurityType {
+	return SecTypeVeNCrypt
+}
+
+// SubType returns SecSubTypeVeNCrypt02Unknown, the handler is shared by the server connections
+// which negotiate their own sub types
+func (*ServerAuthVeNCrypt) SubType() SecuritySubType {
+	return SecSubTypeVeNCrypt02Unknown
+}
+
+// subTypes returns the offered sub types in order of preference, the X509 ones only when there
+// is a TLSConfig and the anonymous TLS ones never
+func (auth *ServerAuthVeNCrypt) subTypes() []SecuritySubType {
+	subTypes := auth.SubTypes
+	if len(subTypes) == 0 {
+		if auth.Verifier != nil {
+			subTypes = append(subTypes, SecSubTypeVeNCrypt02X509Plain)
+		}
+		if len(auth.Password) > 0 {
+			subTypes = append(subTypes, SecSubTypeVeNCrypt02X509VNC)
+		}
+		// without credentials to check, clients only get TLS
+		if auth.Verifier == nil && len(auth.Password) == 0 {
+			subTypes = append(subTypes, SecSubTypeVeNCrypt02X509None)
+		}
+	}
+	var offered []SecuritySubType
+	for _, subType := range subTypes {
+		if useTLS, x509 := vencryptTLS(subType); useTLS && (!x509 || auth.TLSConfig == nil) {
+			continue
+		}
+		offered = append(offered, subType)
+	}
+	return offered
+}
+
+func (auth *ServerAuthVeNCrypt) Auth(c Conn) error {
+	if err := binary.Write(c, binary.BigEndian, []uint8{0, 2}); err != nil {
+		return err
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	var version [2]uint8
+	if err := binary.Read(c, binary.BigEndian, &version); err != nil {
+		return err
+	}
+	if version != [2]uint8{0, 2} {
+		binary.Write(c, binary.BigEndian, uint8(1))
+		c.Flush()
+		return fmt.Errorf("VeNCrypt: unsupported client version %d.%d", version[0], version[1])
+	}
+
+	subTypes := auth.subTypes()
+	if err := binary.Write(c, binary.BigEndian, []uint8{0, uint8(len(subTypes))}); err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, subTypes); err != nil {
+		return err
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	if len(subTypes) == 0 {
+		return errors.New("VeNCrypt: no sub type to offer, the default ones need a TLS config")
+	}
+	var subType SecuritySubType
+	if err := binary.Read(c, binary.BigEndian, &subType); err != nil {
+		return err
+	}
+	offered := false
+	for _, st := range subTypes {
+		offered = offered || st == subType
+	}
+	if !offered {
+		binary.Write(c, binary.BigEndian, uint8(0))
+		c.Flush()
+		return fmt.Errorf("VeNCrypt: client chose sub type %v which wasn't offered", subType)
+	}
+	if err := binary.Write(c, binary.BigEndian, uint8(1)); err != nil {
+		return err
+	}
+
+	if useTLS, _ := vencryptTLS(subType); useTLS {
+		if err := upgradeTLS(c, func(conn net.Conn) *tls.Conn { return tls.Server(conn, auth.TLSConfig) }); err != nil {
+			return err
+		}
+	} else if err := c.Flush(); err != nil {
+		return err
+	}
+
+	switch subType {
+	case SecSubTypeVeNCrypt02TLSVNC, SecSubTypeVeNCrypt02X509VNC:
+		challenge := make([]byte, 16)
+		if _, err := rand.Read(challenge); err != nil {
+			return err
+		}
+		return (&ServerAuthVNC{Challenge: challenge, Password: auth.Password}).Auth(c)
+	case SecSubTypeVeNCrypt02Plain, SecSubTypeVeNCrypt02TLSPlain, SecSubTypeVeNCrypt02X509Plain:
+		return auth.plainAuth(c)
+	}
+	return nil
+}
+
+// plainAuth reads the username and password and checks them with the Verifier
+func (auth *ServerAuthVeNCrypt) plainAuth(c Conn) error {
+	var lengths [2]uint32
+	if err := binary.Read(c, binary.BigEndian, &lengths); err != nil {
+		return err
+	}
+	if lengths[0] > vencryptMaxCredentialLength || lengths[1] > vencryptMaxCredentialLength {
+		return errors.New("VeNCrypt: credentials too long")
+	}
+	username := make([]byte, lengths[0])
+	password := make([]byte, lengths[1])
+	if err := binary.Read(c, binary.BigEndian, &username); err != nil {
+		return err
+	}
+	if err := binary.Read(c, binary.BigEndian, &password); err != nil {
+		return err
+	}
+	if auth.Verifier == nil {
+		return errors.New("VeNCrypt: no credential verifier")
+	}
+	return auth.Verifier.Verify(username, password)
+}
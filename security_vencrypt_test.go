@@ -0,0 +1,360 @@
+package vnc2video
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCertificate returns a self signed certificate for localhost, and a pool trusting it
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// fakeVeNCryptServer runs the server side of a VeNCrypt X509Plain handshake, returning the
+// credentials it got over TLS
+func fakeVeNCryptServer(conn net.Conn, cert tls.Certificate, creds chan<- string, errs chan<- error) {
+	err := func() error {
+		if _, err := conn.Write([]byte{1, uint8(SecTypeVeNCrypt)}); err != nil {
+			return err
+		}
+		var reply [3]byte
+		// security type, then the client's VeNCrypt version after ours
+		if _, err := io.ReadFull(conn, reply[:1]); err != nil {
+			return err
+		}
+		if _, err := conn.Write([]byte{0, 2}); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply[1:]); err != nil {
+			return err
+		}
+		if reply != [3]byte{uint8(SecTypeVeNCrypt), 0, 2} {
+			return io.ErrUnexpectedEOF
+		}
+		subTypes := []SecuritySubType{SecSubTypeVeNCrypt02TLSNone, SecSubTypeVeNCrypt02X509Plain}
+		if err := binary.Write(conn, binary.BigEndian, []uint8{0, uint8(len(subTypes))}); err != nil {
+			return err
+		}
+		if err := binary.Write(conn, binary.BigEndian, subTypes); err != nil {
+			return err
+		}
+		var subType SecuritySubType
+		if err := binary.Read(conn, binary.BigEndian, &subType); err != nil {
+			return err
+		}
+		if subType != SecSubTypeVeNCrypt02X509Plain {
+			return io.ErrUnexpectedEOF
+		}
+		if _, err := conn.Write([]byte{1}); err != nil {
+			return err
+		}
+
+		tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+		var lengths [2]uint32
+		if err := binary.Read(tlsConn, binary.BigEndian, &lengths); err != nil {
+			return err
+		}
+		cred := make([]byte, lengths[0]+lengths[1])
+		if _, err := io.ReadFull(tlsConn, cred); err != nil {
+			return err
+		}
+		creds <- string(cred[:lengths[0]]) + ":" + string(cred[lengths[0]:])
+		// security result, then the first server init bytes
+		_, err := tlsConn.Write([]byte{0, 0, 0, 0, 'o', 'k'})
+		return err
+	}()
+	errs <- err
+}
+
+func TestClientAuthVeNCryptX509(t *testing.T) {
+	cert, pool := testCertificate(t)
+	server, client := net.Pipe()
+	creds := make(chan string, 1)
+	errs := make(chan error, 1)
+	go fakeVeNCryptServer(server, cert, creds, errs)
+
+	auth := &ClientAuthVeNCrypt{
+		TLSConfig: &tls.Config{RootCAs: pool, ServerName: "localhost"},
+		Username:  []byte("user"),
+		Password:  []byte("secret"),
+	}
+	cc, err := NewClientConn(client, &ClientConfig{Encodings: []Encoding{&RawEncoding{}}, SecurityHandlers: []SecurityHandler{auth}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	// closed first, the TLS close notify has no reader
+	defer server.Close()
+	if err := (&DefaultClientSecurityHandler{}).Handle(cc); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if got := <-creds; got != "user:secret" {
+		t.Fatalf("server got credentials %q", got)
+	}
+	if auth.SubType() != SecSubTypeVeNCrypt02X509Plain {
+		t.Fatalf("negotiated sub type %v", auth.SubType())
+	}
+	// the rest of the connection reads the TLS stream
+	if _, ok := cc.Conn().(*tls.Conn); !ok {
+		t.Fatalf("connection not upgraded, got %T", cc.Conn())
+	}
+	var rest [2]byte
+	if _, err := io.ReadFull(cc, rest[:]); err != nil || string(rest[:]) != "ok" {
+		t.Fatalf("read %q after the handshake, err %v", rest, err)
+	}
+}
+
+func TestClientAuthVeNCryptRejectsUnknownCA(t *testing.T) {
+	cert, _ := testCertificate(t)
+	_, otherPool := testCertificate(t)
+	server, client := net.Pipe()
+	defer server.Close()
+	go fakeVeNCryptServer(server, cert, make(chan string, 1), make(chan error, 1))
+
+	auth := &ClientAuthVeNCrypt{
+		TLSConfig: &tls.Config{RootCAs: otherPool, ServerName: "localhost"},
+		Username:  []byte("user"),
+		Password:  []byte("secret"),
+	}
+	cc, err := NewClientConn(client, &ClientConfig{Encodings: []Encoding{&RawEncoding{}}, SecurityHandlers: []SecurityHandler{auth}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	if err := (&DefaultClientSecurityHandler{}).Handle(cc); err == nil {
+		t.Fatal("handshake succeeded with an untrusted certificate")
+	}
+}
+
+func TestClientAuthVeNCryptAnonymousTLS(t *testing.T) {
+	for _, auth := range []*ClientAuthVeNCrypt{
+		{Password: []byte("secret")},
+		{SubTypes: []SecuritySubType{SecSubTypeVeNCrypt02TLSVNC}, Password: []byte("secret")},
+	} {
+		server, client := net.Pipe()
+		// a server set up without certificates, which only offers anonymous TLS
+		go func() {
+			defer server.Close()
+			server.Write([]byte{0, 2})
+			io.ReadFull(server, make([]byte, 2))
+			server.Write([]byte{0, 2})
+			binary.Write(server, binary.BigEndian, []SecuritySubType{SecSubTypeVeNCrypt02TLSVNC, SecSubTypeVeNCrypt02TLSNone})
+		}()
+		cc, err := NewClientConn(client, &ClientConfig{Encodings: []Encoding{&RawEncoding{}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = auth.Auth(cc)
+		if err == nil || !strings.Contains(err.Error(), "anonymous TLS not supported") {
+			t.Errorf("sub types %v: got error %v", auth.SubTypes, err)
+		}
+		if auth.SubType() != SecSubTypeVeNCrypt02Unknown {
+			t.Errorf("sub types %v: negotiated %v", auth.SubTypes, auth.SubType())
+		}
+		cc.Close()
+	}
+}
+
+// vencryptHandshake runs the security handshake between a VeNCrypt client and server,
+// returning the client and server errors
+func vencryptHandshake(t *testing.T, client *ClientAuthVeNCrypt, server *ServerAuthVeNCrypt) (*ClientConn, *ServerConn, error, error) {
+	sc, cc := net.Pipe()
+	serverConn, err := NewServerConn(sc, &ServerConfig{SecurityHandlers: []SecurityHandler{server}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn.SetProtoVersion(ProtoVersion38)
+	clientConn, err := NewClientConn(cc, &ClientConfig{Encodings: []Encoding{&RawEncoding{}}, SecurityHandlers: []SecurityHandler{client}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverErr := make(chan error, 1)
+	go func() { serverErr <- (&DefaultServerSecurityHandler{}).Handle(serverConn) }()
+	clientErr := (&DefaultClientSecurityHandler{}).Handle(clientConn)
+	if clientErr != nil {
+		// unblock a server waiting for the client
+		cc.Close()
+	}
+	return clientConn, serverConn, clientErr, <-serverErr
+}
+
+func TestServerAuthVeNCrypt(t *testing.T) {
+	cert, pool := testCertificate(t)
+	verifier := CredentialVerifierFunc(func(username, password []byte) error {
+		if string(username) != "user" || string(password) != "secret" {
+			return errors.New("invalid username or password")
+		}
+		return nil
+	})
+	server := &ServerAuthVeNCrypt{
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		Verifier:  verifier,
+		Password:  []byte("vncpass"),
+	}
+	noCredentials := &ServerAuthVeNCrypt{TLSConfig: server.TLSConfig}
+	clientTLS := &tls.Config{RootCAs: pool, ServerName: "localhost"}
+
+	for _, test := range []struct {
+		server  *ServerAuthVeNCrypt
+		client  *ClientAuthVeNCrypt
+		subType SecuritySubType
+		ok      bool
+	}{
+		{server, &ClientAuthVeNCrypt{TLSConfig: clientTLS, Username: []byte("user"), Password: []byte("secret")}, SecSubTypeVeNCrypt02X509Plain, true},
+		{server, &ClientAuthVeNCrypt{TLSConfig: clientTLS, Username: []byte("user"), Password: []byte("wrong")}, SecSubTypeVeNCrypt02X509Plain, false},
+		{server, &ClientAuthVeNCrypt{TLSConfig: clientTLS, Password: []byte("vncpass")}, SecSubTypeVeNCrypt02X509VNC, true},
+		{server, &ClientAuthVeNCrypt{TLSConfig: clientTLS, Password: []byte("wrong")}, SecSubTypeVeNCrypt02X509VNC, false},
+		// X509None would skip the credential checks, it is only offered by servers without them
+		{server, &ClientAuthVeNCrypt{TLSConfig: clientTLS}, 0, false},
+		{noCredentials, &ClientAuthVeNCrypt{TLSConfig: clientTLS}, SecSubTypeVeNCrypt02X509None, true},
+	} {
+		cc, sc, clientErr, serverErr := vencryptHandshake(t, test.client, test.server)
+		if test.client.SubType() != test.subType {
+			t.Errorf("negotiated %v, want %v", test.client.SubType(), test.subType)
+		}
+		if test.ok && (clientErr != nil || serverErr != nil) {
+			t.Errorf("%v: handshake failed, client error %v, server error %v", test.subType, clientErr, serverErr)
+		}
+		if !test.ok && (clientErr == nil || serverErr == nil) {
+			t.Errorf("%v: handshake succeeded with wrong credentials", test.subType)
+		}
+		if test.ok {
+			// both ends continue over TLS
+			go func() {
+				sc.Write([]byte("init"))
+				sc.Flush()
+			}()
+			var init [4]byte
+			if _, err := io.ReadFull(cc, init[:]); err != nil || string(init[:]) != "init" {
+				t.Errorf("%v: read %q after the handshake, err %v", test.subType, init, err)
+			}
+		}
+		sc.Close()
+		cc.Close()
+	}
+}
+
+func TestServerAuthVeNCryptRejectsTLSNone(t *testing.T) {
+	cert, _ := testCertificate(t)
+	sc, cc := net.Pipe()
+	defer cc.Close()
+	serverConn, err := NewServerConn(sc, &ServerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	server := &ServerAuthVeNCrypt{
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		Password:  []byte("vncpass"),
+	}
+	serverErr := make(chan error, 1)
+	go func() { serverErr <- server.Auth(serverConn) }()
+
+	// a client choosing TLSNone although it wasn't offered
+	var version [2]byte
+	if _, err := io.ReadFull(cc, version[:]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cc.Write([]byte{0, 2}); err != nil {
+		t.Fatal(err)
+	}
+	var count [2]byte
+	if _, err := io.ReadFull(cc, count[:]); err != nil {
+		t.Fatal(err)
+	}
+	subTypes := make([]SecuritySubType, count[1])
+	if err := binary.Read(cc, binary.BigEndian, subTypes); err != nil {
+		t.Fatal(err)
+	}
+	for _, subType := range subTypes {
+		if subType == SecSubTypeVeNCrypt02TLSNone {
+			t.Errorf("TLSNone offered by a password protected server: %v", subTypes)
+		}
+	}
+	if err := binary.Write(cc, binary.BigEndian, SecSubTypeVeNCrypt02TLSNone); err != nil {
+		t.Fatal(err)
+	}
+	var accepted [1]byte
+	if _, err := io.ReadFull(cc, accepted[:]); err != nil {
+		t.Fatal(err)
+	}
+	if accepted[0] != 0 {
+		t.Errorf("server accepted TLSNone")
+	}
+	if err := <-serverErr; err == nil {
+		t.Errorf("authentication succeeded with TLSNone")
+	}
+}
+
+func TestServerAuthVeNCryptSubTypes(t *testing.T) {
+	cert, _ := testCertificate(t)
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	verifier := CredentialVerifierFunc(func(username, password []byte) error { return nil })
+	for _, test := range []struct {
+		auth     *ServerAuthVeNCrypt
+		subTypes []SecuritySubType
+	}{
+		{&ServerAuthVeNCrypt{TLSConfig: tlsConfig}, []SecuritySubType{SecSubTypeVeNCrypt02X509None}},
+		// the TLS is certificate based, anonymous TLS clients couldn't complete it
+		{&ServerAuthVeNCrypt{TLSConfig: tlsConfig, SubTypes: []SecuritySubType{SecSubTypeVeNCrypt02TLSNone, SecSubTypeVeNCrypt02X509None}},
+			[]SecuritySubType{SecSubTypeVeNCrypt02X509None}},
+		{&ServerAuthVeNCrypt{TLSConfig: tlsConfig, Verifier: verifier, Password: []byte("vncpass")},
+			[]SecuritySubType{SecSubTypeVeNCrypt02X509Plain, SecSubTypeVeNCrypt02X509VNC}},
+		// without a TLS config only the plain sub types are left
+		{&ServerAuthVeNCrypt{Verifier: verifier, Password: []byte("vncpass")}, nil},
+		{&ServerAuthVeNCrypt{Verifier: verifier, SubTypes: []SecuritySubType{SecSubTypeVeNCrypt02X509Plain, SecSubTypeVeNCrypt02Plain}},
+			[]SecuritySubType{SecSubTypeVeNCrypt02Plain}},
+	} {
+		subTypes := test.auth.subTypes()
+		if len(subTypes) != len(test.subTypes) {
+			t.Errorf("offered %v, want %v", subTypes, test.subTypes)
+			continue
+		}
+		for i := range subTypes {
+			if subTypes[i] != test.subTypes[i] {
+				t.Errorf("offered %v, want %v", subTypes, test.subTypes)
+				break
+			}
+		}
+	}
+}
@@ -6,24 +6,38 @@ import "fmt"
 
 const (
 	_SecurityType_name_0 = "SecTypeUnknownSecTypeNoneSecTypeVNC"
-	_SecurityType_name_1 = "SecTypeTight"
-	_SecurityType_name_2 = "SecTypeVeNCrypt"
+	_SecurityType_name_1 = "SecTypeRA2SecTypeRA2ne"
+	_SecurityType_name_2 = "SecTypeTight"
+	_SecurityType_name_3 = "SecTypeVeNCrypt"
+	_SecurityType_name_4 = "SecTypeARD"
+	_SecurityType_name_5 = "SecTypeRA256SecTypeRAne256"
 )
 
 var (
 	_SecurityType_index_0 = [...]uint8{0, 14, 25, 35}
-	_SecurityType_index_1 = [...]uint8{0, 12}
-	_SecurityType_index_2 = [...]uint8{0, 15}
+	_SecurityType_index_1 = [...]uint8{0, 10, 22}
+	_SecurityType_index_2 = [...]uint8{0, 12}
+	_SecurityType_index_3 = [...]uint8{0, 15}
+	_SecurityType_index_4 = [...]uint8{0, 10}
+	_SecurityType_index_5 = [...]uint8{0, 12, 26}
 )
 
 func (i SecurityType) String() string {
 	switch {
 	case 0 <= i && i <= 2:
 		return _SecurityType_name_0[_SecurityType_index_0[i]:_SecurityType_index_0[i+1]]
+	case 5 <= i && i <= 6:
+		i -= 5
+		return _SecurityType_name_1[_SecurityType_index_1[i]:_SecurityType_index_1[i+1]]
 	case i == 16:
-		return _SecurityType_name_1
-	case i == 19:
 		return _SecurityType_name_2
+	case i == 19:
+		return _SecurityType_name_3
+	case i == 30:
+		return _SecurityType_name_4
+	case 129 <= i && i <= 130:
+		i -= 129
+		return _SecurityType_name_5[_SecurityType_index_5[i]:_SecurityType_index_5[i+1]]
 	default:
 		return fmt.Sprintf("SecurityType(%d)", i)
 	}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"time"
 )
 
 var _ Conn = (*ServerConn)(nil)
@@ -16,7 +17,10 @@ func (c *ServerConn) Config() interface{} {
 	return c.cfg
 }
 func (c *ServerConn) GetEncInstance(typ EncodingType) Encoding {
-	for _, enc := range c.encodings {
+	c.encMu.Lock()
+	encodings := c.encodings
+	c.encMu.Unlock()
+	for _, enc := range encodings {
 		if enc.Type() == typ {
 			return enc
 		}
@@ -29,21 +33,81 @@ func (c *ServerConn) Conn() net.Conn {
 	return c.c
 }
 
+// SetConn replaces the underlining net.Conn, used by security handlers wrapping it with TLS.
+// Buffered writes are flushed first, the new conn gets new buffers.
+func (c *ServerConn) SetConn(conn net.Conn) error {
+	if err := c.bw.Flush(); err != nil {
+		return err
+	}
+	if c.br.Buffered() > 0 {
+		return fmt.Errorf("can't replace a conn with %d unread bytes", c.br.Buffered())
+	}
+	c.c = conn
+	c.br = bufio.NewReader(conn)
+	c.bw = bufio.NewWriter(conn)
+	return nil
+}
+
 // Wait waits connection to close
 func (c *ServerConn) Wait() {
 	<-c.quit
 }
 
-// SetEncodings ??? sets server connection encodings
+// SetEncodings sets server connection encodings, in the client's order of preference
 func (c *ServerConn) SetEncodings(encs []EncodingType) error {
-	encodings := make(map[EncodingType]Encoding)
-	for _, enc := range c.cfg.Encodings {
-		encodings[enc.Type()] = enc
+	instances := make(map[EncodingType]Encoding)
+	for _, enc := range c.encInstances {
+		instances[enc.Type()] = enc
+	}
+	var encodings []Encoding
+	for _, encType := range encs {
+		if enc, ok := instances[encType]; ok {
+			encodings = append(encodings, enc)
+		}
+	}
+	// the levels are given to the encodings by the goroutine encoding the updates, see Encodings
+	compressLevel, qualityLevel := encodingLevels(encs)
+	c.encMu.Lock()
+	c.encodings = encodings
+	c.compressLevel, c.qualityLevel = compressLevel, qualityLevel
+	c.levelsChanged = true
+	c.encMu.Unlock()
+
+	// the first ExtendedDesktopSize rect tells the client the extension is supported
+	if c.GetEncInstance(EncExtendedDesktopSizePseudo) != nil {
+		c.sizeMu.Lock()
+		if !c.desktopSizeSent && c.desktopSize == nil {
+			c.desktopSize = &desktopSizeChange{reason: DesktopSizeReasonServer}
+		}
+		c.desktopSizeSent = true
+		c.sizeMu.Unlock()
+	}
+
+	// continuous updates and fences are served from the source, which announces them with the
+	// next update, the extended clipboard caps are sent right away
+	c.extMu.Lock()
+	if c.extensions == nil {
+		c.extensions = make(map[EncodingType]bool)
 	}
+	sendCaps := false
 	for _, encType := range encs {
-		if enc, ok := encodings[encType]; ok {
-			c.encodings = append(c.encodings, enc)
+		if c.extensions[encType] {
+			continue
 		}
+		switch encType {
+		case EncContinuousUpdatesPseudo, EncFencePseudo:
+			if c.cfg.Source != nil {
+				c.extensions[encType] = true
+				c.announce = append(c.announce, encType)
+			}
+		case EncExtendedClipboardPseudo:
+			c.extensions[encType] = true
+			sendCaps = true
+		}
+	}
+	c.extMu.Unlock()
+	if sendCaps {
+		c.queue(&ServerCutText{Clipboard: clipboardCaps()})
 	}
 	return nil
 }
@@ -94,6 +158,8 @@ func (c *ServerConn) DesktopName() []byte {
 
 // PixelFormat return connection pixel format
 func (c *ServerConn) PixelFormat() PixelFormat {
+	c.encMu.Lock()
+	defer c.encMu.Unlock()
 	return c.pixelFormat
 }
 
@@ -104,22 +170,40 @@ func (c *ServerConn) SetDesktopName(name []byte) {
 
 // SetPixelFormat sets pixel format for server conn
 func (c *ServerConn) SetPixelFormat(pf PixelFormat) error {
+	c.encMu.Lock()
+	defer c.encMu.Unlock()
 	c.pixelFormat = pf
 	return nil
 }
 
-// Encodings returns connection encodings
+// Encodings returns connection encodings, in the client's order of preference. The encodings
+// get the compression and quality levels the client asked for, so they are to be used by the
+// goroutine calling Encodings.
 func (c *ServerConn) Encodings() []Encoding {
+	c.encMu.Lock()
+	defer c.encMu.Unlock()
+	if c.levelsChanged {
+		for _, enc := range c.encInstances {
+			if lenc, ok := enc.(levelEncoding); ok {
+				lenc.setLevels(c.compressLevel, c.qualityLevel)
+			}
+		}
+		c.levelsChanged = false
+	}
 	return c.encodings
 }
 
 // Width returns framebuffer width
 func (c *ServerConn) Width() uint16 {
+	c.sizeMu.Lock()
+	defer c.sizeMu.Unlock()
 	return c.fbWidth
 }
 
 // Height returns framebuffer height
 func (c *ServerConn) Height() uint16 {
+	c.sizeMu.Lock()
+	defer c.sizeMu.Unlock()
 	return c.fbHeight
 }
 
@@ -139,16 +223,88 @@ func (c *ServerConn) SetSecurityHandler(sechandler SecurityHandler) error {
 	return nil
 }
 
-// SetWidth sets framebuffer width
+// SetWidth sets framebuffer width, the clients are told with the next FramebufferUpdate
 func (c *ServerConn) SetWidth(w uint16) {
-	// TODO send desktopsize pseudo encoding
-	c.fbWidth = w
+	c.setDesktopSize(w, c.Height(), nil, nil)
 }
 
-// SetHeight sets framebuffer height
+// SetHeight sets framebuffer height, the clients are told with the next FramebufferUpdate
 func (c *ServerConn) SetHeight(h uint16) {
-	//	TODO send desktopsize pseudo encoding
-	c.fbHeight = h
+	c.setDesktopSize(c.Width(), h, nil, nil)
+}
+
+// Screens returns the screen layout, a single screen of the whole framebuffer unless a client
+// set another one
+func (c *ServerConn) Screens() []Screen {
+	c.sizeMu.Lock()
+	defer c.sizeMu.Unlock()
+	if len(c.screens) == 0 {
+		return []Screen{{Width: c.fbWidth, Height: c.fbHeight}}
+	}
+	return c.screens
+}
+
+// desktopSizeChange is a desktop size change not sent to the client yet
+type desktopSizeChange struct {
+	reason uint16
+	status uint16
+}
+
+// setDesktopSize changes the framebuffer size and layout, a change is sent to the client as a
+// server side change unless given.
+func (c *ServerConn) setDesktopSize(w, h uint16, screens []Screen, change *desktopSizeChange) {
+	c.sizeMu.Lock()
+	defer c.sizeMu.Unlock()
+	if w != c.fbWidth || h != c.fbHeight {
+		c.fbWidth, c.fbHeight = w, h
+		c.screens = nil
+		if change == nil {
+			change = &desktopSizeChange{reason: DesktopSizeReasonServer}
+		}
+	}
+	if screens != nil {
+		c.screens = screens
+	}
+	if change != nil && (c.desktopSize == nil || c.desktopSize.reason == DesktopSizeReasonServer) {
+		c.desktopSize = change
+	}
+}
+
+// desktopSizeRect returns the pseudo rect telling the client about a desktop size change,
+// ExtendedDesktopSize or DesktopSize depending on its encodings, nil when there is none.
+func (c *ServerConn) desktopSizeRect() *Rectangle {
+	c.sizeMu.Lock()
+	change := c.desktopSize
+	c.desktopSize = nil
+	c.sizeMu.Unlock()
+	if change == nil {
+		return nil
+	}
+	if enc, ok := c.GetEncInstance(EncExtendedDesktopSizePseudo).(*ExtendedDesktopSizePseudoEncoding); ok {
+		enc.Screens = c.Screens()
+		return &Rectangle{X: change.reason, Y: change.status, Width: c.Width(), Height: c.Height(), EncType: EncExtendedDesktopSizePseudo, Enc: enc}
+	}
+	if change.reason == DesktopSizeReasonServer && c.GetEncInstance(EncDesktopSizePseudo) != nil {
+		return &Rectangle{Width: c.Width(), Height: c.Height(), EncType: EncDesktopSizePseudo, Enc: &DesktopSizePseudoEncoding{}}
+	}
+	return nil
+}
+
+// clientSupports returns true when the client announced the continuous updates or the fence
+// extension
+func (c *ServerConn) clientSupports(ext EncodingType) bool {
+	c.extMu.Lock()
+	defer c.extMu.Unlock()
+	return c.extensions[ext]
+}
+
+// announcements returns the extensions the client announced since the last call
+func (c *ServerConn) announcements() []EncodingType {
+	c.extMu.Lock()
+	defer c.extMu.Unlock()
+	announce := c.announce
+	c.announce = nil
+	return announce
 }
 
 // ServerConn underlining server conn
@@ -167,9 +323,20 @@ type ServerConn struct {
 	// Name associated with the desktop, sent from the server.
 	desktopName []byte
 
+	// encMu guards the encodings, the levels and the pixel format, which are set by the
+	// goroutine reading the client messages while another one encodes the updates
+	encMu sync.Mutex
 	// Encodings supported by the client. This should not be modified
 	// directly. Instead, SetEncodings() should be used.
 	encodings []Encoding
+	// compressLevel and qualityLevel are given to the encodings by Encodings when changed
+	compressLevel int
+	qualityLevel  int
+	levelsChanged bool
+
+	// Per connection copies of the configured encodings, these hold the
+	// compression stream state for this client.
+	encInstances []Encoding
 
 	securityHandler SecurityHandler
 
@@ -179,6 +346,23 @@ type ServerConn struct {
 	// Width of the frame buffer in pixels, sent to the client.
 	fbWidth uint16
 
+	// sizeMu guards the framebuffer size, the screen layout and the pending size change
+	sizeMu      sync.Mutex
+	screens     []Screen
+	desktopSize *desktopSizeChange
+	// desktopSizeSent is set once the client accepted ExtendedDesktopSize
+	desktopSizeSent bool
+
+	// extMu guards the extensions announced by the client, and the continuous updates and fence
+	// ones the server didn't answer yet
+	extMu      sync.Mutex
+	extensions map[EncodingType]bool
+	announce   []EncodingType
+
+	clipboard clipboard
+	// messages are written by the message handler, with the ones from ServerMessageCh
+	messages chan ServerMessage
+
 	// The pixel format associated with the connection. This shouldn't
 	// be modified. If you wish to set a new pixel format, use the
 	// SetPixelFormat method.
@@ -212,21 +396,37 @@ type ServerConfig struct {
 	Height           uint16
 	Width            uint16
 	ErrorCh          chan error
+	// Source, when set, is served to the clients: FramebufferUpdateRequests are answered
+	// from it instead of being sent to ClientMessageCh.
+	Source FramebufferSource
+	// UpdateInterval is how often Source is checked for damage, DefaultUpdateInterval when zero
+	UpdateInterval time.Duration
+	// ClipboardCh gets the client's clipboard, see ServerConn.SetClipboard for the server's
+	ClipboardCh chan *ClipboardEvent
 }
 
 // NewServerConn returns new  Server connection fron net.Conn
 func NewServerConn(c net.Conn, cfg *ServerConfig) (*ServerConn, error) {
+	encodings := make([]Encoding, 0, len(cfg.Encodings))
+	for _, enc := range cfg.Encodings {
+		if cenc, ok := enc.(connEncoding); ok {
+			enc = cenc.newConnEncoding()
+		}
+		encodings = append(encodings, enc)
+	}
 	return &ServerConn{
-		c:           c,
-		br:          bufio.NewReader(c),
-		bw:          bufio.NewWriter(c),
-		cfg:         cfg,
-		desktopName: cfg.DesktopName,
-		encodings:   cfg.Encodings,
-		pixelFormat: cfg.PixelFormat,
-		fbWidth:     cfg.Width,
-		fbHeight:    cfg.Height,
-		quit:        make(chan struct{}),
+		c:            c,
+		br:           bufio.NewReader(c),
+		bw:           bufio.NewWriter(c),
+		cfg:          cfg,
+		desktopName:  cfg.DesktopName,
+		encodings:    encodings,
+		encInstances: encodings,
+		pixelFormat:  cfg.PixelFormat,
+		fbWidth:      cfg.Width,
+		fbHeight:     cfg.Height,
+		quit:         make(chan struct{}),
+		messages:     make(chan ServerMessage, 16),
 	}, nil
 }
 
@@ -278,7 +478,32 @@ func (*DefaultServerMessageHandler) Handle(c Conn) error {
 	}
 	wg.Add(2)
 
+	// both goroutines stop when one of them fails
 	quit := make(chan struct{})
+	var quitOnce sync.Once
+	stop := func() { quitOnce.Do(func() { close(quit) }) }
+
+	// update requests, resize requests, continuous updates, fences and pixel formats are handled
+	// by the server goroutine in the order they came, so the updates don't interleave with the
+	// messages from ServerMessageCh and each is encoded in a single pixel format
+	var sourceMsgs chan ClientMessage
+	var updateTick <-chan time.Time
+	scheduler := &updateScheduler{source: cfg.Source}
+	if cfg.Source != nil {
+		sourceMsgs = make(chan ClientMessage, 1)
+		interval := cfg.UpdateInterval
+		if interval <= 0 {
+			interval = DefaultUpdateInterval
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		updateTick = ticker.C
+	}
+
+	var serverMsgs chan ServerMessage
+	if sc, ok := c.(*ServerConn); ok {
+		serverMsgs = sc.messages
+	}
 
 	// server
 	go func() {
@@ -287,13 +512,28 @@ func (*DefaultServerMessageHandler) Handle(c Conn) error {
 			select {
 			case <-quit:
 				return
+			case msg := <-sourceMsgs:
+				if err = scheduler.handle(c, msg); err != nil {
+					cfg.ErrorCh <- err
+					stop()
+					return
+				}
+			case <-updateTick:
+				if err = scheduler.update(c); err != nil {
+					cfg.ErrorCh <- err
+					stop()
+					return
+				}
 			case msg := <-cfg.ServerMessageCh:
 				if err = msg.Write(c); err != nil {
 					cfg.ErrorCh <- err
-					if quit != nil {
-						close(quit)
-						quit = nil
-					}
+					stop()
+					return
+				}
+			case msg := <-serverMsgs:
+				if err = msg.Write(c); err != nil {
+					cfg.ErrorCh <- err
+					stop()
 					return
 				}
 			}
@@ -311,28 +551,42 @@ func (*DefaultServerMessageHandler) Handle(c Conn) error {
 				var messageType ClientMessageType
 				if err := binary.Read(c, binary.BigEndian, &messageType); err != nil {
 					cfg.ErrorCh <- err
-					if quit != nil {
-						close(quit)
-						quit = nil
-					}
+					stop()
 					return
 				}
 				msg, ok := clientMessages[messageType]
 				if !ok {
 					cfg.ErrorCh <- fmt.Errorf("unsupported message-type: %v", messageType)
-					close(quit)
+					stop()
 					return
 				}
 				parsedMsg, err := msg.Read(c)
 				if err != nil {
 					cfg.ErrorCh <- err
-					if quit != nil {
-						close(quit)
-						quit = nil
-					}
+					stop()
 					return
 				}
-				cfg.ClientMessageCh <- parsedMsg
+				if sourceMsgs != nil && handledBySource(parsedMsg) {
+					select {
+					case sourceMsgs <- parsedMsg:
+					case <-quit:
+						return
+					}
+					continue
+				}
+				if msg, ok := parsedMsg.(*SetPixelFormat); ok {
+					if err := c.SetPixelFormat(msg.PF); err != nil {
+						cfg.ErrorCh <- err
+						stop()
+						return
+					}
+				}
+				if sc, ok := c.(*ServerConn); ok {
+					sc.handleClipboard(parsedMsg)
+				}
+				if cfg.ClientMessageCh != nil {
+					cfg.ClientMessageCh <- parsedMsg
+				}
 			}
 		}
 	}()
@@ -0,0 +1,427 @@
+package vnc2video
+
+import (
+	"image"
+	"image/draw"
+	"sync"
+	"time"
+
+	"github.com/amitbet/vnc2video/logger"
+)
+
+// DefaultUpdateInterval is how often pending incremental update requests are checked for damage
+const DefaultUpdateInterval = 40 * time.Millisecond
+
+const (
+	// damage older than this many Invalidate calls is forgotten, clients that fall behind get a full update
+	imageSourceMaxDamage = 256
+	// updates with more damaged rects are sent as their bounding box instead
+	maxUpdateRects = 64
+	// continuous updates are held back while this many of the fences following them aren't
+	// answered, which bounds the updates in flight on slow links
+	continuousUpdatesWindow = 2
+)
+
+// FramebufferSource provides the framebuffer served by a ServerConn and tracks which parts of it changed.
+type FramebufferSource interface {
+	// Image returns the current framebuffer image.
+	Image() draw.Image
+	// Damaged returns the regions changed since the given version together with the current
+	// version, version 0 always returns the whole framebuffer.
+	Damaged(since uint64) ([]image.Rectangle, uint64)
+}
+
+// DesktopResizer is implemented by the FramebufferSources clients can resize with SetDesktopSize,
+// the image returned by Image is expected to have the new size once ResizeDesktop succeeds.
+type DesktopResizer interface {
+	ResizeDesktop(width, height uint16, screens []Screen) error
+}
+
+type sourceDamage struct {
+	version uint64
+	rect    image.Rectangle
+}
+
+// ImageSource is a FramebufferSource serving an image, such as a VncCanvas, whose
+// changes are reported with Invalidate.
+type ImageSource struct {
+	mu      sync.Mutex
+	img     draw.Image
+	version uint64
+	// highest version whose damage was dropped from the log
+	dropped uint64
+	damage  []sourceDamage
+}
+
+// NewImageSource returns a FramebufferSource serving img
+func NewImageSource(img draw.Image) *ImageSource {
+	return &ImageSource{img: img, version: 1}
+}
+
+// Image returns the served image
+func (s *ImageSource) Image() draw.Image {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.img
+}
+
+// SetImage replaces the served image, which may have another size, and marks it all as changed
+func (s *ImageSource) SetImage(img draw.Image) {
+	s.mu.Lock()
+	s.img = img
+	s.mu.Unlock()
+	s.Invalidate()
+}
+
+// Invalidate marks regions of the image as changed, the whole image when no region is given
+func (s *ImageSource) Invalidate(rects ...image.Rectangle) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(rects) == 0 {
+		rects = []image.Rectangle{s.img.Bounds()}
+	}
+	s.version++
+	for _, r := range rects {
+		s.damage = append(s.damage, sourceDamage{version: s.version, rect: r})
+	}
+	if len(s.damage) > imageSourceMaxDamage {
+		drop := len(s.damage) - imageSourceMaxDamage
+		s.dropped = s.damage[drop-1].version
+		s.damage = append(s.damage[:0], s.damage[drop:]...)
+	}
+}
+
+// Damaged implements FramebufferSource
+func (s *ImageSource) Damaged(since uint64) ([]image.Rectangle, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if since == 0 || since < s.dropped {
+		return []image.Rectangle{s.img.Bounds()}, s.version
+	}
+	var rects []image.Rectangle
+	for _, d := range s.damage {
+		if d.version > since {
+			rects = append(rects, d.rect)
+		}
+	}
+	return rects, s.version
+}
+
+// serverUpdateEncodings are the encodings able to encode an arbitrary region of a source image
+var serverUpdateEncodings = map[EncodingType]bool{
+	EncRaw:     true,
+	EncRRE:     true,
+	EncHextile: true,
+	EncZlib:    true,
+	EncTight:   true,
+	EncZRLE:    true,
+}
+
+// updateScheduler answers a connection's FramebufferUpdateRequests from a FramebufferSource,
+// holding incremental requests back until the requested region is damaged.
+type updateScheduler struct {
+	source  FramebufferSource
+	pending *FramebufferUpdateRequest
+	// source version the client was last updated to
+	version uint64
+	// unsent is the damage up to version outside of the regions requested so far
+	unsent []image.Rectangle
+	// continuous is an incremental request standing for the region of continuous updates,
+	// nil unless the client enabled them
+	continuous *FramebufferUpdateRequest
+	// fences is the number of fences sent after continuous updates and not answered yet
+	fences int
+}
+
+// handledBySource returns true for the client messages answered by an updateScheduler, a new
+// pixel format is among them so that it doesn't change in the middle of an update
+func handledBySource(msg ClientMessage) bool {
+	switch msg.(type) {
+	case *FramebufferUpdateRequest, *SetDesktopSize, *EnableContinuousUpdates, *ClientFence, *SetPixelFormat:
+		return true
+	}
+	return false
+}
+
+// handle answers a client message for which handledBySource is true
+func (s *updateScheduler) handle(c Conn, msg ClientMessage) error {
+	switch msg := msg.(type) {
+	case *FramebufferUpdateRequest:
+		s.request(msg)
+	case *SetDesktopSize:
+		s.resize(c, msg)
+		return nil
+	case *SetPixelFormat:
+		return c.SetPixelFormat(msg.PF)
+	case *EnableContinuousUpdates:
+		if err := s.enableContinuous(c, msg); err != nil {
+			return err
+		}
+	case *ClientFence:
+		if err := s.fence(c, msg); err != nil {
+			return err
+		}
+	}
+	return s.update(c)
+}
+
+// request records a FramebufferUpdateRequest, merging it with a still pending one
+func (s *updateScheduler) request(req *FramebufferUpdateRequest) {
+	s.pending = mergeUpdateRequests(s.pending, req)
+}
+
+// mergeUpdateRequests returns a request covering both requests, incremental when both are
+func mergeUpdateRequests(a, b *FramebufferUpdateRequest) *FramebufferUpdateRequest {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	region := vncRequestRect(a).Union(vncRequestRect(b))
+	inc := a.Inc
+	if b.Inc == 0 {
+		inc = 0
+	}
+	return &FramebufferUpdateRequest{
+		Inc:    inc,
+		X:      uint16(region.Min.X),
+		Y:      uint16(region.Min.Y),
+		Width:  uint16(region.Dx()),
+		Height: uint16(region.Dy()),
+	}
+}
+
+// enableContinuous starts or stops continuous updates, stopping them is confirmed with
+// EndOfContinuousUpdates
+func (s *updateScheduler) enableContinuous(c Conn, msg *EnableContinuousUpdates) error {
+	if msg.Enable != 0 {
+		s.continuous = &FramebufferUpdateRequest{Inc: 1, X: msg.X, Y: msg.Y, Width: msg.Width, Height: msg.Height}
+		return nil
+	}
+	s.continuous = nil
+	s.fences = 0
+	return (&EndOfContinuousUpdates{}).Write(c)
+}
+
+// fence answers a fence request of the client, or counts the answer to a fence sent after a
+// continuous update. Messages are handled in order, which is all the flags can ask for.
+func (s *updateScheduler) fence(c Conn, msg *ClientFence) error {
+	if msg.Flags&FenceRequest != 0 {
+		return (&ServerFence{Flags: msg.Flags & fenceFlags, Payload: msg.Payload}).Write(c)
+	}
+	if s.fences > 0 {
+		s.fences--
+	}
+	return nil
+}
+
+// announce tells the client about the extensions it announced, a first EndOfContinuousUpdates
+// says continuous updates are supported and a first fence request lets the client send fences.
+func (s *updateScheduler) announce(c Conn) error {
+	sc, ok := c.(*ServerConn)
+	if !ok {
+		return nil
+	}
+	for _, ext := range sc.announcements() {
+		var msg ServerMessage = &EndOfContinuousUpdates{}
+		if ext == EncFencePseudo {
+			msg = &ServerFence{Flags: FenceRequest}
+		}
+		if err := msg.Write(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// update sends a FramebufferUpdate for the pending request or the continuous updates if there
+// is something to send, damage outside of the requested region is kept for later requests.
+// Continuous updates are followed by a fence when the client supports them, and held back
+// while continuousUpdatesWindow fences aren't answered.
+func (s *updateScheduler) update(c Conn) error {
+	if err := s.announce(c); err != nil {
+		return err
+	}
+	req := s.pending
+	continuous := s.continuous != nil && s.fences < continuousUpdatesWindow
+	if continuous {
+		req = mergeUpdateRequests(req, s.continuous)
+	}
+	if req == nil {
+		return nil
+	}
+	img := s.source.Image()
+	region := vncRequestRect(req).Intersect(img.Bounds())
+
+	// a resized framebuffer is announced with a pseudo rect, followed by all of it
+	var sizeRect *Rectangle
+	if sc, ok := c.(*ServerConn); ok {
+		size := img.Bounds().Size()
+		sc.setDesktopSize(uint16(size.X), uint16(size.Y), nil, nil)
+		sizeRect = sc.desktopSizeRect()
+	}
+
+	var rects []image.Rectangle
+	if sizeRect != nil {
+		rects = []image.Rectangle{img.Bounds()}
+		_, s.version = s.source.Damaged(s.version)
+		s.unsent = nil
+	} else if req.Inc == 0 {
+		rects = []image.Rectangle{region}
+		s.takeDamage(region, img.Bounds())
+	} else if rects = s.takeDamage(region, img.Bounds()); len(rects) == 0 {
+		return nil
+	}
+	if len(rects) > maxUpdateRects {
+		union := rects[0]
+		for _, r := range rects[1:] {
+			union = union.Union(r)
+		}
+		rects = []image.Rectangle{union}
+	}
+
+	enc := updateEncoding(c)
+	enc.(Renderer).SetTargetImage(img)
+
+	msg := &FramebufferUpdate{}
+	if sizeRect != nil {
+		msg.Rects = append(msg.Rects, sizeRect)
+	}
+	for _, r := range rects {
+		if r.Empty() {
+			continue
+		}
+		for _, tile := range splitUpdateRect(r, enc.Type()) {
+			msg.Rects = append(msg.Rects, &Rectangle{
+				X:       uint16(tile.Min.X),
+				Y:       uint16(tile.Min.Y),
+				Width:   uint16(tile.Dx()),
+				Height:  uint16(tile.Dy()),
+				EncType: enc.Type(),
+				Enc:     enc,
+			})
+		}
+	}
+	msg.NumRect = uint16(len(msg.Rects))
+	s.pending = nil
+	logger.Tracef("sending framebuffer update with %d rects using %s", msg.NumRect, enc.Type())
+	if err := msg.Write(c); err != nil {
+		return err
+	}
+	if sc, ok := c.(*ServerConn); ok && continuous && sc.clientSupports(EncFencePseudo) {
+		s.fences++
+		return (&ServerFence{Flags: FenceRequest | FenceBlockBefore}).Write(c)
+	}
+	return nil
+}
+
+// takeDamage returns the damage within region the client wasn't sent yet, the damage outside
+// of it is kept in s.unsent
+func (s *updateScheduler) takeDamage(region, bounds image.Rectangle) []image.Rectangle {
+	damaged, version := s.source.Damaged(s.version)
+	s.version = version
+	var rects, unsent []image.Rectangle
+	for _, r := range append(s.unsent, damaged...) {
+		if r = r.Intersect(bounds); r.Empty() {
+			continue
+		}
+		if in := r.Intersect(region); !in.Empty() {
+			rects = append(rects, in)
+		}
+		unsent = append(unsent, subtractRect(r, region)...)
+	}
+	if len(unsent) > maxUpdateRects {
+		union := unsent[0]
+		for _, r := range unsent[1:] {
+			union = union.Union(r)
+		}
+		unsent = []image.Rectangle{union}
+	}
+	s.unsent = unsent
+	return rects
+}
+
+// subtractRect returns the parts of r outside of region, as up to four rects
+func subtractRect(r, region image.Rectangle) []image.Rectangle {
+	in := r.Intersect(region)
+	if in.Empty() {
+		return []image.Rectangle{r}
+	}
+	var parts []image.Rectangle
+	for _, part := range []image.Rectangle{
+		image.Rect(r.Min.X, r.Min.Y, r.Max.X, in.Min.Y),
+		image.Rect(r.Min.X, in.Max.Y, r.Max.X, r.Max.Y),
+		image.Rect(r.Min.X, in.Min.Y, in.Min.X, in.Max.Y),
+		image.Rect(in.Max.X, in.Min.Y, r.Max.X, in.Max.Y),
+	} {
+		if !part.Empty() {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// resize answers a SetDesktopSize request, which succeeds when the source is a DesktopResizer
+// accepting it. The client gets the result with its next update.
+func (s *updateScheduler) resize(c Conn, msg *SetDesktopSize) {
+	status := DesktopSizeStatusProhibited
+	if msg.Width == 0 || msg.Height == 0 || len(msg.Screens) == 0 {
+		status = DesktopSizeStatusInvalidLayout
+	} else if resizer, ok := s.source.(DesktopResizer); ok {
+		if err := resizer.ResizeDesktop(msg.Width, msg.Height, msg.Screens); err != nil {
+			logger.Errorf("desktop resize to %dx%d failed: %v", msg.Width, msg.Height, err)
+			status = DesktopSizeStatusOutOfResources
+		} else {
+			status = DesktopSizeStatusOK
+		}
+	}
+	sc, ok := c.(*ServerConn)
+	if !ok {
+		return
+	}
+	change := &desktopSizeChange{reason: DesktopSizeReasonClient, status: status}
+	if status == DesktopSizeStatusOK {
+		size := s.source.Image().Bounds().Size()
+		sc.setDesktopSize(uint16(size.X), uint16(size.Y), msg.Screens, change)
+	} else {
+		sc.setDesktopSize(sc.Width(), sc.Height(), nil, change)
+	}
+}
+
+// updateEncoding picks the client's most preferred encoding that can encode the source
+// image, falling back to raw which every client must accept.
+func updateEncoding(c Conn) Encoding {
+	for _, enc := range c.Encodings() {
+		if _, ok := enc.(Renderer); ok && serverUpdateEncodings[enc.Type()] && enc.Supported(c) {
+			return enc
+		}
+	}
+	if sc, ok := c.(*ServerConn); ok {
+		for _, enc := range sc.encInstances {
+			if enc.Type() == EncRaw {
+				return enc
+			}
+		}
+	}
+	return &RawEncoding{}
+}
+
+// splitUpdateRect cuts a rect into pieces small enough for the encoding, tight limits the rect size
+func splitUpdateRect(r image.Rectangle, encType EncodingType) []image.Rectangle {
+	if encType != EncTight {
+		return []image.Rectangle{r}
+	}
+	var tiles []image.Rectangle
+	tileHeight := TightMaxRectSize / Min(r.Dx(), TightMaxRectWidth)
+	for y := r.Min.Y; y < r.Max.Y; y += tileHeight {
+		for x := r.Min.X; x < r.Max.X; x += TightMaxRectWidth {
+			tiles = append(tiles, image.Rect(x, y, Min(x+TightMaxRectWidth, r.Max.X), Min(y+tileHeight, r.Max.Y)))
+		}
+	}
+	return tiles
+}
+
+func vncRequestRect(req *FramebufferUpdateRequest) image.Rectangle {
+	return MakeRect(int(req.X), int(req.Y), int(req.Width), int(req.Height))
+}
@@ -0,0 +1,299 @@
+package vnc2video
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestImageSourceDamaged(t *testing.T) {
+	src := NewImageSource(image.NewRGBA(image.Rect(0, 0, 64, 64)))
+	rects, version := src.Damaged(0)
+	if len(rects) != 1 || rects[0] != src.Image().Bounds() {
+		t.Fatalf("version 0 should return the whole image, got %v", rects)
+	}
+	if rects, _ = src.Damaged(version); len(rects) != 0 {
+		t.Fatalf("expected no damage, got %v", rects)
+	}
+	src.Invalidate(image.Rect(1, 2, 3, 4))
+	rects, version = src.Damaged(version)
+	if len(rects) != 1 || rects[0] != image.Rect(1, 2, 3, 4) {
+		t.Fatalf("got damage %v", rects)
+	}
+
+	for i := 0; i < imageSourceMaxDamage+1; i++ {
+		src.Invalidate(image.Rect(0, 0, 1, 1))
+	}
+	if rects, _ = src.Damaged(version); len(rects) != 1 || rects[0] != src.Image().Bounds() {
+		t.Fatalf("a client behind the damage log should get the whole image, got %v", rects)
+	}
+}
+
+// readUpdate decodes a FramebufferUpdate written to conn with the given encodings
+func readUpdate(t *testing.T, conn *bufferConn, encodings ...Encoding) *FramebufferUpdate {
+	serverEncodings := conn.encodings
+	conn.encodings = encodings
+	defer func() { conn.encodings = serverEncodings }()
+
+	var msgType ServerMessageType
+	if err := binary.Read(conn, binary.BigEndian, &msgType); err != nil {
+		t.Fatal(err)
+	}
+	if msgType != FramebufferUpdateMsgType {
+		t.Fatalf("got message type %v", msgType)
+	}
+	msg, err := (&FramebufferUpdate{}).Read(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg.(*FramebufferUpdate)
+}
+
+func TestUpdateScheduler(t *testing.T) {
+	img := testSourceImage(100, 70)
+	src := NewImageSource(img)
+	dst := NewRGBImage(img.Bounds())
+	conn := &bufferConn{pf: PixelFormat32bit, encodings: []Encoding{&CopyRectEncoding{}, &HextileEncoding{}, &RawEncoding{}}}
+	scheduler := &updateScheduler{source: src}
+
+	scheduler.request(&FramebufferUpdateRequest{Inc: 0, Width: 100, Height: 70})
+	if err := scheduler.update(conn); err != nil {
+		t.Fatal(err)
+	}
+	update := readUpdate(t, conn, &HextileEncoding{Image: dst}, &RawEncoding{Image: dst})
+	if update.NumRect != 1 || update.Rects[0].EncType != EncHextile {
+		t.Fatalf("expected one hextile rect, got %v", update)
+	}
+
+	// incremental requests wait for damage
+	scheduler.request(&FramebufferUpdateRequest{Inc: 1, Width: 100, Height: 70})
+	if err := scheduler.update(conn); err != nil {
+		t.Fatal(err)
+	}
+	if conn.Len() != 0 {
+		t.Fatalf("update sent without damage")
+	}
+
+	img.Set(90, 5, color.RGBA{R: 1, G: 2, B: 3, A: 255})
+	src.Invalidate(image.Rect(90, 5, 91, 6), image.Rect(200, 200, 210, 210))
+	if err := scheduler.update(conn); err != nil {
+		t.Fatal(err)
+	}
+	update = readUpdate(t, conn, &HextileEncoding{Image: dst}, &RawEncoding{Image: dst})
+	if update.NumRect != 1 || *update.Rects[0] != (Rectangle{X: 90, Y: 5, Width: 1, Height: 1, EncType: EncHextile, Enc: update.Rects[0].Enc}) {
+		t.Fatalf("expected the damaged pixel only, got %v", update)
+	}
+	if got := rgbaAt(dst, 90, 5); got.R != 1 || got.G != 2 || got.B != 3 {
+		t.Fatalf("damaged pixel not updated, got %v", got)
+	}
+	if scheduler.pending != nil {
+		t.Fatalf("request still pending after the update")
+	}
+}
+
+func TestUpdateSchedulerRegions(t *testing.T) {
+	src := NewImageSource(testSourceImage(100, 70))
+	dst := NewRGBImage(src.Image().Bounds())
+	conn := &bufferConn{pf: PixelFormat32bit, encodings: []Encoding{&RawEncoding{}}}
+	scheduler := &updateScheduler{source: src}
+	scheduler.request(&FramebufferUpdateRequest{Inc: 0, Width: 100, Height: 70})
+	if err := scheduler.update(conn); err != nil {
+		t.Fatal(err)
+	}
+	readUpdate(t, conn, &RawEncoding{Image: dst})
+
+	// a client polling each half gets the damage of each half, the rect across both is split
+	src.Invalidate(image.Rect(10, 10, 20, 20), image.Rect(60, 40, 70, 50), image.Rect(40, 0, 60, 5))
+	for _, test := range []struct {
+		req   *FramebufferUpdateRequest
+		rects []image.Rectangle
+	}{
+		{&FramebufferUpdateRequest{Inc: 1, Width: 50, Height: 70}, []image.Rectangle{image.Rect(10, 10, 20, 20), image.Rect(40, 0, 50, 5)}},
+		{&FramebufferUpdateRequest{Inc: 1, X: 50, Width: 50, Height: 70}, []image.Rectangle{image.Rect(60, 40, 70, 50), image.Rect(50, 0, 60, 5)}},
+	} {
+		scheduler.request(test.req)
+		if err := scheduler.update(conn); err != nil {
+			t.Fatal(err)
+		}
+		update := readUpdate(t, conn, &RawEncoding{Image: dst})
+		var rects []image.Rectangle
+		for _, r := range update.Rects {
+			rects = append(rects, MakeRect(int(r.X), int(r.Y), int(r.Width), int(r.Height)))
+		}
+		if len(rects) != len(test.rects) {
+			t.Fatalf("request %v: got rects %v, want %v", test.req, rects, test.rects)
+		}
+		for i := range rects {
+			if rects[i] != test.rects[i] {
+				t.Fatalf("request %v: got rects %v, want %v", test.req, rects, test.rects)
+			}
+		}
+	}
+
+	// both halves are up to date
+	scheduler.request(&FramebufferUpdateRequest{Inc: 1, Width: 100, Height: 70})
+	if err := scheduler.update(conn); err != nil {
+		t.Fatal(err)
+	}
+	if conn.Len() != 0 || len(scheduler.unsent) != 0 {
+		t.Fatalf("sent damage twice, %d bytes, unsent %v", conn.Len(), scheduler.unsent)
+	}
+}
+
+func TestServerConnEncodings(t *testing.T) {
+	// a config encoding which already compressed rects has zlib streams the conns mustn't share
+	tight := &TightEncoding{Image: testSourceImage(100, 70)}
+	if err := tight.Write(&bufferConn{pf: PixelFormat32bit}, &Rectangle{Width: 100, Height: 70, EncType: EncTight, Enc: tight}); err != nil {
+		t.Fatal(err)
+	}
+	if tight.encoders == [4]*zlib.Writer{} {
+		t.Fatal("no zlib stream started")
+	}
+	cfg := &ServerConfig{Encodings: []Encoding{tight, &RawEncoding{}, &LastRectPseudoEncoding{}}}
+	a, _ := NewServerConn(&recordConn{}, cfg)
+	b, _ := NewServerConn(&recordConn{}, cfg)
+	for i, enc := range cfg.Encodings {
+		if _, ok := enc.(connEncoding); !ok {
+			if a.encInstances[i] != enc || b.encInstances[i] != enc {
+				t.Errorf("%v: stateless encoding not shared", enc.Type())
+			}
+			continue
+		}
+		if a.encInstances[i] == enc || b.encInstances[i] == enc || a.encInstances[i] == b.encInstances[i] {
+			t.Errorf("%v: encoding shared between conns", enc.Type())
+		}
+	}
+	for _, conn := range []*ServerConn{a, b} {
+		enc := conn.encInstances[0].(*TightEncoding)
+		if enc.Image != tight.Image || enc.encoders != [4]*zlib.Writer{} {
+			t.Errorf("got tight encoding %+v", enc)
+		}
+	}
+}
+
+func TestSplitUpdateRect(t *testing.T) {
+	tiles := splitUpdateRect(image.Rect(0, 0, 3000, 100), EncTight)
+	area := 0
+	for _, tile := range tiles {
+		if tile.Dx() > TightMaxRectWidth || tile.Dx()*tile.Dy() > TightMaxRectSize {
+			t.Fatalf("tile %v too large for tight", tile)
+		}
+		area += tile.Dx() * tile.Dy()
+	}
+	if area != 3000*100 {
+		t.Fatalf("tiles cover %d pixels, want %d", area, 3000*100)
+	}
+}
+
+func TestServerMessageHandlerEncodings(t *testing.T) {
+	// the client changes its encodings and pixel format while the updates are encoded, run with
+	// -race to check they are only shared under the lock
+	source := NewImageSource(testSourceImage(100, 70))
+	sc, cc := net.Pipe()
+	errs := make(chan error, 4)
+	server, err := NewServerConn(sc, &ServerConfig{
+		PixelFormat:    PixelFormat32bit,
+		Encodings:      []Encoding{&RawEncoding{}, &TightEncoding{}, &ZRLEEncoding{}},
+		Messages:       DefaultClientMessages,
+		Source:         source,
+		UpdateInterval: time.Millisecond,
+		ErrorCh:        errs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		(&DefaultServerMessageHandler{}).Handle(server)
+		close(done)
+	}()
+	go io.Copy(ioutil.Discard, cc)
+	// the source changes all the time, the pending requests are answered by the ticker
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond / 2):
+				source.Invalidate(image.Rect(i%90, 0, i%90+10, 70))
+			}
+		}
+	}()
+
+	pf16 := NewPixelFormat(16)
+	msgs := &bufferConn{pf: PixelFormat32bit}
+	for i := 0; i < 200; i++ {
+		encodings := []EncodingType{EncTight, EncCompressionLevel1, EncJPEGQualityLevelPseudo5, EncRaw}
+		pf := PixelFormat32bit
+		if i%2 == 1 {
+			encodings = []EncodingType{EncZRLE, EncCompressionLevel9, EncRaw}
+			pf = pf16
+		}
+		(&SetPixelFormat{PF: pf}).Write(msgs)
+		(&SetEncodings{EncNum: uint16(len(encodings)), Encodings: encodings}).Write(msgs)
+		(&FramebufferUpdateRequest{Inc: 1, Width: 100, Height: 70}).Write(msgs)
+		if _, err := cc.Write(msgs.Next(msgs.Len())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cc.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler didn't return")
+	}
+}
+
+func TestServerMessageHandlerPixelFormat(t *testing.T) {
+	img := NewRGBImage(image.Rect(0, 0, 2, 1))
+	img.Set(0, 0, color.RGBA{R: 255, A: 255})
+	img.Set(1, 0, color.RGBA{B: 255, A: 255})
+	sc, cc := net.Pipe()
+	defer cc.Close()
+	server, err := NewServerConn(sc, &ServerConfig{
+		PixelFormat:    PixelFormat32bit,
+		Encodings:      []Encoding{&RawEncoding{}},
+		Messages:       DefaultClientMessages,
+		Source:         NewImageSource(img),
+		UpdateInterval: time.Hour,
+		Width:          2,
+		Height:         1,
+		ErrorCh:        make(chan error, 4),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go (&DefaultServerMessageHandler{}).Handle(server)
+
+	// each update following a SetPixelFormat is in the new format: 16 bit RGB555, then 32 bit
+	header := []byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 2, 0, 1, 0, 0, 0, 0}
+	for _, test := range []struct {
+		pf     PixelFormat
+		pixels []byte
+	}{
+		{PixelFormatAten, []byte{0x00, 0x7c, 0x1f, 0x00}},
+		{PixelFormat32bit, []byte{0x00, 0x00, 0xff, 0x00, 0xff, 0x00, 0x00, 0x00}},
+	} {
+		msgs := &bufferConn{}
+		(&SetPixelFormat{PF: test.pf}).Write(msgs)
+		(&FramebufferUpdateRequest{Width: 2, Height: 1}).Write(msgs)
+		if _, err := cc.Write(msgs.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		want := append(append([]byte{}, header...), test.pixels...)
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(cc, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%d bpp: got update %x, want %x", test.pf.BPP, got, want)
+		}
+	}
+}